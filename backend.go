@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+//Backend is where a Store keeps its objects and their metadata. The
+//Store builds everything else (chunking, checksums, quarantine) on
+//top of these few operations, so any backend gets all of it.
+type Backend interface{
+	//Put starts writing the object, nothing replaces what is stored
+	//under id and key until the returned writer is committed
+	Put(id string, key string) (BlobWriter, error)
+	//Get streams the whole object and returns its size
+	Get(id string, key string) (int64, io.ReadCloser, error)
+	//ReadRange streams length bytes of the object starting at offset,
+	//a length of 0 reads to the end. The returned size is the number
+	//of bytes the reader will produce.
+	ReadRange(id string, key string, offset int64, length int64) (int64, io.ReadCloser, error)
+	//Stat returns the metadata of the object, an error wrapping
+	//os.ErrNotExist if there is no such object
+	Stat(id string, key string) (ObjectMeta, error)
+	//SetMeta replaces the metadata of an object that is already stored
+	SetMeta(meta ObjectMeta) error
+	Delete(id string, key string) error
+	//List returns the objects of id whose key starts with prefix, sorted by key
+	List(id string, prefix string) ([]ObjectMeta, error)
+	//IDs returns every ID that has objects, sorted
+	IDs() ([]string, error)
+	//Clear removes everything the backend holds
+	Clear() error
+}
+
+//BlobWriter is an object being written to a Backend
+type BlobWriter interface{
+	io.Writer
+	//Commit puts the written bytes in place of the object together
+	//with its metadata, readers see either the old object or the new one
+	Commit(meta ObjectMeta) error
+	//Abort throws the written bytes away, it does nothing after Commit
+	Abort()
+}
+
+func errNotExist(id string, key string) error{
+	return fmt.Errorf("[%s] of (%s): %w", key, id, os.ErrNotExist)
+}
+
+//rangeSize works out how many bytes a range read of an object of
+//size bytes returns, a length of 0 means until the end
+func rangeSize(key string, size int64, offset int64, length int64) (int64, error){
+	if offset < 0 || length < 0{
+		return 0, fmt.Errorf("invalid range offset (%d) length (%d)", offset, length)
+	}
+	if offset > size{
+		return 0, fmt.Errorf("offset (%d) is past the end of [%s] (%d bytes)", offset, key, size)
+	}
+
+	n := size - offset
+	if length > 0 && length < n{
+		n = length
+	}
+	return n, nil
+}
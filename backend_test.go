@@ -0,0 +1,759 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testBackends(t *testing.T) map[string]Backend {
+	pack, err := NewPackBackend(PackBackendOpts{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pack.Close() })
+
+	tiered, err := NewTieredBackend(TieredBackendOpts{Tiers: []Tier{
+		{Name: "hot", Backend: NewMemoryBackend()},
+		{Name: "cold", Backend: NewMemoryBackend(), Codec: GzipCodec{}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jbod, err := NewJBODBackend(JBODBackendOpts{
+		Roots:             []string{t.TempDir(), t.TempDir()},
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]Backend{
+		"fs": NewFSBackend(FSBackendOpts{
+			Root:              t.TempDir(),
+			PathTransformFunc: CASPathTransformFunc,
+		}),
+		"memory":    NewMemoryBackend(),
+		"pack":      pack,
+		"tiered":    tiered,
+		"jbod":      jbod,
+		"encrypted": NewEncryptedBackend(NewMemoryBackend(), []byte("node key")),
+	}
+}
+
+func putBlob(t *testing.T, b Backend, id string, key string, data []byte) {
+	w, err := b.Put(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ObjectMeta{Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	for name, b := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			id := generateID()
+			for i := 0; i < 5; i++ {
+				key := fmt.Sprintf("logs/%d", i)
+				putBlob(t, b, id, key, []byte(key+" contents"))
+			}
+
+			//nothing is stored until the writer is committed
+			w, err := b.Put(id, "aborted")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte("never stored"))
+			w.Abort()
+			if _, err := b.Stat(id, "aborted"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("aborted object is stored: %v", err)
+			}
+
+			n, r, err := b.ReadRange(id, "logs/3", 7, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(r)
+			r.Close()
+			if n != 3 || string(data) != "con" {
+				t.Errorf("have range %q (%d)", data, n)
+			}
+
+			meta, err := b.Stat(id, "logs/3")
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta.Metadata = map[string]string{"owner": "ci"}
+			if err := b.SetMeta(meta); err != nil {
+				t.Fatal(err)
+			}
+			if meta, _ := b.Stat(id, "logs/3"); meta.Metadata["owner"] != "ci" || meta.Size != 15 {
+				t.Errorf("unexpected metadata %+v", meta)
+			}
+
+			if err := b.Delete(id, "logs/0"); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := b.Get(id, "logs/0"); err == nil {
+				t.Error("deleted object can still be read")
+			}
+
+			metas, err := b.List(id, "logs/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(metas) != 4 || metas[0].Key != "logs/1" {
+				t.Errorf("listed %d objects", len(metas))
+			}
+			if ids, _ := b.IDs(); len(ids) != 1 || ids[0] != id {
+				t.Errorf("unexpected IDs %v", ids)
+			}
+
+			if err := b.Clear(); err != nil {
+				t.Fatal(err)
+			}
+			if ids, _ := b.IDs(); len(ids) != 0 {
+				t.Errorf("IDs left after Clear %v", ids)
+			}
+		})
+	}
+}
+
+func TestBackendLink(t *testing.T) {
+	for name, b := range testBackends(t) {
+		l, ok := b.(linker)
+		if !ok {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			id := generateID()
+			putBlob(t, b, id, "a", []byte("old"))
+
+			to := ObjectMeta{ID: versionNamespace(id), Key: "a@1", Size: 3, Metadata: map[string]string{"version": "1"}}
+			if err := l.Link(id, "a", to); err != nil {
+				t.Fatal(err)
+			}
+
+			//they are two objects, replacing and deleting one leaves the other alone
+			putBlob(t, b, id, "a", []byte("new"))
+			_, r, err := b.Get(to.ID, to.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(r)
+			r.Close()
+			if string(data) != "old" {
+				t.Errorf("have %q for the linked object", data)
+			}
+			if meta, _ := b.Stat(to.ID, to.Key); meta.Metadata["version"] != "1" {
+				t.Errorf("unexpected metadata %+v", meta)
+			}
+
+			if err := b.Delete(to.ID, to.Key); err != nil {
+				t.Fatal(err)
+			}
+			_, r, err = b.Get(id, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ = io.ReadAll(r)
+			r.Close()
+			if string(data) != "new" {
+				t.Errorf("have %q once the link is gone", data)
+			}
+		})
+	}
+
+	//an old version on disk is the file the current version was in
+	fs := NewFSBackend(FSBackendOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	s := NewStore(StoreOpts{Backend: fs, Versioning: true})
+	id := generateID()
+	if _, err := s.Write(id, "doc", bytes.NewReader([]byte("version 0"))); err != nil {
+		t.Fatal(err)
+	}
+	current, err := os.Stat(fs.objectPath(id, "doc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(id, "doc", bytes.NewReader([]byte("version 1"))); err != nil {
+		t.Fatal(err)
+	}
+	versions, _ := s.ListVersions(id, "")
+	if len(versions) != 2 {
+		t.Fatalf("have versions %+v", versions)
+	}
+	archived, err := os.Stat(fs.objectPath(versionNamespace(id), versionKey("doc", versions[1].VersionID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(current, archived) {
+		t.Error("the old version was copied instead of linked")
+	}
+}
+
+func TestStoreOnBackends(t *testing.T) {
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	for name, b := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			s := NewStore(StoreOpts{Backend: b, Chunking: true})
+			id := generateID()
+
+			if _, err := s.Write(id, "a", bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			_, r, err := s.Read(id, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			have, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(have, data) {
+				t.Fatalf("chunked object does not match: %v", err)
+			}
+
+			if ids, _ := s.IDs(); len(ids) != 1 {
+				t.Errorf("chunk area shows up as an ID: %v", ids)
+			}
+
+			if err := s.Delete(id, "a"); err != nil {
+				t.Fatal(err)
+			}
+			if ids, _ := b.IDs(); len(ids) != 0 {
+				t.Errorf("left behind after deleting the last object: %v", ids)
+			}
+		})
+	}
+}
+
+func TestPackBackendReload(t *testing.T) {
+	dir := t.TempDir()
+	b, err := NewPackBackend(PackBackendOpts{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := generateID()
+	putBlob(t, b, id, "kept", []byte("kept"))
+	putBlob(t, b, id, "gone", []byte("gone"))
+	b.Delete(id, "gone")
+	b.Close()
+
+	//a crash half way through an append
+	f, _ := os.OpenFile(b.segmentPath(1), os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{packOpPut, 0xff, 0x00})
+	f.Close()
+
+	b, err = NewPackBackend(PackBackendOpts{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	_, r, err := b.Get(id, "kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	if string(data) != "kept" {
+		t.Errorf("have %q after reload", data)
+	}
+	if _, err := b.Stat(id, "gone"); err == nil {
+		t.Error("deleted object is back after reload")
+	}
+
+	putBlob(t, b, id, "after", []byte("after"))
+	if _, _, err := b.Get(id, "after"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPackBackendCompact(t *testing.T) {
+	dir := t.TempDir()
+	b, err := NewPackBackend(PackBackendOpts{Dir: dir, SegmentSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := generateID()
+	for i := 0; i < 100; i++ {
+		putBlob(t, b, id, fmt.Sprintf("%03d", i), bytes.Repeat([]byte{byte(i)}, 64))
+	}
+	meta, _ := b.Stat(id, "001")
+	meta.Metadata = map[string]string{"owner": "ci"}
+	b.SetMeta(meta)
+
+	before, _ := filepath.Glob(filepath.Join(dir, "*"+packSegmentExt))
+
+	//a read that is in flight while its segment goes away
+	_, r, err := b.Get(id, "000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 2; i < 100; i++ {
+		if i%10 != 0 {
+			b.Delete(id, fmt.Sprintf("%03d", i))
+		}
+	}
+
+	if err := b.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(data, bytes.Repeat([]byte{0}, 64)) {
+		t.Fatalf("in flight read broke during compaction: %v", err)
+	}
+
+	after, _ := filepath.Glob(filepath.Join(dir, "*"+packSegmentExt))
+	if len(after) >= len(before) {
+		t.Errorf("%d segments before compacting, %d after", len(before), len(after))
+	}
+
+	check := func(b *PackBackend) {
+		metas, _ := b.List(id, "")
+		if len(metas) != 11 {
+			t.Errorf("have %d objects, want 11", len(metas))
+		}
+		for _, meta := range metas {
+			i, _ := strconv.Atoi(meta.Key)
+			_, r, err := b.Get(id, meta.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(r)
+			r.Close()
+			if !bytes.Equal(data, bytes.Repeat([]byte{byte(i)}, 64)) {
+				t.Errorf("[%s] has the wrong bytes after compacting", meta.Key)
+			}
+		}
+		if meta, _ := b.Stat(id, "001"); meta.Metadata["owner"] != "ci" {
+			t.Errorf("metadata lost by compacting %+v", meta)
+		}
+	}
+	check(b)
+	b.Close()
+
+	//deleted objects stay deleted and the rest is still there after a restart
+	b, err = NewPackBackend(PackBackendOpts{Dir: dir, SegmentSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	check(b)
+}
+
+func TestTieredBackend(t *testing.T) {
+	hot, warm, cold := NewMemoryBackend(), NewFSBackend(FSBackendOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	}), NewMemoryBackend()
+	b, err := NewTieredBackend(TieredBackendOpts{Tiers: []Tier{
+		{Name: "hot", Backend: hot, MaxIdle: 20 * time.Millisecond},
+		{Name: "warm", Backend: warm, MaxIdle: time.Hour},
+		{Name: "cold", Backend: cold, Codec: GzipCodec{}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStore(StoreOpts{Backend: b})
+	id := generateID()
+	data := bytes.Repeat([]byte("tiered storage "), 1000)
+	if _, err := s.WriteWithOpts(id, "file", bytes.NewReader(data), WriteOpts{Metadata: map[string]string{"owner": "ci"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(tier string) {
+		t.Helper()
+		if got, err := b.TierOf(id, "file"); err != nil || got != tier {
+			t.Fatalf("expected the object in the %s tier, got %s, %v", tier, got, err)
+		}
+
+		_, r, err := s.Read(id, "file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("expected the object to read the same in the %s tier, %v", tier, err)
+		}
+
+		_, r, err = s.ReadRange(id, "file", 100, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ = io.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(got, data[100:150]) {
+			t.Errorf("expected the range to read the same in the %s tier", tier)
+		}
+
+		meta, err := s.Stat(id, "file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(meta.Metadata) != 1 || meta.Metadata["owner"] != "ci" {
+			t.Errorf("expected the metadata of the object, got %v", meta.Metadata)
+		}
+	}
+	check("hot")
+
+	//only objects left unread long enough move down
+	time.Sleep(50 * time.Millisecond)
+	if moved, err := b.Rebalance(); err != nil || moved != 1 {
+		t.Fatalf("expected 1 object to move, got %d, %v", moved, err)
+	}
+	check("warm")
+	if moved, _ := b.Rebalance(); moved != 0 {
+		t.Errorf("expected the object read just now to stay, %d moved", moved)
+	}
+
+	if err := b.Move(id, "file", "cold"); err != nil {
+		t.Fatal(err)
+	}
+	check("cold")
+	_, r, err := cold.Get(id, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := io.ReadAll(r)
+	r.Close()
+	if len(stored) >= len(data) {
+		t.Errorf("expected the cold tier to compress the object, %d of %d bytes", len(stored), len(data))
+	}
+
+	//a write goes to the first tier and leaves nothing behind
+	if _, err := s.WriteWithOpts(id, "file", bytes.NewReader(data), WriteOpts{Metadata: map[string]string{"owner": "ci"}}); err != nil {
+		t.Fatal(err)
+	}
+	check("hot")
+	if _, err := cold.Stat(id, "file"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the old copy to be gone from the cold tier, got %v", err)
+	}
+
+	b.PromoteOnRead = true
+	if err := b.Move(id, "file", "cold"); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err = s.Read(id, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	check("hot")
+}
+
+func TestJBODBackend(t *testing.T) {
+	roots := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	b, err := NewJBODBackend(JBODBackendOpts{Roots: roots, PathTransformFunc: CASPathTransformFunc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStore(StoreOpts{Backend: b})
+	id := generateID()
+
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("file_%d", i)
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	onDisk := func(d *jbodDisk) int {
+		metas, _ := d.backend.List(id, "")
+		return len(metas)
+	}
+	used := 0
+	for _, d := range b.disks {
+		if onDisk(d) > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("expected the objects to be spread over the disks, %d used", used)
+	}
+
+	//the first disk goes away, its mount point is left as a plain file
+	failed := onDisk(b.disks[0])
+	if err := os.RemoveAll(roots[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(roots[0], nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lost, err := s.Lost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lost) != failed {
+		t.Errorf("expected the %d objects of the failed disk to be lost, got %d", failed, len(lost))
+	}
+	if disks := b.Disks(); disks[0].Err == nil || disks[1].Err != nil || disks[2].Err != nil {
+		t.Errorf("expected only the first disk to be taken out, got %+v", disks)
+	}
+
+	//the failed disk took its index along, the healthy ones remember
+	reopen := func() *Store {
+		b, err := NewJBODBackend(JBODBackendOpts{Roots: roots, PathTransformFunc: CASPathTransformFunc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewStore(StoreOpts{Backend: b})
+	}
+	if lost, err := reopen().Lost(); err != nil || len(lost) != failed {
+		t.Errorf("expected the %d lost objects after a restart, got %d (%v)", failed, len(lost), err)
+	}
+
+	//the node carries on with the other disks
+	metas, err := s.List(id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 30-failed {
+		t.Errorf("expected %d objects left, got %d", 30-failed, len(metas))
+	}
+	for _, meta := range metas {
+		if _, r, err := s.Read(id, meta.Key); err != nil {
+			t.Errorf("reading [%s] from a healthy disk: %s", meta.Key, err)
+		} else {
+			r.Close()
+		}
+	}
+
+	//a lost object stored again isn't lost anymore
+	for _, meta := range lost {
+		if _, err := s.Write(id, meta.Key, bytes.NewReader([]byte(meta.Key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lost, _ := s.Lost(); len(lost) != 0 {
+		t.Errorf("expected nothing lost once it was stored again, got %d", len(lost))
+	}
+	if lost, _ := reopen().Lost(); len(lost) != 0 {
+		t.Errorf("expected nothing lost after a restart either, got %d", len(lost))
+	}
+	if onDisk(b.disks[1])+onDisk(b.disks[2]) != 30 {
+		t.Errorf("expected every object on the healthy disks")
+	}
+}
+
+func TestFSBackendMigrate(t *testing.T) {
+	root := t.TempDir()
+	id := generateID()
+	keys := []string{"a", "dir/b", "c"}
+
+	plain := NewFSBackend(FSBackendOpts{Root: root})
+	for _, key := range keys {
+		putBlob(t, plain, id, key, []byte("data of "+key))
+	}
+
+	b := NewFSBackend(FSBackendOpts{Root: root, PathTransformFunc: CASPathTransformFunc, Layout: "cas"})
+	if b.layout == nil || b.layout.Name != "cas" || b.layout.From != "plain" || b.layout.Version != 2 {
+		t.Errorf("expected the move from plain to cas to be recorded, got %+v", b.layout)
+	}
+
+	//both layouts are readable while the objects move
+	putBlob(t, b, id, "c", []byte("new c"))
+	if _, err := os.Stat(filepath.Join(root, id, "c")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the plain copy of a rewritten object to be gone, got %v", err)
+	}
+	for _, key := range keys {
+		_, r, err := b.Get(id, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+
+	moved, err := b.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 2 {
+		t.Errorf("expected 2 objects moved, got %d", moved)
+	}
+	if b.layout.From != "" {
+		t.Errorf("expected the move to be recorded as done, got %+v", b.layout)
+	}
+
+	reopened := NewFSBackend(FSBackendOpts{Root: root, PathTransformFunc: CASPathTransformFunc, Layout: "cas"})
+	if err := reopened.RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if _, err := os.Stat(reopened.path(id, key)); err != nil {
+			t.Errorf("[%s] expected it at its cas path: %v", key, err)
+		}
+		_, r, err := reopened.Get(id, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		r.Close()
+		if want := "data of " + key; key != "c" && string(b) != want {
+			t.Errorf("[%s] expected %q, got %q", key, want, b)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, id, "dir")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the folders of the plain layout to be pruned, got %v", err)
+	}
+}
+
+func TestFSBackendRebuildBareObjects(t *testing.T) {
+	root := t.TempDir()
+	id := generateID()
+
+	//objects written before the metadata was kept next to them
+	files := map[string]string{
+		filepath.Join(id, "dir", "a"):                    "data of a",
+		filepath.Join("chunks", id, "deadbeef"):          "a chunk",
+		filepath.Join("quarantine", "chunks", id, "bad"): "a bad chunk",
+	}
+	for path, data := range files {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(path)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, path), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := NewFSBackend(FSBackendOpts{Root: root})
+	for _, tc := range []struct{ id, key, data string }{
+		{id, "dir/a", "data of a"},
+		{"chunks/" + id, "deadbeef", "a chunk"},
+		{"quarantine/chunks/" + id, "bad", "a bad chunk"},
+	} {
+		meta, err := b.Stat(tc.id, tc.key)
+		if err != nil {
+			t.Errorf("[%s] of (%s) was not indexed: %v", tc.key, tc.id, err)
+			continue
+		}
+		sum := sha256.Sum256([]byte(tc.data))
+		if meta.Size != int64(len(tc.data)) || meta.Checksum != hex.EncodeToString(sum[:]) {
+			t.Errorf("[%s] indexed as %+v", tc.key, meta)
+		}
+		_, r, err := b.Get(tc.id, tc.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, _ := io.ReadAll(r)
+		r.Close()
+		if string(have) != tc.data {
+			t.Errorf("[%s] have %q", tc.key, have)
+		}
+	}
+
+	//the files of the root itself aren't objects
+	if ids, _ := b.IDs(); len(ids) != 3 {
+		t.Errorf("expected 3 IDs, got %v", ids)
+	}
+}
+
+func TestFSBackendHasherLayout(t *testing.T) {
+	root := t.TempDir()
+	id := generateID()
+
+	b := NewFSBackend(FSBackendOpts{Root: root, KeyHasher: SHA256KeyHasher{}})
+	if b.layout == nil || b.layout.Name != "cas-sha256-digests" {
+		t.Fatalf("expected the sha256 layout to be recorded, got %+v", b.layout)
+	}
+	putBlob(t, b, id, "a", []byte("data of a"))
+	if _, err := os.Stat(filepath.Join(root, id, CASPathTransformFunc("a").FullPath())); err != nil {
+		t.Errorf("expected [a] at its cas path: %v", err)
+	}
+
+	//another secret lays the keys out elsewhere, which has to be noticed
+	hmac := NewFSBackend(FSBackendOpts{Root: root, KeyHasher: HMACKeyHasher{Secret: []byte("secret")}})
+	if hmac.layout == nil || hmac.layout.From != "cas-sha256-digests" {
+		t.Errorf("expected the move to the hmac layout to be recorded, got %+v", hmac.layout)
+	}
+	other := NewFSBackend(FSBackendOpts{Root: root, KeyHasher: HMACKeyHasher{Secret: []byte("other")}})
+	if other.layout == nil || other.layout.Name == hmac.Layout {
+		t.Errorf("expected another secret to be another layout, got %+v", other.layout)
+	}
+}
+
+func TestEncryptedBackend(t *testing.T) {
+	root := t.TempDir()
+	fs := NewFSBackend(FSBackendOpts{Root: root})
+	s := NewStore(StoreOpts{Backend: fs, NodeKey: []byte("node key")})
+	id := generateID()
+
+	secret := "the launch codes are 0000"
+	opts := WriteOpts{Metadata: map[string]string{"owner": "mallory"}}
+	if _, err := s.WriteWithOpts(id, "plans/secret.txt", bytes.NewReader([]byte(secret)), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	//nothing on the disk gives the object, its key or its metadata away
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.Contains(path, "secret") || strings.Contains(path, "plans") {
+			t.Errorf("key shows in the path %s", path)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, leak := range []string{secret, "launch", "plans/secret.txt", "mallory"} {
+			if bytes.Contains(b, []byte(leak)) {
+				t.Errorf("%s gives away %q", path, leak)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, r, err := s.ReadRange(id, "plans/secret.txt", 4, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if n != 6 || string(b) != "launch" {
+		t.Errorf("have range %q (%d)", b, n)
+	}
+
+	metas, err := s.List(id, "plans/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 1 || metas[0].Key != "plans/secret.txt" || metas[0].Metadata["owner"] != "mallory" {
+		t.Errorf("expected the key and metadata back, got %+v", metas)
+	}
+
+	//another node key reads nothing
+	other := NewEncryptedBackend(fs, []byte("another key"))
+	if _, err := other.Stat(id, "plans/secret.txt"); err == nil {
+		t.Error("expected another key to find nothing")
+	}
+	if metas, _ := other.List(id, ""); len(metas) != 0 {
+		t.Errorf("expected another key to list nothing, got %d objects", len(metas))
+	}
+}
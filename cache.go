@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+//CachePolicy decides which cached object is evicted first
+type CachePolicy int
+
+const (
+	//CacheLRU evicts the object that was read the longest time ago
+	CacheLRU CachePolicy = iota
+	//CacheLFU evicts the object that was read the least often
+	CacheLFU
+)
+
+//CacheOpts configure the cache tier. Objects the node doesn't own, the
+//replicas other nodes pushed and the files Get cached, are written with
+//Cached set and are the only ones the cache tier ever evicts.
+type CacheOpts struct{
+	//MaxBytes is how much the cached objects may store together,
+	//0 keeps them until they are deleted
+	MaxBytes 	int64
+	Policy 		CachePolicy
+}
+
+//CacheStats are the counters of the cache tier
+type CacheStats struct{
+	Hits 		int64
+	Misses 		int64
+	Evictions 	int64
+	//Bytes and Objects are what is cached right now
+	Bytes 		int64
+	Objects 	int
+}
+
+type cacheKey struct{
+	id 	string
+	key string
+}
+
+type cacheEntry struct{
+	size 		int64
+	lastUsed 	time.Time
+	uses 		int64
+}
+
+//cacheTier keeps track of the cached objects of a store and of how they
+//are used. It is filled from the backend the first time it is needed.
+type cacheTier struct{
+	mu 		sync.Mutex
+	opts 	CacheOpts
+	loaded 	bool
+	entries map[cacheKey]*cacheEntry
+	stats 	CacheStats
+}
+
+func newCacheTier(opts CacheOpts) *cacheTier{
+	return &cacheTier{
+		opts: 		opts,
+		entries: 	make(map[cacheKey]*cacheEntry),
+	}
+}
+
+//load picks up the objects cached before the store was opened,
+//as if they were last read when they were written. mu must be held.
+func (c *cacheTier) load(s *Store) error{
+	if c.loaded{
+		return nil
+	}
+
+	ids, err := s.IDs()
+	if err != nil{
+		return err
+	}
+	for _, id := range ids{
+		metas, err := s.Backend.List(id, "")
+		if err != nil{
+			return err
+		}
+		for _, meta := range metas{
+			if meta.Cached{
+				c.set(meta, meta.ModifiedAt)
+			}
+		}
+	}
+
+	c.loaded = true
+	return nil
+}
+
+//set starts tracking a cached object. mu must be held.
+func (c *cacheTier) set(meta ObjectMeta, now time.Time){
+	k := cacheKey{meta.ID, meta.Key}
+	if e, ok := c.entries[k]; ok{
+		c.stats.Bytes -= e.size
+	} else{
+		c.stats.Objects++
+	}
+	c.entries[k] = &cacheEntry{size: meta.Size, lastUsed: now}
+	c.stats.Bytes += meta.Size
+}
+
+//remove stops tracking an object. mu must be held.
+func (c *cacheTier) remove(id string, key string){
+	k := cacheKey{id, key}
+	if e, ok := c.entries[k]; ok{
+		delete(c.entries, k)
+		c.stats.Bytes -= e.size
+		c.stats.Objects--
+	}
+}
+
+//victims returns the cached objects in the order they should be
+//evicted in if the cache is over its limit. mu must be held.
+func (c *cacheTier) victims() []cacheKey{
+	if c.opts.MaxBytes <= 0 || c.stats.Bytes <= c.opts.MaxBytes{
+		return nil
+	}
+
+	keys := make([]cacheKey, 0, len(c.entries))
+	for k := range c.entries{
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool{
+		a, b := c.entries[keys[i]], c.entries[keys[j]]
+		if c.opts.Policy == CacheLFU && a.uses != b.uses{
+			return a.uses < b.uses
+		}
+		return a.lastUsed.Before(b.lastUsed)
+	})
+	return keys
+}
+
+//cached updates the cache tier after meta was committed and evicts
+//what no longer fits. chunkLock must be held.
+func (s *Store) cached(meta ObjectMeta){
+	c := s.cache
+	c.mu.Lock()
+	if err := c.load(s); err != nil{
+		c.mu.Unlock()
+		log.Printf("loading the cache tier failed: %s", err)
+		return
+	}
+	if meta.Cached{
+		c.set(meta, time.Now())
+	} else{
+		c.remove(meta.ID, meta.Key)
+	}
+	victims := c.victims()
+	c.mu.Unlock()
+
+	for _, k := range victims{
+		if !c.full(){
+			return
+		}
+
+		//pins and owned copies may have replaced the cached
+		//object since it was tracked, they are never evicted
+		victim, err := s.Backend.Stat(k.id, k.key)
+		if err != nil || !victim.Cached{
+			s.uncache(k.id, k.key)
+			continue
+		}
+		if victim.Pinned(){
+			continue
+		}
+
+		if err := s.deleteObject(victim, false); err != nil{
+			log.Printf("evicting [%s] of (%s) failed: %s", k.key, k.id, err)
+			continue
+		}
+
+		c.mu.Lock()
+		c.stats.Evictions++
+		c.mu.Unlock()
+	}
+}
+
+//full reports whether the cached objects are over the limit
+func (c *cacheTier) full() bool{
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.opts.MaxBytes > 0 && c.stats.Bytes > c.opts.MaxBytes
+}
+
+//touch records a read of the object for the eviction policy
+func (s *Store) touch(meta ObjectMeta){
+	if !meta.Cached{
+		return
+	}
+
+	c := s.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[cacheKey{meta.ID, meta.Key}]; ok{
+		e.lastUsed = time.Now()
+		e.uses++
+	}
+}
+
+//reset forgets every object, after the store was cleared
+func (c *cacheTier) reset(){
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[cacheKey]*cacheEntry)
+	c.stats.Bytes, c.stats.Objects = 0, 0
+	c.loaded = false
+}
+
+//uncache stops tracking a deleted object
+func (s *Store) uncache(id string, key string){
+	s.cache.mu.Lock()
+	defer s.cache.mu.Unlock()
+
+	s.cache.remove(id, key)
+}
+
+//recordLookup counts a file that was found on the node as a cache
+//hit, and one that had to be fetched from a peer as a miss
+func (s *Store) recordLookup(hit bool){
+	s.cache.mu.Lock()
+	defer s.cache.mu.Unlock()
+
+	if hit{
+		s.cache.stats.Hits++
+	} else{
+		s.cache.stats.Misses++
+	}
+}
+
+//CacheStats returns the counters of the cache tier
+func (s *Store) CacheStats() (CacheStats, error){
+	c := s.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.load(s); err != nil{
+		return CacheStats{}, fmt.Errorf("loading the cache tier: %w", err)
+	}
+	return c.stats, nil
+}
+
+//CacheStats returns the counters of the cache tier of the server
+func (s *FileServer) CacheStats() (CacheStats, error){
+	return s.store.CacheStats()
+}
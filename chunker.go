@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/bits"
+)
+
+const (
+	//bounds for the content defined chunks, the chunker aims
+	//for chunks of avgChunkSize but never goes outside of these
+	minChunkSize = 2 * 1024
+	avgChunkSize = 8 * 1024
+	maxChunkSize = 64 * 1024
+)
+
+//gearTable maps every byte value to a random looking 64 bit number
+//for the rolling hash. It is derived from sha256 instead of a random
+//source so every node cuts the same data at the same places.
+var gearTable = func() [256]uint64{
+	var table [256]uint64
+	for i := range table{
+		sum := sha256.Sum256([]byte{byte(i)})
+		table[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return table
+}()
+
+//masks used for normalized chunking. Before the chunk reaches the
+//average size we use a mask with more bits so cuts are less likely,
+//after that one with fewer bits so cuts become more likely. The bits
+//are taken from the top of the hash, those depend on the most bytes.
+var (
+	maskSmall = topBits(bits.Len(avgChunkSize) + 1)
+	maskLarge = topBits(bits.Len(avgChunkSize) - 3)
+)
+
+func topBits(n int) uint64{
+	return ^uint64(0) << (64 - n)
+}
+
+//Chunker splits a stream into content defined chunks using FastCDC.
+//Because the cut points depend on the bytes around them and not on
+//their position, inserting data near the start of a file only changes
+//the chunks around the insert and the rest still deduplicate.
+type Chunker struct{
+	r   io.Reader
+	buf []byte
+	//number of valid bytes in buf
+	n   int
+	eof bool
+}
+
+func NewChunker(r io.Reader) *Chunker{
+	return &Chunker{
+		r:   r,
+		buf: make([]byte, maxChunkSize),
+	}
+}
+
+//Next returns the next chunk of the stream
+//and io.EOF once the stream is used up.
+func (c *Chunker) Next() ([]byte, error){
+	//keep the buffer topped up so a full max size chunk fits
+	if !c.eof && c.n < len(c.buf){
+		n, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF{
+			c.eof = true
+		} else if err != nil{
+			return nil, err
+		}
+	}
+
+	if c.n == 0{
+		return nil, io.EOF
+	}
+
+	cut := cutPoint(c.buf[:c.n])
+
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+
+	//move what is left to the front of the buffer
+	c.n = copy(c.buf, c.buf[cut:c.n])
+
+	return chunk, nil
+}
+
+//cutPoint returns the length of the first chunk in data
+func cutPoint(data []byte) int{
+	n := len(data)
+	if n <= minChunkSize{
+		return n
+	}
+	if n > maxChunkSize{
+		n = maxChunkSize
+	}
+
+	normal := avgChunkSize
+	if n < normal{
+		normal = n
+	}
+
+	var hash uint64
+	i := minChunkSize
+	for ; i < normal; i++{
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&maskSmall == 0{
+			return i + 1
+		}
+	}
+	for ; i < n; i++{
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&maskLarge == 0{
+			return i + 1
+		}
+	}
+	return n
+}
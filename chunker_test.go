@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunkHashes(t *testing.T, data []byte) map[[32]byte]bool {
+	hashes := make(map[[32]byte]bool)
+	c := NewChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return hashes
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunk) > maxChunkSize {
+			t.Errorf("chunk of %d bytes is bigger than %d", len(chunk), maxChunkSize)
+		}
+		hashes[sha256.Sum256(chunk)] = true
+	}
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	var total int
+	c := NewChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += len(chunk)
+	}
+	if total != len(data) {
+		t.Errorf("have %d bytes want %d", total, len(data))
+	}
+
+	//inserting bytes at the front should only change the first chunks
+	shifted := append([]byte("a few new bytes"), data...)
+
+	before := chunkHashes(t, data)
+	after := chunkHashes(t, shifted)
+
+	var shared int
+	for hash := range after {
+		if before[hash] {
+			shared++
+		}
+	}
+	if shared < len(before)-2 {
+		t.Errorf("only %d of %d chunks survived an insert at the front", shared, len(before))
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	//the chunks of an ID are kept under the ID "chunks/<id>",
+	//IDs are hex so this can never clash with one of them
+	chunksFolderName = "chunks"
+
+	//metadata of a chunk counting the manifests using it
+	chunkRefsKey = "refs"
+)
+
+//ChunkRef points at one chunk of an object by the sha256 of its plaintext
+type ChunkRef struct{
+	Hash string
+	Size int64
+	//Checksum is the hex encoded sha256 of the Size bytes a chunk is sent
+	//as, it is only set for the chunks that go to a peer
+	Checksum string `json:",omitempty"`
+}
+
+//Manifest lists the chunks that make up an object, in order. A chunked
+//object is stored as its manifest, with Chunked set in its metadata.
+type Manifest struct{
+	Size 	int64
+	Chunks 	[]ChunkRef
+	//Checksum is the hex encoded sha256 of the whole object, a peer
+	//keeping encrypted chunks has no other way of knowing it. Peers get
+	//it sealed with the key of the owner, see remoteManifest.
+	Checksum string 	`json:",omitempty"`
+}
+
+//uniqueHashes returns the hashes of the manifest without duplicates
+func (m *Manifest) uniqueHashes() []string{
+	seen := make(map[string]bool)
+	hashes := []string{}
+	for _, c := range m.Chunks{
+		if seen[c.Hash]{
+			continue
+		}
+		seen[c.Hash] = true
+		hashes = append(hashes, c.Hash)
+	}
+	return hashes
+}
+
+//chunkSpan is the part of a chunk that falls inside a range of the object
+type chunkSpan struct{
+	Hash 	string
+	Offset 	int64
+	Length 	int64
+}
+
+//spans maps a range of the object onto the chunks holding it,
+//a length of 0 means until the end of the object
+func (m *Manifest) spans(offset int64, length int64) []chunkSpan{
+	end := m.Size
+	if length > 0 && offset + length < end{
+		end = offset + length
+	}
+
+	spans := []chunkSpan{}
+	var pos int64
+	for _, c := range m.Chunks{
+		from, to := pos, pos + c.Size
+		pos = to
+
+		if to <= offset || from >= end{
+			continue
+		}
+
+		start := max(offset, from)
+		stop := min(end, to)
+		spans = append(spans, chunkSpan{
+			Hash: 	c.Hash,
+			Offset: start - from,
+			Length: stop - start,
+		})
+	}
+	return spans
+}
+
+//chunkNamespace is the ID the chunks of id are stored under
+func chunkNamespace(id string) string{
+	return chunksFolderName + "/" + id
+}
+
+//HasChunk reports whether the chunk is in the chunk area of id
+func (s *Store) HasChunk(id string, hash string) bool{
+	_, err := s.Backend.Stat(chunkNamespace(id), hash)
+	return err == nil
+}
+
+func (s *Store) readManifest(id string, key string) (*Manifest, error){
+	_, r, err := s.Backend.Get(id, key)
+	if err != nil{
+		return nil, err
+	}
+	defer r.Close()
+
+	m := new(Manifest)
+	if err := json.NewDecoder(r).Decode(m); err != nil{
+		return nil, fmt.Errorf("corrupt manifest for [%s]: %s", key, err)
+	}
+	return m, nil
+}
+
+//writeChunked splits r into content defined chunks, only the chunks
+//the store doesn't have yet are written. r is read without chunkLock,
+//it may be a slow peer, every chunk is held as soon as it is stored.
+func (s *Store) writeChunked(id string, key string, r io.Reader, opts WriteOpts) (int64, error){
+	room, err := s.quotaRoom(id, key)
+	if err != nil{
+		return 0, err
+	}
+	if room >= 0{
+		r = io.LimitReader(r, room + 1)
+	}
+	//only the new chunks take room on the disk
+	space, err := s.spaceRoom()
+	if err != nil{
+		return 0, err
+	}
+
+	m := &Manifest{}
+	var added int64
+	hash := sha256.New()
+	chunker := NewChunker(io.TeeReader(r, hash))
+	for{
+		chunk, err := chunker.Next()
+		if err == io.EOF{
+			break
+		}
+		if err != nil{
+			s.unholdChunks(id, m)
+			return 0, err
+		}
+
+		sum := sha256.Sum256(chunk)
+		hashStr := hex.EncodeToString(sum[:])
+
+		if !s.HasChunk(id, hashStr){
+			added += int64(len(chunk))
+			if space >= 0 && added > space{
+				s.unholdChunks(id, m)
+				return 0, errSpace(space)
+			}
+		}
+		if err := s.holdChunk(id, hashStr, bytes.NewReader(chunk), "", 0); err != nil{
+			s.unholdChunks(id, m)
+			return 0, err
+		}
+
+		m.Chunks = append(m.Chunks, ChunkRef{Hash: hashStr, Size: int64(len(chunk))})
+		m.Size += int64(len(chunk))
+	}
+	//the chunks are held by m until the manifest takes references of its own
+	defer s.unholdChunks(id, m)
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if len(opts.Checksum) > 0 && opts.Checksum != checksum{
+		return 0, fmt.Errorf("writing [%s]: %w", key, ErrChecksumMismatch)
+	}
+	m.Checksum = checksum
+
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
+
+	err = s.commitManifest(m, ObjectMeta{
+		ID: 		id,
+		Key: 		key,
+		Size: 		m.Size,
+		Checksum: 	checksum,
+		Chunked: 	true,
+		Metadata: 	opts.Metadata,
+		VersionID: 	opts.VersionID,
+		ExpiresAt: 	opts.ExpiresAt,
+		Cached: 	opts.Cached,
+		Hashed: 	opts.Hashed,
+	})
+	if err != nil{
+		return 0, err
+	}
+	return m.Size, nil
+}
+
+//WriteChunks stores an object from its manifest. The chunks listed in
+//missing are read from r one after another, Size bytes each, every
+//other chunk of the manifest has to be in the store already. Every
+//chunk is checked against its Checksum before it is kept, one that
+//doesn't match fails the whole object with ErrChecksumMismatch.
+func (s *Store) WriteChunks(id string, key string, m *Manifest, missing []ChunkRef, r io.Reader, opts WriteOpts) error{
+	return noSpace(s.writeChunks(id, key, m, missing, r, opts))
+}
+
+func (s *Store) writeChunks(id string, key string, m *Manifest, missing []ChunkRef, r io.Reader, opts WriteOpts) error{
+	if err := s.checkQuota(id, key, m.Size); err != nil{
+		return err
+	}
+	var size int64
+	for _, c := range missing{
+		size += c.Size
+	}
+	if err := s.checkSpace(size); err != nil{
+		return err
+	}
+
+	//every chunk is read off the stream before chunkLock is taken
+	held := &Manifest{}
+	defer s.unholdChunks(id, held)
+	for _, c := range missing{
+		if len(c.Checksum) == 0{
+			return fmt.Errorf("chunk (%s) of [%s] came without a checksum", c.Hash, key)
+		}
+		if c.Size < 0 || c.Size > maxChunkSize + encHeaderSize{
+			return fmt.Errorf("chunk (%s) of [%s] has an invalid size (%d)", c.Hash, key, c.Size)
+		}
+		buf := make([]byte, c.Size)
+		if _, err := io.ReadFull(r, buf); err != nil{
+			return err
+		}
+		//someone else may have sent it in the meantime
+		if err := s.holdChunk(id, c.Hash, bytes.NewReader(buf), c.Checksum, opts.EncVersion); err != nil{
+			return err
+		}
+		held.Chunks = append(held.Chunks, c)
+	}
+
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
+
+	checksum, err := s.checksumChunks(id, m)
+	if err != nil{
+		return err
+	}
+
+	return s.commitManifest(m, ObjectMeta{
+		ID: 		id,
+		Key: 		key,
+		Size: 		m.Size,
+		Checksum: 	checksum,
+		Chunked: 	true,
+		Metadata: 	opts.Metadata,
+		VersionID: 	opts.VersionID,
+		ExpiresAt: 	opts.ExpiresAt,
+		Cached: 	opts.Cached,
+		Hashed: 	opts.Hashed,
+	})
+}
+
+//holdChunk stores the chunk read from r unless the store has it, and
+//takes a reference on it so nothing deletes it while the rest of the
+//object is written. unholdChunks drops the reference.
+func (s *Store) holdChunk(id string, hash string, r io.Reader, checksum string, encVersion int) error{
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
+
+	if !s.HasChunk(id, hash){
+		if err := s.writeChunk(id, hash, r, checksum, encVersion); err != nil{
+			return err
+		}
+	}
+	if err := s.addChunkRefs(id, hash, 1); err != nil{
+		s.removeChunks(id, []string{hash})
+		return err
+	}
+	return nil
+}
+
+//unholdChunks drops the references holdChunk took on the chunks of m,
+//the ones nothing else uses are deleted
+func (s *Store) unholdChunks(id string, m *Manifest){
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
+
+	s.releaseChunks(id, m)
+}
+
+//checksumChunks hashes the stored chunks of m in order, for a chunked
+//object that is what its checksum covers
+func (s *Store) checksumChunks(id string, m *Manifest) (string, error){
+	hash := sha256.New()
+	for _, c := range m.Chunks{
+		_, r, err := s.readChunkRange(id, c.Hash, 0, 0)
+		if err != nil{
+			return "", err
+		}
+		_, err = io.Copy(hash, r)
+		r.Close()
+		if err != nil{
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+//writeChunk stores a chunk with no references, a chunk that is in
+//the backend is always complete. Unless checksum is empty it is only
+//kept when what was read from r has that sha256. encVersion is that
+//of the header of a chunk a peer sent encrypted, 0 for plaintext.
+func (s *Store) writeChunk(id string, hash string, r io.Reader, checksum string, encVersion int) error{
+	w, err := s.Backend.Put(chunkNamespace(id), hash)
+	if err != nil{
+		return err
+	}
+	defer w.Abort()
+
+	codec, r, err := pickCodec(s.Codec, r)
+	if err != nil{
+		return err
+	}
+
+	sum := sha256.New()
+	n, err := encode(codec, w, io.TeeReader(r, sum))
+	if err != nil{
+		return err
+	}
+
+	sumHex := hex.EncodeToString(sum.Sum(nil))
+	if len(checksum) > 0 && sumHex != checksum{
+		return fmt.Errorf("chunk (%s) of (%s): %w", hash, id, ErrChecksumMismatch)
+	}
+
+	now := time.Now()
+	meta := ObjectMeta{
+		Size: 		n,
+		Checksum: 	sumHex,
+		EncVersion: encVersion,
+		CreatedAt: 	now,
+		ModifiedAt: now,
+	}
+	if codec != nil{
+		meta.Codec = codec.Name()
+	}
+	return w.Commit(meta)
+}
+
+//removeChunks deletes chunks that were written but never referenced.
+//chunkLock must be held.
+func (s *Store) removeChunks(id string, hashes []string){
+	for _, hash := range hashes{
+		if s.chunkRefs(id, hash) > 0{
+			continue
+		}
+		s.Backend.Delete(chunkNamespace(id), hash)
+	}
+}
+
+//commitManifest takes a reference on every chunk of m, stores the
+//manifest as the object and then drops the references of the object
+//it replaces. chunkLock must be held.
+func (s *Store) commitManifest(m *Manifest, meta ObjectMeta) error{
+	for _, c := range m.Chunks{
+		if !s.HasChunk(meta.ID, c.Hash){
+			return fmt.Errorf("chunk (%s) of [%s] is missing", c.Hash, meta.Key)
+		}
+	}
+
+	for i, c := range m.Chunks{
+		if err := s.addChunkRefs(meta.ID, c.Hash, 1); err != nil{
+			s.releaseChunks(meta.ID, &Manifest{Chunks: m.Chunks[:i]})
+			return err
+		}
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil{
+		s.releaseChunks(meta.ID, m)
+		return err
+	}
+
+	w, err := s.Backend.Put(meta.ID, meta.Key)
+	if err != nil{
+		s.releaseChunks(meta.ID, m)
+		return err
+	}
+	defer w.Abort()
+
+	if _, err := w.Write(b); err != nil{
+		s.releaseChunks(meta.ID, m)
+		return err
+	}
+
+	if err := s.commitObject(w, meta); err != nil{
+		s.releaseChunks(meta.ID, m)
+		return err
+	}
+	return nil
+}
+
+//releaseChunks drops one reference for every chunk in m.
+//chunkLock must be held.
+func (s *Store) releaseChunks(id string, m *Manifest){
+	for _, c := range m.Chunks{
+		if err := s.addChunkRefs(id, c.Hash, -1); err != nil{
+			fmt.Printf("releasing chunk (%s) failed: %s\n", c.Hash, err)
+		}
+	}
+}
+
+//chunkRefs returns the number of manifests using the chunk
+func (s *Store) chunkRefs(id string, hash string) int{
+	meta, err := s.Backend.Stat(chunkNamespace(id), hash)
+	if err != nil{
+		return 0
+	}
+	refs, _ := strconv.Atoi(meta.Metadata[chunkRefsKey])
+	return refs
+}
+
+//addChunkRefs changes the reference count of a chunk and deletes
+//the chunk once nothing uses it anymore
+func (s *Store) addChunkRefs(id string, hash string, delta int) error{
+	meta, err := s.Backend.Stat(chunkNamespace(id), hash)
+	if errors.Is(err, os.ErrNotExist) && delta < 0{
+		//already gone, it was quarantined
+		return nil
+	}
+	if err != nil{
+		return err
+	}
+
+	refs, _ := strconv.Atoi(meta.Metadata[chunkRefsKey])
+	refs += delta
+	if refs <= 0{
+		return s.Backend.Delete(chunkNamespace(id), hash)
+	}
+
+	//the metadata map is shared with the backend, so it is never changed in place
+	meta.Metadata = map[string]string{chunkRefsKey: strconv.Itoa(refs)}
+	return s.Backend.SetMeta(meta)
+}
+
+//readChunkRange reads part of a stored chunk,
+//a length of 0 reads to the end of the chunk
+func (s *Store) readChunkRange(id string, hash string, offset int64, length int64) (int64, io.ReadCloser, error){
+	meta, err := s.Backend.Stat(chunkNamespace(id), hash)
+	if err != nil{
+		return 0, nil, err
+	}
+	return s.readObjectRange(meta, offset, length)
+}
+
+//chunkReader reads a range of a chunked object,
+//opening the chunks one at a time as it goes
+type chunkReader struct{
+	store 	*Store
+	id 		string
+	spans 	[]chunkSpan
+	cur 	io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error){
+	for{
+		if r.cur == nil{
+			if len(r.spans) == 0{
+				return 0, io.EOF
+			}
+
+			span := r.spans[0]
+			r.spans = r.spans[1:]
+
+			_, rc, err := r.store.readChunkRange(r.id, span.Hash, span.Offset, span.Length)
+			if err != nil{
+				return 0, err
+			}
+			r.cur = rc
+		}
+
+		n, err := r.cur.Read(p)
+		if err == io.EOF{
+			r.cur.Close()
+			r.cur = nil
+			if n > 0{
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error{
+	if r.cur != nil{
+		return r.cur.Close()
+	}
+	return nil
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/Hemansh24/HyperFS/p2p"
+)
+
+//MessageHasChunks asks a peer which of the chunks of ID it is missing
+type MessageHasChunks struct{
+	ID 		string
+	Hashes 	[]string
+}
+
+//MessageStoreChunks announces a chunked file. The chunks in Missing
+//follow as a stream, each one encrypted on its own so it starts with
+//the header of copyEncrypt, and Size is the length of that stream.
+type MessageStoreChunks struct{
+	ID 			string
+	Key 		string
+	Manifest 	Manifest
+	Missing 	[]ChunkRef
+	Size 		int64
+	VersionID 	string
+	ExpiresAt 	time.Time
+}
+
+//storeChunked stores the file as chunks and sends every
+//peer only the chunks it doesn't have yet
+func (s *FileServer) storeChunked(key string, r io.Reader, opts WriteOpts) error{
+	size, err := s.store.WriteWithOpts(s.ID, key, r, opts)
+	if err != nil{
+		return err
+	}
+
+	m, err := s.store.readManifest(s.ID, key)
+	if err != nil{
+		return err
+	}
+
+	fmt.Printf("[%s] stored (%d) bytes in (%d) chunks\n", s.Transport.Addr(), size, len(m.Chunks))
+
+	var rejected error
+	for _, peer := range s.peerList(){
+		err := s.replicateChunks(peer, key, m)
+		if err == nil{
+			continue
+		}
+		log.Printf("replicating (%s) to peer %s failed: %s", key, peer.RemoteAddr(), err)
+		if isRejection(err) && rejected == nil{
+			rejected = err
+		}
+	}
+
+	if err := s.PruneVersions(key); err != nil{
+		return err
+	}
+	return rejected
+}
+
+func (s *FileServer) replicateChunks(peer p2p.Peer, key string, m *Manifest) error{
+	remote, hashes := s.remoteManifest(m)
+	missing, err := s.missingChunks(peer, remote.uniqueHashes())
+	if err != nil{
+		return err
+	}
+
+	//every chunk is encrypted on its own, with its own header in front
+	//of it, and up front so the peer can check it against its checksum
+	var (
+		refs = []ChunkRef{}
+		chunks = [][]byte{}
+		size int64
+	)
+	for _, id := range missing{
+		_, r, err := s.store.readChunkRange(s.ID, hashes[id], 0, 0)
+		if err != nil{
+			return err
+		}
+
+		//chunks are served in ranges, which compressed
+		//ciphertext can't be cut into, so they go as they are
+		buf := new(bytes.Buffer)
+		_, err = copyEncrypt(s.Enckey, nil, r, buf)
+		r.Close()
+		if err != nil{
+			return err
+		}
+
+		sum := sha256.Sum256(buf.Bytes())
+		refs = append(refs, ChunkRef{Hash: id, Size: int64(buf.Len()), Checksum: hex.EncodeToString(sum[:])})
+		chunks = append(chunks, buf.Bytes())
+		size += int64(buf.Len())
+	}
+
+	if !s.hasRoom(peer, size){
+		log.Printf("[%s] skipping peer %s, it has no room for (%d) bytes", s.Transport.Addr(), peer.RemoteAddr(), size)
+		return nil
+	}
+
+	msg := Message{
+		Payload: MessageStoreChunks{
+			ID: 		s.ID,
+			Key: 		s.hashKey(key),
+			Manifest: 	*remote,
+			Missing: 	refs,
+			Size: 		size,
+			VersionID: 	s.versionOf(key),
+			ExpiresAt: 	s.expiryOf(key),
+		},
+	}
+	if err := s.askToStore(peer, s.hashKey(key), &msg); err != nil{
+		return err
+	}
+
+	//nothing to stream, the peer already has every chunk
+	if size == 0{
+		fmt.Printf("[%s] peer %s already has every chunk of (%s)\n", s.Transport.Addr(), peer.RemoteAddr(), key)
+		return nil
+	}
+
+	err = peer.Hold(func(w io.Writer) error{
+		if _, err := w.Write([]byte{p2p.IncomingStream}); err != nil{
+			return err
+		}
+
+		for _, chunk := range chunks{
+			if _, err := w.Write(chunk); err != nil{
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil{
+		return err
+	}
+
+	fmt.Printf("[%s] sent (%d/%d) chunks of (%s) to %s\n", s.Transport.Addr(), len(refs), len(m.uniqueHashes()), key, peer.RemoteAddr())
+	return nil
+}
+
+//remoteManifest is the manifest m as the peers get it, with every
+//chunk under its chunkID and the checksum sealed, so neither tells a
+//peer anything about the plaintext. hashes maps the chunk IDs back to
+//the hashes the chunks are stored under here.
+func (s *FileServer) remoteManifest(m *Manifest) (*Manifest, map[string]string){
+	remote := &Manifest{Size: m.Size, Chunks: make([]ChunkRef, 0, len(m.Chunks))}
+	hashes := make(map[string]string)
+	for _, c := range m.Chunks{
+		id := s.chunkID(c.Hash)
+		hashes[id] = c.Hash
+		remote.Chunks = append(remote.Chunks, ChunkRef{Hash: id, Size: c.Size})
+	}
+
+	if sum, err := hex.DecodeString(m.Checksum); err == nil && len(sum) > 0{
+		remote.Checksum = hex.EncodeToString(s.sealChecksum(sum))
+	}
+	return remote, hashes
+}
+
+//missingChunks asks the peer which of the hashes it doesn't have
+func (s *FileServer) missingChunks(peer p2p.Peer, hashes []string) ([]string, error){
+	msg := Message{
+		Payload: MessageHasChunks{
+			ID: 	s.ID,
+			Hashes: hashes,
+		},
+	}
+	if err := s.sendTo(peer, &msg); err != nil{
+		return nil, err
+	}
+
+	if err := peer.WaitStream(responseTimeout); err != nil{
+		return nil, err
+	}
+
+	var n int64
+	if err := binary.Read(peer, binary.LittleEndian, &n); err != nil{
+		return nil, err
+	}
+	if n != int64(len(hashes)){
+		peer.CloseStream()
+		return nil, fmt.Errorf("peer answered for (%d) chunks, asked for (%d)", n, len(hashes))
+	}
+
+	//one byte per hash, 1 if the peer is missing the chunk
+	bitmap := make([]byte, n)
+	_, err := io.ReadFull(peer, bitmap)
+	peer.CloseStream()
+	if err != nil{
+		return nil, err
+	}
+
+	missing := []string{}
+	for i, hash := range hashes{
+		if bitmap[i] == 1{
+			missing = append(missing, hash)
+		}
+	}
+	return missing, nil
+}
+
+func (s *FileServer) handleMessageHasChunks(from string, msg MessageHasChunks) error{
+	peer, ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+
+	//an empty answer to an invalid ID, the peer is waiting for one
+	idErr := checkRemoteID(msg.ID)
+	bitmap := []byte{}
+	if idErr == nil{
+		bitmap = make([]byte, len(msg.Hashes))
+		for i, hash := range msg.Hashes{
+			if !s.store.HasChunk(msg.ID, hash){
+				bitmap[i] = 1
+			}
+		}
+	}
+
+	err := peer.Hold(func(w io.Writer) error{
+		w.Write([]byte{p2p.IncomingStream})
+		binary.Write(w, binary.LittleEndian, int64(len(bitmap)))
+		_, err := w.Write(bitmap)
+		return err
+	})
+	if idErr != nil{
+		return idErr
+	}
+	return err
+}
+
+func (s *FileServer) handleMessageStoreChunks(from string, msg MessageStoreChunks) error{
+	peer, ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+
+	//turned down before the chunks are sent when they can't fit
+	err := s.checkReplicaID(msg.ID)
+	if err == nil{
+		err = s.store.checkQuota(msg.ID, msg.Key, msg.Manifest.Size)
+	}
+	if err == nil{
+		err = s.store.checkSpace(msg.Size)
+	}
+	if err := s.answerStore(peer, msg.ID, msg.Key, err); err != nil{
+		return err
+	}
+
+	//only a stream that was actually sent has to be waited for and closed
+	var lr io.Reader = bytes.NewReader(nil)
+	if msg.Size > 0{
+		if err := peer.WaitStream(storeStreamTimeout); err != nil{
+			return err
+		}
+		lr = io.LimitReader(peer, msg.Size)
+	}
+	err = s.store.WriteChunks(msg.ID, msg.Key, &msg.Manifest, msg.Missing, lr, WriteOpts{VersionID: msg.VersionID, ExpiresAt: msg.ExpiresAt, Cached: true, Hashed: true, EncVersion: encVersion})
+	if msg.Size > 0{
+		io.Copy(io.Discard, lr)
+		peer.CloseStream()
+	}
+	if err != nil{
+		//filled up after all, so it stops sending what won't fit
+		if rejectionReason(err) == rejectStorage{
+			s.advertiseCapacity(peer)
+		}
+		return err
+	}
+
+	fmt.Printf("[%s] written (%d) new chunks of (%s) to disk\n", s.Transport.Addr(), len(msg.Missing), msg.Key)
+	return nil
+}
+
+//serveChunked answers a MessageGetFile for a chunked file. Every chunk
+//was encrypted on its own, so after the header we send the list of
+//spans followed by, for every span, the IV of its chunk and the part
+//of the chunk's ciphertext that is inside the range.
+func (s *FileServer) serveChunked(peer p2p.Peer, msg MessageGetFile, meta ObjectMeta) error{
+	m, err := s.store.readManifest(meta.ID, meta.Key)
+	if err != nil || msg.Offset > m.Size{
+		sendFileNotFound(peer)
+		return fmt.Errorf("[%s] can't serve range of (%s)", s.Transport.Addr(), msg.Key)
+	}
+
+	spans := m.spans(msg.Offset, msg.Length)
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(spans); err != nil{
+		sendFileNotFound(peer)
+		return err
+	}
+
+	size := int64(4 + buf.Len())
+	for _, span := range spans{
+		size += aes.BlockSize + span.Length
+	}
+
+	//the whole file is checked against the checksum of the manifest
+	header := fileHeader{Size: size, Chunked: true}
+	if sum, err := hex.DecodeString(m.Checksum); err == nil && len(sum) == sha256.Size && msg.Offset == 0 && (msg.Length == 0 || msg.Length >= m.Size){
+		copy(header.Checksum[:], sum)
+	}
+
+	err = peer.Hold(func(w io.Writer) error{
+		if err := sendFileHeader(w, header); err != nil{
+			return err
+		}
+		binary.Write(w, binary.LittleEndian, uint32(buf.Len()))
+		if _, err := w.Write(buf.Bytes()); err != nil{
+			return err
+		}
+
+		for _, span := range spans{
+			if err := s.sendChunkSpan(w, msg.ID, span); err != nil{
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil{
+		return err
+	}
+
+	fmt.Printf("[%s] written (%d) chunked bytes over the network to %s\n", s.Transport.Addr(), size, peer.RemoteAddr())
+	return nil
+}
+
+func (s *FileServer) sendChunkSpan(w io.Writer, id string, span chunkSpan) error{
+	meta, err := s.store.Backend.Stat(chunkNamespace(id), span.Hash)
+	if err != nil{
+		return err
+	}
+	header := encHeaderLen(meta)
+
+	//the IV is at the end of the header, after the codec byte if it has one
+	_, iv, err := s.store.readChunkRange(id, span.Hash, header - aes.BlockSize, aes.BlockSize)
+	if err != nil{
+		return err
+	}
+	_, err = io.Copy(w, iv)
+	iv.Close()
+	if err != nil{
+		return err
+	}
+
+	_, r, err := s.store.readChunkRange(id, span.Hash, header + span.Offset, span.Length)
+	if err != nil{
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+//chunkDecryptReader decrypts a chunked response from serveChunked
+type chunkDecryptReader struct{
+	block 	cipher.Block
+	src 	io.Reader
+	spans 	[]chunkSpan
+	cur 	io.Reader
+}
+
+func newChunkDecryptReader(block cipher.Block, src io.Reader) (*chunkDecryptReader, error){
+	var n uint32
+	if err := binary.Read(src, binary.LittleEndian, &n); err != nil{
+		return nil, err
+	}
+	if err := checkLength(int64(n)); err != nil{
+		return nil, err
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(src, buf); err != nil{
+		return nil, err
+	}
+
+	var spans []chunkSpan
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&spans); err != nil{
+		return nil, err
+	}
+
+	return &chunkDecryptReader{
+		block: 	block,
+		src: 	src,
+		spans: 	spans,
+	}, nil
+}
+
+func (r *chunkDecryptReader) Read(p []byte) (int, error){
+	for{
+		if r.cur == nil{
+			if len(r.spans) == 0{
+				return 0, io.EOF
+			}
+
+			span := r.spans[0]
+			r.spans = r.spans[1:]
+
+			iv := make([]byte, r.block.BlockSize())
+			if _, err := io.ReadFull(r.src, iv); err != nil{
+				return 0, err
+			}
+
+			r.cur = cipher.StreamReader{
+				S: newCTRAt(r.block, iv, span.Offset),
+				R: io.LimitReader(r.src, span.Length),
+			}
+		}
+
+		n, err := r.cur.Read(p)
+		if err == io.EOF{
+			r.cur = nil
+			if n > 0{
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+//multihash header for sha2-256, the code of the hash
+//function followed by the length of the digest
+const (
+	multihashSHA256 	= 0x12
+	multihashSHA256Len 	= 0x20
+)
+
+var ErrContentMismatch = errors.New("content does not match its content identifier")
+
+//contentID turns a sha256 digest into a content identifier, the hex
+//encoded multihash of the digest ("1220" followed by the digest). The
+//header leaves room for other hash functions later on.
+func contentID(digest []byte) string{
+	return hex.EncodeToString(append([]byte{multihashSHA256, multihashSHA256Len}, digest...))
+}
+
+//parseContentID returns the sha256 digest inside a content identifier
+func parseContentID(id string) ([]byte, error){
+	b, err := hex.DecodeString(id)
+	if err != nil{
+		return nil, fmt.Errorf("invalid content identifier (%s): %s", id, err)
+	}
+
+	if len(b) != 2 + multihashSHA256Len || b[0] != multihashSHA256 || b[1] != multihashSHA256Len{
+		return nil, fmt.Errorf("invalid content identifier (%s): not a sha2-256 multihash", id)
+	}
+	return b[2:], nil
+}
+
+func isContentID(key string) bool{
+	_, err := parseContentID(key)
+	return err == nil
+}
+
+//verifyReader hashes everything that is read through it and fails
+//with err at the end if it doesn't match the digest. When seal is set
+//the digest is passed through it before the two are compared.
+type verifyReader struct{
+	r 		io.Reader
+	hash 	hash.Hash
+	want 	[]byte
+	err 	error
+	seal 	func([]byte) []byte
+}
+
+//newVerifyReader checks r against the content identifier id
+func newVerifyReader(r io.Reader, id string) (*verifyReader, error){
+	want, err := parseContentID(id)
+	if err != nil{
+		return nil, err
+	}
+
+	return &verifyReader{
+		r: 		r,
+		hash: 	sha256.New(),
+		want: 	want,
+		err: 	ErrContentMismatch,
+	}, nil
+}
+
+//newChecksumReader checks r against a hex encoded sha256 checksum
+func newChecksumReader(r io.Reader, checksum string) (*verifyReader, error){
+	want, err := hex.DecodeString(checksum)
+	if err != nil || len(want) != sha256.Size{
+		return nil, fmt.Errorf("invalid checksum (%s)", checksum)
+	}
+
+	return &verifyReader{
+		r: 		r,
+		hash: 	sha256.New(),
+		want: 	want,
+		err: 	ErrChecksumMismatch,
+	}, nil
+}
+
+func (v *verifyReader) Read(p []byte) (int, error){
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+
+	if err == io.EOF{
+		sum := v.hash.Sum(nil)
+		if v.seal != nil{
+			sum = v.seal(sum)
+		}
+		if !bytes.Equal(sum, v.want){
+			return n, v.err
+		}
+	}
+	return n, err
+}
+
+//verifiedReadCloser verifies a reader that has to be closed
+type verifiedReadCloser struct{
+	*verifyReader
+	io.Closer
+}
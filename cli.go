@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+//runCommand runs the command name of the command line on the root of a
+//node that isn't running, it backs the root up with Export or restores
+//it with Import
+func runCommand(name string, args []string) error{
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	root := flags.String("root", "", "storage root of the node, \"3000_network\" for the node on :3000")
+	nodeKey := flags.String("node-key", "", "hex node key the root is encrypted with, if it is")
+
+	switch name{
+	case "export":
+		out := flags.String("o", "", "file the archive is written to, stdout when empty")
+		since := flags.String("since", "", "RFC 3339 time, only what changed after it is exported")
+		if err := flags.Parse(args); err != nil{
+			return err
+		}
+
+		var after time.Time
+		if len(*since) > 0{
+			t, err := time.Parse(time.RFC3339, *since)
+			if err != nil{
+				return fmt.Errorf("invalid -since: %w", err)
+			}
+			after = t
+		}
+		//a root that isn't there would be created empty
+		if _, err := os.Stat(*root); len(*root) > 0 && err != nil{
+			return err
+		}
+		s, err := openNodeStore(*root, *nodeKey)
+		if err != nil{
+			return err
+		}
+
+		var w io.Writer = os.Stdout
+		if len(*out) > 0{
+			f, err := os.Create(*out)
+			if err != nil{
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		n, err := s.Export(w, after)
+		if err != nil{
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "exported %d objects of %s\n", n, *root)
+		return nil
+
+	case "import":
+		in := flags.String("i", "", "file the archive is read from, stdin when empty")
+		if err := flags.Parse(args); err != nil{
+			return err
+		}
+
+		s, err := openNodeStore(*root, *nodeKey)
+		if err != nil{
+			return err
+		}
+
+		var r io.Reader = os.Stdin
+		if len(*in) > 0{
+			f, err := os.Open(*in)
+			if err != nil{
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		n, err := s.Import(r)
+		if err != nil{
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "imported %d objects into %s\n", n, *root)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q, expected export or import", name)
+}
+
+//openNodeStore opens the store a node keeps under root, a new
+//root is created for an import to restore a node into
+func openNodeStore(root string, nodeKey string) (*Store, error){
+	if len(root) == 0{
+		return nil, fmt.Errorf("the storage root of the node is missing (-root)")
+	}
+	key, err := hex.DecodeString(nodeKey)
+	if err != nil{
+		return nil, fmt.Errorf("invalid -node-key: %w", err)
+	}
+	return NewStore(StoreOpts{Backend: newNodeBackend(root), NodeKey: key, Tombstones: true}), nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+//Codec compresses data before it is stored or encrypted for a peer
+type Codec interface{
+	//ID is written in front of encrypted data to say how it was
+	//compressed, it must never change once data is out there
+	ID() byte
+	//Name is recorded in the metadata of objects compressed with the codec
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+//IDs of the codecs
+const (
+	codecNone byte = 0
+	codecGzip byte = 1
+	//kept for zstd, which isn't in the standard library and has
+	//to be brought in with RegisterCodec by whoever wants it
+	codecZstd byte = 2
+)
+
+const (
+	//how much of the data is compressed up front to find out
+	//whether compressing all of it is worth the trouble
+	codecSampleSize = 64 * 1024
+
+	//data the sample doesn't shrink below this share
+	//of its size is left uncompressed
+	codecMaxRatio = 0.9
+)
+
+var codecs = map[byte]Codec{
+	codecGzip: GzipCodec{},
+}
+
+//RegisterCodec makes a codec known so that data compressed with it can be
+//read back. It has to happen before anything is read, in an init function.
+func RegisterCodec(c Codec){
+	if c.ID() == codecNone{
+		panic("codec ID 0 means not compressed")
+	}
+	codecs[c.ID()] = c
+}
+
+//codecByID returns the codec with the ID, nil for uncompressed data
+func codecByID(id byte) (Codec, error){
+	if id == codecNone{
+		return nil, nil
+	}
+	c, ok := codecs[id]
+	if !ok{
+		return nil, fmt.Errorf("unknown codec (%d)", id)
+	}
+	return c, nil
+}
+
+//codecByName returns the codec with the name, nil for an empty name
+func codecByName(name string) (Codec, error){
+	if len(name) == 0{
+		return nil, nil
+	}
+	for _, c := range codecs{
+		if c.Name() == name{
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec (%s)", name)
+}
+
+//GzipCodec is DEFLATE in a gzip stream, from the standard library
+type GzipCodec struct{
+	//Level is one of the compress/gzip levels, 0 means the default
+	Level int
+}
+
+func (GzipCodec) ID() byte{
+	return codecGzip
+}
+
+func (GzipCodec) Name() string{
+	return "gzip"
+}
+
+func (c GzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error){
+	level := c.Level
+	if level == 0{
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (GzipCodec) NewReader(r io.Reader) (io.ReadCloser, error){
+	return gzip.NewReader(r)
+}
+
+//pickCodec compresses a sample from the front of r and returns c if the
+//sample gets smaller, or nil if the data looks incompressible (already
+//compressed or encrypted). The returned reader still produces all of r.
+func pickCodec(c Codec, r io.Reader) (Codec, io.Reader, error){
+	if c == nil{
+		return nil, r, nil
+	}
+
+	sample := make([]byte, codecSampleSize)
+	n, err := io.ReadFull(r, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF{
+		return nil, nil, err
+	}
+	sample = sample[:n]
+	r = io.MultiReader(bytes.NewReader(sample), r)
+
+	if n == 0{
+		return nil, r, nil
+	}
+
+	compressed := new(countingWriter)
+	w, err := c.NewWriter(compressed)
+	if err != nil{
+		return nil, nil, err
+	}
+	w.Write(sample)
+	if err := w.Close(); err != nil{
+		return nil, nil, err
+	}
+
+	if float64(compressed.n) > codecMaxRatio * float64(n){
+		return nil, r, nil
+	}
+	return c, r, nil
+}
+
+//encode copies src into dst compressed with c, or as is if c is nil.
+//It returns the number of bytes read from src.
+func encode(c Codec, dst io.Writer, src io.Reader) (int64, error){
+	if c == nil{
+		return io.Copy(dst, src)
+	}
+
+	w, err := c.NewWriter(dst)
+	if err != nil{
+		return 0, err
+	}
+	n, err := io.Copy(w, src)
+	if err != nil{
+		w.Close()
+		return n, err
+	}
+	return n, w.Close()
+}
+
+//decode returns a reader producing r decompressed with c,
+//or r itself if c is nil
+func decode(c Codec, r io.Reader) (io.Reader, error){
+	if c == nil{
+		return r, nil
+	}
+	return c.NewReader(r)
+}
+
+//countingWriter counts what is written to it and throws it away
+type countingWriter struct{
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error){
+	w.n += int64(len(p))
+	return len(p), nil
+}
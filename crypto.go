@@ -3,12 +3,29 @@ package main
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/md5"
 	"crypto/rand"
 	"encoding/hex"
 	"io"
 )
 
+//copyEncrypt puts a header in front of the ciphertext: the ID of the
+//codec the plaintext was compressed with, followed by the IV
+const encHeaderSize = 1 + aes.BlockSize
+
+//encVersion is the version of the header a node records, as
+//ObjectMeta.EncVersion, with the ciphertext it keeps for a peer.
+//Ciphertext from before the codec byte has version 0 and starts
+//with the bare IV.
+const encVersion = 1
+
+//encHeaderLen is the length of the header in front of the stored ciphertext of meta
+func encHeaderLen(meta ObjectMeta) int64{
+	if meta.EncVersion == 0{
+		return aes.BlockSize
+	}
+	return encHeaderSize
+}
+
 func generateID() string{
 	buf := make([]byte, 32)
 
@@ -17,10 +34,6 @@ func generateID() string{
 	return hex.EncodeToString(buf)
 }
 
-func hashKey(key string) string{
-	hash:= md5.Sum([]byte(key))
-	return hex.EncodeToString(hash[:])
-}
 func newEncryptionkey() []byte{
 	keyBuf := make([]byte, 32)
 	io.ReadFull(rand.Reader, keyBuf)
@@ -58,16 +71,28 @@ func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error){
 		return 0, err
 	}
 
-	//Read the IV from the given io.Reader, which in out case
-	//should be the block.blockSize() we read.
-	iv := make([]byte, block.BlockSize())
-	if _,err := src.Read(iv); err != nil{
+	//Read the codec and the IV from the given io.Reader, the header
+	//counts towards what was read like copyEncrypt counts it
+	codec, iv, err := readEncHeader(src)
+	if err != nil{
 		return 0, err
 	}
 	
 	stream := cipher.NewCTR(block, iv)
 
-	return copyStream(stream, block.BlockSize(), src, dst)
+	if codec == nil{
+		return copyStream(stream, encHeaderSize, src, dst)
+	}
+
+	r, err := codec.NewReader(cipher.StreamReader{S: stream, R: src})
+	if err != nil{
+		return 0, err
+	}
+	n, err := io.Copy(dst, r)
+	if err != nil{
+		return 0, err
+	}
+	return encHeaderSize + int(n), nil
 	// for{
 	// 	n, err := src.Read(buf)
 	// 	if n > 0{
@@ -87,24 +112,102 @@ func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error){
 	// }
 }
 
-func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error){
+//newCTRAt returns a CTR stream that is positioned at the given byte
+//offset of the plaintext. CTR turns the IV into a counter that goes up
+//by one for every block, so we can jump straight to the block holding
+//offset and then throw away the keystream in front of it.
+func newCTRAt(block cipher.Block, iv []byte, offset int64) cipher.Stream{
+	blockSize := int64(block.BlockSize())
+
+	counter := make([]byte, len(iv))
+	copy(counter, iv)
+
+	//add the block index to the counter as a big endian number
+	carry := uint64(offset / blockSize)
+	for i := len(counter) - 1; i >= 0 && carry > 0; i--{
+		sum := uint64(counter[i]) + (carry & 0xff)
+		counter[i] = byte(sum)
+		carry = (carry >> 8) + (sum >> 8)
+	}
+
+	stream := cipher.NewCTR(block, counter)
+
+	if skip := offset % blockSize; skip > 0{
+		junk := make([]byte, skip)
+		stream.XORKeyStream(junk, junk)
+	}
+	return stream
+}
+
+//newDecryptReader reads the header from the front of src and returns
+//a reader producing the decrypted and decompressed rest of it
+func newDecryptReader(key []byte, src io.Reader) (io.Reader, error){
+	block, err := aes.NewCipher(key)
+	if err != nil{
+		return nil, err
+	}
+
+	codec, iv, err := readEncHeader(src)
+	if err != nil{
+		return nil, err
+	}
+
+	return decode(codec, cipher.StreamReader{S: cipher.NewCTR(block, iv), R: src})
+}
+
+//readEncHeader reads the header copyEncrypt put in front of the
+//ciphertext, the codec is nil if the plaintext isn't compressed
+func readEncHeader(src io.Reader) (Codec, []byte, error){
+	header := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil{
+		return nil, nil, err
+	}
+
+	codec, err := codecByID(header[0])
+	if err != nil{
+		return nil, nil, err
+	}
+	return codec, header[1:], nil
+}
+
+//copyEncrypt compresses src with codec, unless it turns out not to
+//compress, and encrypts it into dst. A nil codec never compresses.
+func copyEncrypt(key []byte, codec Codec, src io.Reader, dst io.Writer) (int, error){
 	block, err := aes.NewCipher(key)
 	if err != nil{
 		return 0, err
 	}
 
-	iv := make([]byte, block.BlockSize()) //16 bytes
+	codec, src, err = pickCodec(codec, src)
+	if err != nil{
+		return 0, err
+	}
+
+	header := make([]byte, encHeaderSize)
+	if codec != nil{
+		header[0] = codec.ID()
+	}
+
+	iv := header[1:] //16 bytes
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil{
 		return 0, err
 	}
 
-	//Prepend the IV to the file.
-	if _, err := dst.Write(iv); err != nil{
+	//Prepend the codec and the IV to the file.
+	if _, err := dst.Write(header); err != nil{
 		return 0, err
 	}
 
 
 	stream := cipher.NewCTR(block, iv)
 
-	return copyStream(stream, block.BlockSize(), src, dst)
+	if codec == nil{
+		return copyStream(stream, encHeaderSize, src, dst)
+	}
+
+	ciphertext := &countingWriter{}
+	if _, err := encode(codec, cipher.StreamWriter{S: stream, W: io.MultiWriter(dst, ciphertext)}, src); err != nil{
+		return 0, err
+	}
+	return encHeaderSize + int(ciphertext.n), nil
 }
@@ -2,6 +2,11 @@ package main
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
 	"testing"
 )
 
@@ -11,7 +16,7 @@ func TestCopyEncryptDecrypt(t *testing.T){
 	dst := new(bytes.Buffer)
 	key := newEncryptionkey()
 
-	_, err := copyEncrypt(key, src, dst)
+	_, err := copyEncrypt(key, nil, src, dst)
 	if err!= nil{
 		t.Error(err)
 	}
@@ -22,10 +27,108 @@ func TestCopyEncryptDecrypt(t *testing.T){
 		t.Error(err)
 	}
 
-	if nw != 16 + len(payload){
+	if nw != encHeaderSize + len(payload){
 		t.Fail()
 	}
 	if out.String() != payload{
 		t.Errorf("Decryption Failed")
 	}
-}
\ No newline at end of file
+}
+
+func TestNewCTRAt(t *testing.T){
+	payload := []byte("a payload that is a good deal longer than a single AES block")
+	dst := new(bytes.Buffer)
+	key := newEncryptionkey()
+
+	if _, err := copyEncrypt(key, nil, bytes.NewReader(payload), dst); err != nil{
+		t.Fatal(err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil{
+		t.Fatal(err)
+	}
+	ciphertext := dst.Bytes()
+	iv := ciphertext[1:encHeaderSize]
+
+	for _, offset := range []int{0, 1, 15, 16, 17, 33, len(payload) - 1}{
+		src := bytes.NewReader(ciphertext[encHeaderSize+offset:])
+		out, err := io.ReadAll(cipher.StreamReader{S: newCTRAt(block, iv, int64(offset)), R: src})
+		if err != nil{
+			t.Error(err)
+		}
+
+		if string(out) != string(payload[offset:]){
+			t.Errorf("offset %d: have %s want %s", offset, out, payload[offset:])
+		}
+	}
+}
+
+func TestCopyEncryptCodec(t *testing.T){
+	key := newEncryptionkey()
+
+	text := bytes.Repeat([]byte("the same line of log over and over again\n"), 1000)
+	noise := make([]byte, 32*1024)
+	rand.Read(noise)
+
+	for _, tc := range []struct{
+		name 	string
+		data 	[]byte
+		codec 	byte
+	}{
+		{"text", text, codecGzip},
+		{"noise", noise, codecNone},
+		{"empty", nil, codecNone},
+	}{
+		dst := new(bytes.Buffer)
+		n, err := copyEncrypt(key, GzipCodec{}, bytes.NewReader(tc.data), dst)
+		if err != nil{
+			t.Fatal(err)
+		}
+		if n != dst.Len(){
+			t.Errorf("%s: copyEncrypt says (%d) bytes, wrote (%d)", tc.name, n, dst.Len())
+		}
+		if dst.Bytes()[0] != tc.codec{
+			t.Errorf("%s: have codec (%d) want (%d)", tc.name, dst.Bytes()[0], tc.codec)
+		}
+		if tc.codec == codecGzip && dst.Len() >= len(tc.data) / 10{
+			t.Errorf("%s: (%d) bytes compressed to (%d)", tc.name, len(tc.data), dst.Len())
+		}
+
+		r, err := newDecryptReader(key, dst)
+		if err != nil{
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(out, tc.data){
+			t.Errorf("%s: round trip failed: %v", tc.name, err)
+		}
+	}
+}
+
+func TestContentIDVerify(t *testing.T){
+	data := []byte("content addressed bytes")
+	sum := sha256.Sum256(data)
+	id := contentID(sum[:])
+
+	if id[:4] != "1220" || !isContentID(id){
+		t.Fatalf("%s is not a sha2-256 multihash", id)
+	}
+
+	v, err := newVerifyReader(bytes.NewReader(data), id)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(v); err != nil{
+		t.Errorf("expected matching content to verify, got %s", err)
+	}
+
+	v, _ = newVerifyReader(bytes.NewReader([]byte("tampered bytes")), id)
+	if _, err := io.ReadAll(v); err != ErrContentMismatch{
+		t.Errorf("have %v want %v", err, ErrContentMismatch)
+	}
+
+	if isContentID("picture_1.png"){
+		t.Error("a plain key should not parse as a content identifier")
+	}
+}
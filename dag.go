@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+//kinds of DAG blocks, stored as the first byte of every block
+const (
+	//a leaf holding a chunk of file data
+	dagRaw byte = 0x00
+	//an inner node of a file, its links are the parts of the file in order
+	dagFile byte = 0x01
+	//a directory, its links are named entries pointing at files or directories
+	dagDirectory byte = 0x02
+
+	//most links a single inner node holds
+	dagFanout = 64
+)
+
+//DAGLink points from one block to another by its content identifier
+type DAGLink struct{
+	//Name is only set for the entries of a directory
+	Name 	string 	`json:",omitempty"`
+	CID 	string
+	//Size is the number of file bytes below the link
+	Size 	int64
+}
+
+//DAGNode is a decoded block of a Merkle DAG. Every block is addressed
+//by the content identifier of its encoding, and inner nodes address
+//their children the same way, so the root ID covers the whole tree.
+type DAGNode struct{
+	Kind 	byte
+	Data 	[]byte
+	Links 	[]DAGLink
+}
+
+//encode returns the block for the node, the kind byte followed by the
+//raw data for leaves or the JSON encoded links for everything else
+func (n *DAGNode) encode() ([]byte, error){
+	if n.Kind == dagRaw{
+		return append([]byte{dagRaw}, n.Data...), nil
+	}
+
+	b, err := json.Marshal(n.Links)
+	if err != nil{
+		return nil, err
+	}
+	return append([]byte{n.Kind}, b...), nil
+}
+
+func decodeDAGNode(block []byte) (*DAGNode, error){
+	if len(block) == 0{
+		return nil, fmt.Errorf("empty DAG block")
+	}
+
+	n := &DAGNode{Kind: block[0]}
+	switch n.Kind{
+	case dagRaw:
+		n.Data = block[1:]
+	case dagFile, dagDirectory:
+		if err := json.Unmarshal(block[1:], &n.Links); err != nil{
+			return nil, fmt.Errorf("corrupt DAG block: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown DAG block kind (%d)", n.Kind)
+	}
+	return n, nil
+}
+
+//size is the number of file bytes below the node
+func (n *DAGNode) size() int64{
+	if n.Kind == dagRaw{
+		return int64(len(n.Data))
+	}
+
+	var size int64
+	for _, l := range n.Links{
+		size += l.Size
+	}
+	return size
+}
+
+//putDAGNode encodes the node, hands the block to put and returns a link to it
+func putDAGNode(n *DAGNode, put func(string, []byte) error) (DAGLink, error){
+	block, err := n.encode()
+	if err != nil{
+		return DAGLink{}, err
+	}
+
+	sum := sha256.Sum256(block)
+	link := DAGLink{CID: contentID(sum[:]), Size: n.size()}
+
+	return link, put(link.CID, block)
+}
+
+//buildDAG splits r into content defined chunks and builds a balanced
+//tree over them, put is called for every block bottom up. It returns
+//the link to the root block.
+func buildDAG(r io.Reader, put func(string, []byte) error) (DAGLink, error){
+	level := []DAGLink{}
+
+	chunker := NewChunker(r)
+	for{
+		chunk, err := chunker.Next()
+		if err == io.EOF{
+			break
+		}
+		if err != nil{
+			return DAGLink{}, err
+		}
+
+		link, err := putDAGNode(&DAGNode{Kind: dagRaw, Data: chunk}, put)
+		if err != nil{
+			return DAGLink{}, err
+		}
+		level = append(level, link)
+	}
+
+	//an empty file is a single empty leaf
+	if len(level) == 0{
+		return putDAGNode(&DAGNode{Kind: dagRaw}, put)
+	}
+
+	for len(level) > 1{
+		next := []DAGLink{}
+		for i := 0; i < len(level); i += dagFanout{
+			end := min(i + dagFanout, len(level))
+
+			link, err := putDAGNode(&DAGNode{Kind: dagFile, Links: level[i:end]}, put)
+			if err != nil{
+				return DAGLink{}, err
+			}
+			next = append(next, link)
+		}
+		level = next
+	}
+
+	return level[0], nil
+}
+
+//verifyBlock checks a block against the content identifier it was asked for
+func verifyBlock(cid string, block []byte) error{
+	want, err := parseContentID(cid)
+	if err != nil{
+		return err
+	}
+
+	sum := sha256.Sum256(block)
+	if !bytes.Equal(sum[:], want){
+		return fmt.Errorf("DAG block (%s): %w", cid, ErrContentMismatch)
+	}
+	return nil
+}
+
+//dagSpan is a part of the file below a link that still has to be read
+type dagSpan struct{
+	cid 	string
+	offset 	int64
+	length 	int64
+}
+
+//dagReader reads a range of a file DAG. Blocks are fetched one at a
+//time as the reader gets to them, and subtrees outside of the range
+//are skipped using the sizes on the links, so they are never fetched.
+type dagReader struct{
+	get 	func(string) (*DAGNode, error)
+	//spans still to read, the next one is at the end
+	stack 	[]dagSpan
+	cur 	[]byte
+}
+
+func newDAGReader(get func(string) (*DAGNode, error), root string, offset int64, length int64) (*dagReader, error){
+	node, err := get(root)
+	if err != nil{
+		return nil, err
+	}
+	if node.Kind == dagDirectory{
+		return nil, fmt.Errorf("(%s) is a directory", root)
+	}
+
+	size := node.size()
+	if offset > size{
+		return nil, fmt.Errorf("offset (%d) is past the end of (%s) (%d bytes)", offset, root, size)
+	}
+	if length == 0 || offset + length > size{
+		length = size - offset
+	}
+
+	return &dagReader{
+		get: 	get,
+		stack: 	[]dagSpan{{cid: root, offset: offset, length: length}},
+	}, nil
+}
+
+func (r *dagReader) Read(p []byte) (int, error){
+	for len(r.cur) == 0{
+		if len(r.stack) == 0{
+			return 0, io.EOF
+		}
+
+		span := r.stack[len(r.stack) - 1]
+		r.stack = r.stack[:len(r.stack) - 1]
+		if span.length == 0{
+			continue
+		}
+
+		node, err := r.get(span.cid)
+		if err != nil{
+			return 0, err
+		}
+
+		switch node.Kind{
+		case dagRaw:
+			if span.offset + span.length > int64(len(node.Data)){
+				return 0, fmt.Errorf("DAG leaf (%s) is shorter than its link says", span.cid)
+			}
+			r.cur = node.Data[span.offset : span.offset + span.length]
+
+		case dagFile:
+			//push the children that overlap the span, last one first
+			children := []dagSpan{}
+			var pos int64
+			end := span.offset + span.length
+			for _, l := range node.Links{
+				from, to := pos, pos + l.Size
+				pos = to
+				if to <= span.offset || from >= end{
+					continue
+				}
+
+				start := max(span.offset, from)
+				children = append(children, dagSpan{
+					cid: 	l.CID,
+					offset: start - from,
+					length: min(end, to) - start,
+				})
+			}
+			for i := len(children) - 1; i >= 0; i--{
+				r.stack = append(r.stack, children[i])
+			}
+
+		default:
+			return 0, fmt.Errorf("unexpected DAG block kind (%d) inside a file", node.Kind)
+		}
+	}
+
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+//StoreDAG stores the file as a Merkle DAG and returns the content
+//identifier of its root block. Every block is stored and replicated
+//on its own, so peers can later serve any part of the tree.
+func (s *FileServer) StoreDAG(r io.Reader) (string, error){
+	root, err := buildDAG(r, s.putBlock)
+	if err != nil{
+		return "", err
+	}
+
+	fmt.Printf("[%s] stored DAG (%s) of (%d) bytes\n", s.Transport.Addr(), root.CID, root.Size)
+	return root.CID, nil
+}
+
+//StoreDirectory stores a directory node linking to the given
+//entries, which are files or other directories
+func (s *FileServer) StoreDirectory(entries []DAGLink) (string, error){
+	for _, e := range entries{
+		if len(e.Name) == 0{
+			return "", fmt.Errorf("directory entry (%s) has no name", e.CID)
+		}
+	}
+
+	link, err := putDAGNode(&DAGNode{Kind: dagDirectory, Links: entries}, s.putBlock)
+	if err != nil{
+		return "", err
+	}
+	return link.CID, nil
+}
+
+//ListDirectory returns the entries of a directory node
+func (s *FileServer) ListDirectory(cid string) ([]DAGLink, error){
+	node, err := s.getBlock(cid)
+	if err != nil{
+		return nil, err
+	}
+	if node.Kind != dagDirectory{
+		return nil, fmt.Errorf("(%s) is not a directory", cid)
+	}
+	return node.Links, nil
+}
+
+//GetDAG streams the file below the root block
+func (s *FileServer) GetDAG(root string) (io.Reader, error){
+	return s.GetDAGRange(root, 0, 0)
+}
+
+//GetDAGRange streams length bytes of the file below the root block
+//starting at offset. Only the blocks on the path to the range are
+//fetched, and each of them is verified before it is used.
+func (s *FileServer) GetDAGRange(root string, offset int64, length int64) (io.Reader, error){
+	return newDAGReader(s.getBlock, root, offset, length)
+}
+
+//putBlock stores and replicates a single DAG block
+func (s *FileServer) putBlock(cid string, block []byte) error{
+	//blocks are immutable, if we have it the peers got it too
+	if s.store.Has(s.ID, cid){
+		return nil
+	}
+
+	if _, err := s.store.Write(s.ID, cid, bytes.NewReader(block)); err != nil{
+		return err
+	}
+	return s.replicate(cid, int64(len(block)), bytes.NewReader(block))
+}
+
+//getBlock returns a DAG block from disk, or from the first peer that
+//has it. The block is checked against its content identifier before
+//it is decoded, and blocks from the network are kept for next time.
+func (s *FileServer) getBlock(cid string) (*DAGNode, error){
+	var (
+		r 		io.ReadCloser
+		err 	error
+		local 	= s.store.Has(s.ID, cid)
+	)
+	if local{
+		_, r, err = s.store.Read(s.ID, cid)
+	} else{
+		r, err = s.openRemote(cid, 0, 0)
+	}
+	if err != nil{
+		return nil, err
+	}
+
+	block, err := io.ReadAll(r)
+	r.Close()
+	if err != nil{
+		return nil, err
+	}
+
+	if err := verifyBlock(cid, block); err != nil{
+		return nil, err
+	}
+
+	if !local{
+		if _, err := s.store.Write(s.ID, cid, bytes.NewReader(block)); err != nil{
+			fmt.Printf("[%s] could not keep DAG block (%s): %s\n", s.Transport.Addr(), cid, err)
+		}
+	}
+
+	return decodeDAGNode(block)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestDAG(t *testing.T) {
+	data := make([]byte, 3*1024*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	blocks := make(map[string][]byte)
+	put := func(cid string, block []byte) error {
+		blocks[cid] = append([]byte(nil), block...)
+		return nil
+	}
+
+	root, err := buildDAG(bytes.NewReader(data), put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Size != int64(len(data)) {
+		t.Errorf("have root size %d want %d", root.Size, len(data))
+	}
+
+	var fetched []string
+	get := func(cid string) (*DAGNode, error) {
+		fetched = append(fetched, cid)
+		block := blocks[cid]
+		if err := verifyBlock(cid, block); err != nil {
+			return nil, err
+		}
+		return decodeDAGNode(block)
+	}
+
+	r, err := newDAGReader(get, root.CID, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Error("file read back from the DAG does not match")
+	}
+	all := len(fetched)
+
+	//a small range should only touch the blocks on its path
+	fetched = nil
+	r, err = newDAGReader(get, root.CID, 2000000, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = io.ReadAll(r)
+	if !bytes.Equal(b, data[2000000:2000100]) {
+		t.Error("range read back from the DAG does not match")
+	}
+	if len(fetched) >= all/4 {
+		t.Errorf("range fetched %d of %d blocks", len(fetched), all)
+	}
+
+	//a tampered leaf must be caught as soon as it is fetched
+	for cid, block := range blocks {
+		if block[0] == dagRaw {
+			block[len(block)-1] ^= 0xff
+			if _, err := get(cid); err == nil {
+				t.Error("expected tampered block to fail verification")
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "errors"
+
+//diskSpace isn't known on this platform, callers treat
+//every disk as having the same room
+func diskSpace(path string) (uint64, uint64, error){
+	return 0, 0, errors.New("free space is not known on this platform")
+}
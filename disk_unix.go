@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+//diskSpace returns the bytes free for unprivileged writes and
+//the size of the filesystem path is on
+func diskSpace(path string) (uint64, uint64, error){
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil{
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
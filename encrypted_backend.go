@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+//the metadata an EncryptedBackend seals is kept under this key
+//of the metadata of the object in the backend it wraps
+const sealedMetaKey = "sealed"
+
+//EncryptedBackend encrypts everything it stores in the backend it wraps
+//with keys derived from a node key, so the disks of a node on their own
+//give nothing away. Objects are AES-CTR encrypted behind a random IV and
+//decrypted as they are read, range reads included. Keys are stored under
+//their HMAC, and the key, checksum and metadata of every object are
+//sealed with AES-GCM. Sizes, times and IDs are left in the clear.
+//
+//Objects that were stored before the backend was wrapped can't be read
+//through it, they have to be exported and imported again.
+type EncryptedBackend struct{
+	Backend
+
+	//HMAC key the keys are stored under
+	names 	[]byte
+	data 	cipher.Block
+	meta 	cipher.AEAD
+}
+
+//sealedMeta is the part of the metadata of an object that is sealed
+type sealedMeta struct{
+	Key 		string
+	Checksum 	string 				`json:",omitempty"`
+	Metadata 	map[string]string 	`json:",omitempty"`
+}
+
+func NewEncryptedBackend(b Backend, nodeKey []byte) *EncryptedBackend{
+	//every use gets a key of its own, and all of them are AES-256 keys
+	//whatever the length of the node key
+	derive := func(use string) []byte{
+		mac := hmac.New(sha256.New, nodeKey)
+		mac.Write([]byte(use))
+		return mac.Sum(nil)
+	}
+
+	data, _ := aes.NewCipher(derive("data"))
+	metaBlock, _ := aes.NewCipher(derive("meta"))
+	meta, _ := cipher.NewGCM(metaBlock)
+
+	return &EncryptedBackend{
+		Backend: 	b,
+		names: 		derive("names"),
+		data: 		data,
+		meta: 		meta,
+	}
+}
+
+//name is the key the object of key is stored under
+func (b *EncryptedBackend) name(key string) string{
+	mac := hmac.New(sha256.New, b.names)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//seal turns the metadata of an object into the metadata it is
+//stored with, the sealed part is bound to where it is stored
+func (b *EncryptedBackend) seal(meta ObjectMeta) (ObjectMeta, error){
+	plain, err := json.Marshal(sealedMeta{Key: meta.Key, Checksum: meta.Checksum, Metadata: meta.Metadata})
+	if err != nil{
+		return ObjectMeta{}, err
+	}
+
+	nonce := make([]byte, b.meta.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil{
+		return ObjectMeta{}, err
+	}
+	name := b.name(meta.Key)
+	sealed := b.meta.Seal(nonce, nonce, plain, []byte(meta.ID + "/" + name))
+
+	meta.Key, meta.Checksum = name, ""
+	meta.Metadata = map[string]string{sealedMetaKey: base64.StdEncoding.EncodeToString(sealed)}
+	return meta, nil
+}
+
+//unseal turns the metadata an object is stored with back into its own
+func (b *EncryptedBackend) unseal(meta ObjectMeta) (ObjectMeta, error){
+	sealed, err := base64.StdEncoding.DecodeString(meta.Metadata[sealedMetaKey])
+	if err != nil || len(sealed) < b.meta.NonceSize(){
+		return ObjectMeta{}, fmt.Errorf("[%s] of (%s) was not stored encrypted", meta.Key, meta.ID)
+	}
+
+	nonce := sealed[:b.meta.NonceSize()]
+	plain, err := b.meta.Open(nil, nonce, sealed[len(nonce):], []byte(meta.ID + "/" + meta.Key))
+	if err != nil{
+		return ObjectMeta{}, fmt.Errorf("unsealing the metadata of [%s] of (%s): %w", meta.Key, meta.ID, err)
+	}
+
+	var s sealedMeta
+	if err := json.Unmarshal(plain, &s); err != nil{
+		return ObjectMeta{}, err
+	}
+	meta.Key, meta.Checksum, meta.Metadata = s.Key, s.Checksum, s.Metadata
+	return meta, nil
+}
+
+func (b *EncryptedBackend) Put(id string, key string) (BlobWriter, error){
+	w, err := b.Backend.Put(id, b.name(key))
+	if err != nil{
+		return nil, err
+	}
+
+	iv := make([]byte, b.data.BlockSize())
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil{
+		w.Abort()
+		return nil, err
+	}
+	if _, err := w.Write(iv); err != nil{
+		w.Abort()
+		return nil, err
+	}
+
+	return &encryptedBlobWriter{
+		BlobWriter: w,
+		stream: 	cipher.NewCTR(b.data, iv),
+		backend: 	b,
+		id: 		id,
+		key: 		key,
+	}, nil
+}
+
+//encryptedBlobWriter encrypts what is written on the way
+//through and seals the metadata it is committed with
+type encryptedBlobWriter struct{
+	BlobWriter
+	stream 	cipher.Stream
+	backend *EncryptedBackend
+	id 		string
+	key 	string
+}
+
+func (w *encryptedBlobWriter) Write(p []byte) (int, error){
+	buf := make([]byte, len(p))
+	w.stream.XORKeyStream(buf, p)
+	return w.BlobWriter.Write(buf)
+}
+
+func (w *encryptedBlobWriter) Commit(meta ObjectMeta) error{
+	meta.ID, meta.Key = w.id, w.key
+	sealed, err := w.backend.seal(meta)
+	if err != nil{
+		return err
+	}
+	return w.BlobWriter.Commit(sealed)
+}
+
+func (b *EncryptedBackend) Get(id string, key string) (int64, io.ReadCloser, error){
+	return b.ReadRange(id, key, 0, 0)
+}
+
+//ReadRange reads the IV in front of the object and decrypts the
+//range on its own, CTR can start anywhere
+func (b *EncryptedBackend) ReadRange(id string, key string, offset int64, length int64) (int64, io.ReadCloser, error){
+	name := b.name(key)
+	ivSize := int64(b.data.BlockSize())
+
+	_, r, err := b.Backend.ReadRange(id, name, 0, ivSize)
+	if errors.Is(err, os.ErrNotExist){
+		return 0, nil, errNotExist(id, key)
+	}
+	if err != nil{
+		return 0, nil, err
+	}
+	iv := make([]byte, ivSize)
+	_, err = io.ReadFull(r, iv)
+	r.Close()
+	if err != nil{
+		return 0, nil, fmt.Errorf("reading the IV of [%s] of (%s): %w", key, id, err)
+	}
+
+	if offset < 0{
+		return 0, nil, fmt.Errorf("invalid range offset (%d) length (%d)", offset, length)
+	}
+	n, r, err := b.Backend.ReadRange(id, name, offset + ivSize, length)
+	if err != nil{
+		return 0, nil, err
+	}
+	return n, &sectionReadCloser{
+		Reader: cipher.StreamReader{S: newCTRAt(b.data, iv, offset), R: r},
+		Closer: r,
+	}, nil
+}
+
+func (b *EncryptedBackend) Stat(id string, key string) (ObjectMeta, error){
+	meta, err := b.Backend.Stat(id, b.name(key))
+	if errors.Is(err, os.ErrNotExist){
+		//the name it is stored under means nothing to the caller
+		return ObjectMeta{}, errNotExist(id, key)
+	}
+	if err != nil{
+		return ObjectMeta{}, err
+	}
+	return b.unseal(meta)
+}
+
+func (b *EncryptedBackend) SetMeta(meta ObjectMeta) error{
+	sealed, err := b.seal(meta)
+	if err != nil{
+		return err
+	}
+	return b.Backend.SetMeta(sealed)
+}
+
+func (b *EncryptedBackend) Delete(id string, key string) error{
+	return b.Backend.Delete(id, b.name(key))
+}
+
+//List unseals every object of id, the keys they are stored
+//under say nothing about the prefix
+func (b *EncryptedBackend) List(id string, prefix string) ([]ObjectMeta, error){
+	stored, err := b.Backend.List(id, "")
+	if err != nil{
+		return nil, err
+	}
+
+	metas := []ObjectMeta{}
+	for _, meta := range stored{
+		meta, err := b.unseal(meta)
+		if err != nil{
+			//stored before the backend was wrapped
+			continue
+		}
+		if strings.HasPrefix(meta.Key, prefix){
+			metas = append(metas, meta)
+		}
+	}
+	sort.Slice(metas, func(i, j int) bool{
+		return metas[i].Key < metas[j].Key
+	})
+	return metas, nil
+}
+
+//Lost is the lost objects of the backend it wraps, if it loses any
+func (b *EncryptedBackend) Lost() ([]ObjectMeta, error){
+	lr, ok := b.Backend.(lostReporter)
+	if !ok{
+		return nil, nil
+	}
+	stored, err := lr.Lost()
+	if err != nil{
+		return nil, err
+	}
+
+	lost := []ObjectMeta{}
+	for _, meta := range stored{
+		if meta, err := b.unseal(meta); err == nil{
+			lost = append(lost, meta)
+		}
+	}
+	return lost, nil
+}
+
+func (b *EncryptedBackend) Space() (uint64, uint64, error){
+	sr, ok := b.Backend.(spaceReporter)
+	if !ok{
+		return 0, 0, errSpaceUnknown
+	}
+	return sr.Space()
+}
+
+func (b *EncryptedBackend) Migrate() (int, error){
+	lm, ok := b.Backend.(layoutMigrator)
+	if !ok{
+		return 0, nil
+	}
+	return lm.Migrate()
+}
+
+func (b *EncryptedBackend) Close() error{
+	if c, ok := b.Backend.(io.Closer); ok{
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+//Expired reports whether the object has expired by now
+func (m ObjectMeta) Expired(now time.Time) bool{
+	return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
+//errExpired is returned for an object that expired but wasn't swept yet,
+//it is a not exist error so callers treat it like a missing object
+func errExpired(id string, key string) error{
+	return fmt.Errorf("[%s] of (%s) expired: %w", key, id, os.ErrNotExist)
+}
+
+//SweepExpired deletes every expired object that isn't pinned and returns
+//their metadata. The old versions of an expired object are left to the
+//retention policy.
+func (s *Store) SweepExpired() ([]ObjectMeta, error){
+	ids, err := s.IDs()
+	if err != nil{
+		return nil, err
+	}
+
+	swept := []ObjectMeta{}
+	for _, id := range ids{
+		metas, err := s.Backend.List(id, "")
+		if err != nil{
+			return swept, err
+		}
+
+		now := time.Now()
+		for _, meta := range metas{
+			if !meta.Expired(now){
+				continue
+			}
+
+			ok, err := s.sweep(id, meta.Key, now)
+			if err != nil{
+				return swept, err
+			}
+			if ok{
+				swept = append(swept, meta)
+			}
+		}
+	}
+	return swept, nil
+}
+
+//sweep deletes the object if it is still expired, it may have
+//been written again since it was listed
+func (s *Store) sweep(id string, key string, now time.Time) (bool, error){
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
+
+	meta, err := s.Backend.Stat(id, key)
+	if err != nil || !meta.Expired(now) || meta.Pinned(){
+		return false, nil
+	}
+	return true, s.deleteObject(meta, false)
+}
+
+//StoreWithOpts is Store with options for the write, the replicas
+//get the same expiration time as the local copy
+func (s *FileServer) StoreWithOpts(key string, r io.Reader, opts WriteOpts) error{
+	if s.store.Chunking{
+		return s.storeChunked(key, r, opts)
+	}
+	return s.storeFile(key, r, opts)
+}
+
+//StartExpirySweep deletes the expired objects every interval (a minute
+//if it is not set) until the server is stopped. Every node sweeps its
+//own replicas, they carry the expiration time of the file.
+func (s *FileServer) StartExpirySweep(interval time.Duration){
+	if interval <= 0{
+		interval = time.Minute
+	}
+
+	go func(){
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for{
+			select{
+			case <- ticker.C:
+				swept, err := s.store.SweepExpired()
+				if err != nil{
+					log.Printf("[%s] sweeping expired objects failed: %s", s.Transport.Addr(), err)
+				}
+				if len(swept) > 0{
+					fmt.Printf("[%s] swept (%d) expired objects\n", s.Transport.Addr(), len(swept))
+				}
+
+			case <- s.qiutch:
+				return
+			}
+		}
+	}()
+}
+
+//expiryOf returns the expiration time of the file this node
+//stores, so a replica expires together with it
+func (s *FileServer) expiryOf(key string) time.Time{
+	meta, err := s.store.Stat(s.ID, key)
+	if err != nil{
+		return time.Time{}
+	}
+	return meta.ExpiresAt
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	//every object is a file of the archive under "objects/<id>/<key>",
+	//with the key escaped so it is a single name whatever it holds
+	exportFolderName = "objects"
+
+	//the metadata of an object is kept as JSON in this PAX record of its file
+	exportMetaRecord = "HYPERFS.meta"
+
+	//the deletions of the objects of an ID are recorded under the ID
+	//"tombstones/<id>", and go in the archive under that folder with
+	//the ID, key and time of the deletion in this PAX record
+	tombstonesFolderName = "tombstones"
+	exportTombstoneRecord = "HYPERFS.tombstone"
+)
+
+//tombstoneNamespace is the ID the deletions of the objects of id are recorded under
+func tombstoneNamespace(id string) string{
+	return tombstonesFolderName + "/" + id
+}
+
+//recordDeletion leaves a tombstone for a deleted object, so an
+//incremental export knows it is gone. chunkLock must be held.
+func (s *Store) recordDeletion(id string, key string) error{
+	w, err := s.Backend.Put(tombstoneNamespace(id), key)
+	if err != nil{
+		return err
+	}
+	defer w.Abort()
+
+	now := time.Now()
+	return w.Commit(ObjectMeta{CreatedAt: now, ModifiedAt: now})
+}
+
+//clearTombstone removes the tombstone of an object that was written
+//again, if it has one. chunkLock must be held.
+func (s *Store) clearTombstone(id string, key string) error{
+	if _, err := s.Backend.Stat(tombstoneNamespace(id), key); err != nil{
+		return nil
+	}
+	return s.Backend.Delete(tombstoneNamespace(id), key)
+}
+
+//Export writes the current version of every object modified after since
+//to w as a tar archive, the zero time exports all of them. Objects are
+//written as Read returns them, with their original keys and metadata,
+//so the archive doesn't depend on the backend, codec or chunking of the
+//store. An incremental archive, since isn't the zero time, also holds a
+//tombstone for every object deleted after since and not written again,
+//when the store keeps Tombstones.
+//It returns how many objects and tombstones were exported.
+func (s *Store) Export(w io.Writer, since time.Time) (int, error){
+	ids, err := s.IDs()
+	if err != nil{
+		return 0, err
+	}
+
+	tw := tar.NewWriter(w)
+	n := 0
+	for _, id := range ids{
+		metas, err := s.List(id, "")
+		if err != nil{
+			return n, err
+		}
+
+		for _, meta := range metas{
+			if !meta.ModifiedAt.After(since){
+				continue
+			}
+			err := s.exportObject(tw, meta)
+			if errors.Is(err, os.ErrNotExist){
+				//deleted since it was listed
+				continue
+			}
+			if err != nil{
+				return n, fmt.Errorf("exporting [%s] of (%s): %w", meta.Key, id, err)
+			}
+			n++
+		}
+	}
+
+	if !since.IsZero(){
+		deleted, err := s.exportTombstones(tw, since)
+		n += deleted
+		if err != nil{
+			return n, err
+		}
+	}
+	return n, tw.Close()
+}
+
+//exportTombstones writes the tombstones of the objects deleted after since
+func (s *Store) exportTombstones(tw *tar.Writer, since time.Time) (int, error){
+	all, err := s.Backend.IDs()
+	if err != nil{
+		return 0, err
+	}
+
+	n := 0
+	for _, ns := range all{
+		//the objects of an ID may all be gone, so it is only
+		//found through the IDs of its tombstones
+		id, ok := strings.CutPrefix(ns, tombstonesFolderName + "/")
+		if !ok || isInternalID(id){
+			continue
+		}
+		tombstones, err := s.Backend.List(ns, "")
+		if err != nil{
+			return n, err
+		}
+
+		for _, t := range tombstones{
+			if !t.ModifiedAt.After(since){
+				continue
+			}
+			record, err := json.Marshal(ObjectMeta{ID: id, Key: t.Key, ModifiedAt: t.ModifiedAt})
+			if err != nil{
+				return n, err
+			}
+
+			header := &tar.Header{
+				Typeflag: 	tar.TypeReg,
+				Name: 		fmt.Sprintf("%s/%s/%s", tombstonesFolderName, id, url.PathEscape(t.Key)),
+				Mode: 		0644,
+				ModTime: 	t.ModifiedAt,
+				Format: 	tar.FormatPAX,
+				PAXRecords: map[string]string{exportTombstoneRecord: string(record)},
+			}
+			if err := tw.WriteHeader(header); err != nil{
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *Store) exportObject(tw *tar.Writer, meta ObjectMeta) error{
+	_, r, err := s.readStream(meta)
+	if err != nil{
+		return err
+	}
+	defer r.Close()
+
+	//a corrupted object isn't carried over into the archive
+	var src io.Reader = r
+	if len(meta.Checksum) > 0{
+		if src, err = newChecksumReader(r, meta.Checksum); err != nil{
+			return err
+		}
+	}
+
+	//how the object is kept here means nothing to the store it goes to
+	meta.Path, meta.Chunked, meta.Codec = "", false, ""
+	record, err := json.Marshal(meta)
+	if err != nil{
+		return err
+	}
+
+	header := &tar.Header{
+		Typeflag: 	tar.TypeReg,
+		Name: 		fmt.Sprintf("%s/%s/%s", exportFolderName, meta.ID, url.PathEscape(meta.Key)),
+		Size: 		meta.Size,
+		Mode: 		0644,
+		ModTime: 	meta.ModifiedAt,
+		Format: 	tar.FormatPAX,
+		PAXRecords: map[string]string{exportMetaRecord: string(record)},
+	}
+	if err := tw.WriteHeader(header); err != nil{
+		return err
+	}
+
+	_, err = io.Copy(tw, src)
+	return err
+}
+
+//Import stores every object of an archive written by Export, checked
+//against its checksum, and deletes the objects its tombstones record
+//as deleted, unless they are pinned. It returns how many objects it
+//stored or deleted. Objects the store already has with the same checksum
+//and objects that expired in the meantime are skipped, so an incremental
+//archive can be imported on top of the one it follows. Objects are
+//written anew, so they get new creation and modification times.
+func (s *Store) Import(r io.Reader) (int, error){
+	tr := tar.NewReader(r)
+	n := 0
+	for{
+		header, err := tr.Next()
+		if err == io.EOF{
+			return n, nil
+		}
+		if err != nil{
+			return n, err
+		}
+		if header.Typeflag != tar.TypeReg{
+			continue
+		}
+
+		if record, ok := header.PAXRecords[exportTombstoneRecord]; ok{
+			deleted, err := s.importTombstone(header.Name, record)
+			if err != nil{
+				return n, err
+			}
+			if deleted{
+				n++
+			}
+			continue
+		}
+
+		record, ok := header.PAXRecords[exportMetaRecord]
+		if !ok{
+			return n, fmt.Errorf("[%s] of the archive has no metadata", header.Name)
+		}
+		var meta ObjectMeta
+		if err := json.Unmarshal([]byte(record), &meta); err != nil{
+			return n, fmt.Errorf("reading the metadata of [%s]: %w", header.Name, err)
+		}
+		if len(meta.ID) == 0 || isInternalID(meta.ID){
+			return n, fmt.Errorf("[%s] of the archive has an invalid ID (%s)", header.Name, meta.ID)
+		}
+
+		if meta.Expired(time.Now()){
+			continue
+		}
+		if old, err := s.Stat(meta.ID, meta.Key); err == nil && old.Checksum == meta.Checksum{
+			continue
+		}
+
+		_, err = s.WriteWithOpts(meta.ID, meta.Key, tr, WriteOpts{
+			Metadata: 	meta.Metadata,
+			Checksum: 	meta.Checksum,
+			VersionID: 	meta.VersionID,
+			ExpiresAt: 	meta.ExpiresAt,
+			Cached: 	meta.Cached,
+			EncVersion: meta.EncVersion,
+		})
+		if err != nil{
+			return n, fmt.Errorf("importing [%s] of (%s): %w", meta.Key, meta.ID, err)
+		}
+		n++
+	}
+}
+
+//importTombstone deletes the object a tombstone of the archive records
+//as deleted and tells whether there was one to delete
+func (s *Store) importTombstone(name string, record string) (bool, error){
+	var meta ObjectMeta
+	if err := json.Unmarshal([]byte(record), &meta); err != nil{
+		return false, fmt.Errorf("reading the tombstone [%s]: %w", name, err)
+	}
+	if len(meta.ID) == 0 || isInternalID(meta.ID){
+		return false, fmt.Errorf("tombstone [%s] of the archive has an invalid ID (%s)", name, meta.ID)
+	}
+
+	if _, err := s.Backend.Stat(meta.ID, meta.Key); err != nil{
+		return false, nil
+	}
+	err := s.Delete(meta.ID, meta.Key)
+	if errors.Is(err, ErrPinned){
+		log.Printf("keeping pinned [%s] of (%s) the archive deleted", meta.Key, meta.ID)
+		return false, nil
+	}
+	if err != nil{
+		return false, fmt.Errorf("deleting [%s] of (%s): %w", meta.Key, meta.ID, err)
+	}
+	return true, nil
+}
+
+//Export writes every object this server stores, its own files and the
+//replicas it keeps for its peers, to w as a tar archive. See Store.Export.
+func (s *FileServer) Export(w io.Writer, since time.Time) (int, error){
+	return s.store.Export(w, since)
+}
+
+//Import stores the objects of an archive written by Export on this
+//server. They aren't sent to the peers, the archive of every node
+//is imported on a node of its own.
+func (s *FileServer) Import(r io.Reader) (int, error){
+	return s.store.Import(r)
+}
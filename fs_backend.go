@@ -0,0 +1,546 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type FSBackendOpts struct{
+	//Root is the folder name of the root, containing
+	//all the folders/files of the system
+	Root 				string
+
+	PathTransformFunc  	PathTransformFunc
+
+	//HashedPathTransformFunc lays out the objects stored with Hashed set,
+	//whose key already is a digest. PathTransformFunc does when it is nil.
+	HashedPathTransformFunc PathTransformFunc
+
+	//KeyHasher lays the objects out by the digests it makes of their
+	//keys, the layout a FileServer with the same KeyHasher needs. It
+	//stands in for the path functions that are nil, and names the layout
+	//after the hasher when Layout is empty.
+	KeyHasher 			KeyHasher
+
+	//Layout names the layout PathTransformFunc makes, it is recorded in
+	//the root so opening it with another one is noticed. When it is empty
+	//it is "plain" for DefaultPathTransformFunc, the name casLayout gives
+	//KeyHasher, or "custom" for any other PathTransformFunc, which can't
+	//be told from another custom one, so those should be named.
+	Layout 				string
+}
+
+//FSBackend keeps every object in its own file under Root/<id>, at the
+//path PathTransformFunc makes of its key. The metadata of an object is
+//kept in a file next to it and in an index journaled in the root.
+//
+//Objects written under an earlier layout stay where they are, and are
+//found through the path their metadata recorded, until Migrate moves
+//them or they are written again.
+type FSBackend struct{
+	FSBackendOpts
+
+	//metadata of every object, answers Stat and List
+	index 	*index
+
+	//held while an object is put in place or moved to another
+	//layout, so a move never puts an old copy over a new one
+	moveLock 	sync.Mutex
+	//what the root records, nil until it is recorded
+	layout 		*fsLayout
+}
+
+func NewFSBackend(opts FSBackendOpts) *FSBackend{
+	if len(opts.Root) == 0{
+		opts.Root = defaultRootFolderName
+	}
+
+	if opts.KeyHasher != nil{
+		if len(opts.Layout) == 0 && opts.PathTransformFunc == nil{
+			opts.Layout = casLayout(opts.KeyHasher)
+		}
+		if opts.PathTransformFunc == nil{
+			opts.PathTransformFunc = NewCASPathTransformFunc(opts.KeyHasher)
+		}
+		if opts.HashedPathTransformFunc == nil{
+			opts.HashedPathTransformFunc = DigestPathTransformFunc
+		}
+	}
+
+	if len(opts.Layout) == 0{
+		opts.Layout = layoutCustom
+		if opts.PathTransformFunc == nil{
+			opts.Layout = layoutPlain
+		}
+	}
+
+	if opts.PathTransformFunc == nil{
+		opts.PathTransformFunc = DefaultPathTransformFunc
+	}
+	if opts.HashedPathTransformFunc == nil{
+		opts.HashedPathTransformFunc = opts.PathTransformFunc
+	}
+
+	idx, err := openIndex(opts.Root)
+	if err != nil{
+		log.Printf("loading index of [%s] failed, starting empty: %s", opts.Root, err)
+		idx = newIndex(fmt.Sprintf("%s/%s", opts.Root, indexFileName))
+	}
+
+	b := &FSBackend{
+		FSBackendOpts: 	opts,
+		index: 			idx,
+	}
+
+	//a root without a journal may still hold objects, from before
+	//the index existed or because the journal was lost
+	_, rootErr := os.Stat(opts.Root)
+	_, indexErr := os.Stat(idx.path)
+	if rootErr == nil && errors.Is(indexErr, os.ErrNotExist){
+		if err := b.RebuildIndex(); err != nil{
+			log.Printf("rebuilding index of [%s] failed: %s", opts.Root, err)
+		}
+	}
+	if rootErr == nil{
+		if err := b.openLayout(); err != nil{
+			log.Printf("recording the layout of [%s] failed: %s", opts.Root, err)
+		}
+	}
+
+	return b
+}
+
+//relPath is where the layout puts the object, relative to the root
+func (b *FSBackend) relPath(id string, key string) string{
+	return fmt.Sprintf("%s/%s", id, b.PathTransformFunc(key).FullPath())
+}
+
+//metaRelPath is relPath for the object stored as meta,
+//a key that already is a digest is laid out as one
+func (b *FSBackend) metaRelPath(meta ObjectMeta) string{
+	if meta.Hashed{
+		return fmt.Sprintf("%s/%s", meta.ID, b.HashedPathTransformFunc(meta.Key).FullPath())
+	}
+	return b.relPath(meta.ID, meta.Key)
+}
+
+//path is where the layout puts the object on disk
+func (b *FSBackend) path(id string, key string) string{
+	return fmt.Sprintf("%s/%s", b.Root, b.relPath(id, key))
+}
+
+//objectPath is where the object is on disk, which is
+//somewhere else for an object of an earlier layout
+func (b *FSBackend) objectPath(id string, key string) string{
+	if meta, ok := b.index.get(id, key); ok && len(meta.Path) > 0{
+		return fmt.Sprintf("%s/%s", b.Root, meta.Path)
+	}
+	return b.path(id, key)
+}
+
+func (b *FSBackend) Put(id string, key string) (BlobWriter, error){
+	f, err := b.openFileForWriting(id, key)
+	if err != nil{
+		return nil, err
+	}
+	return &fsBlobWriter{atomicFile: f, backend: b, id: id, key: key}, nil
+}
+
+//openFileForWriting returns a temporary file next to the object,
+//it only takes the place of the object once it is committed
+func (b *FSBackend) openFileForWriting(id string, key string) (*atomicFile, error){
+	fullPathWithRoot := b.path(id, key)
+
+	//the folder the file goes in, the filename can have folders
+	//of its own when the key has slashes in it
+	pathNameWithRoot := filepath.Dir(fullPathWithRoot)
+
+	//a Delete next door can prune the folders before the file is
+	//created in them, in which case they are made again
+	for attempt := 0; ; attempt++{
+		//MKdirAll makes the directory if it does not exist using
+		//the path name as the directory name
+		//os.ModePerm uses the default permissions which are read write execute
+		if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil{
+			return nil, err
+		}
+
+		f, err := createAtomic(fullPathWithRoot)
+		if errors.Is(err, os.ErrNotExist) && attempt < 3{
+			continue
+		}
+		return f, err
+	}
+}
+
+//fsBlobWriter renames its file into place and then writes the metadata
+type fsBlobWriter struct{
+	*atomicFile
+	backend *FSBackend
+	id 		string
+	key 	string
+}
+
+func (w *fsBlobWriter) Commit(meta ObjectMeta) error{
+	b := w.backend
+	b.moveLock.Lock()
+	defer b.moveLock.Unlock()
+
+	meta.ID, meta.Key = w.id, w.key
+	rel := b.metaRelPath(meta)
+
+	//the file was opened where an unhashed key goes
+	tmpDir := filepath.Dir(w.path)
+	if path := fmt.Sprintf("%s/%s", b.Root, rel); path != w.path{
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil{
+			return err
+		}
+		w.path = path
+		defer b.pruneDirs(tmpDir, fmt.Sprintf("%s/%s", b.Root, w.id))
+	}
+
+	old := b.objectPath(w.id, w.key)
+	if err := w.atomicFile.Commit(); err != nil{
+		return err
+	}
+
+	if err := b.saveMeta(meta, rel); err != nil{
+		return err
+	}
+
+	//the copy of an earlier layout is replaced by this one
+	if old != w.path{
+		b.removeFiles(old, w.id)
+	}
+	if b.layout == nil{
+		return b.saveLayout(fsLayout{Name: b.Layout})
+	}
+	return nil
+}
+
+func (b *FSBackend) Get(id string, key string) (int64, io.ReadCloser, error){
+	return b.ReadRange(id, key, 0, 0)
+}
+
+func (b *FSBackend) ReadRange(id string, key string, offset int64, length int64) (int64, io.ReadCloser, error){
+	path := b.objectPath(id, key)
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && b.objectPath(id, key) != path{
+		//moved to the new layout in the meantime
+		file, err = os.Open(b.objectPath(id, key))
+	}
+	if err != nil{
+		return 0, nil, err
+	}
+
+	fi, err := file.Stat()
+	if err != nil{
+		file.Close()
+		return 0, nil, err
+	}
+
+	n, err := rangeSize(key, fi.Size(), offset, length)
+	if err != nil{
+		file.Close()
+		return 0, nil, err
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil{
+		file.Close()
+		return 0, nil, err
+	}
+
+	return n, &sectionReadCloser{
+		Reader: io.LimitReader(file, n),
+		Closer: file,
+	}, nil
+}
+
+func (b *FSBackend) Stat(id string, key string) (ObjectMeta, error){
+	meta, ok := b.index.get(id, key)
+	if !ok{
+		return ObjectMeta{}, errNotExist(id, key)
+	}
+	return meta, nil
+}
+
+func (b *FSBackend) SetMeta(meta ObjectMeta) error{
+	b.moveLock.Lock()
+	defer b.moveLock.Unlock()
+
+	old, ok := b.index.get(meta.ID, meta.Key)
+	if !ok{
+		return errNotExist(meta.ID, meta.Key)
+	}
+	rel := old.Path
+	if len(rel) == 0{
+		rel = b.metaRelPath(old)
+	}
+	return b.saveMeta(meta, rel)
+}
+
+//saveMeta writes the metadata file next to the object, which is at rel
+//under the root, and records it in the index
+func (b *FSBackend) saveMeta(meta ObjectMeta, rel string) error{
+	meta.Path = rel
+
+	by, err := json.Marshal(meta)
+	if err != nil{
+		return err
+	}
+
+	if err := writeFileAtomic(fmt.Sprintf("%s/%s%s", b.Root, rel, metaExt), by); err != nil{
+		return err
+	}
+	return b.index.put(meta)
+}
+
+//Delete removes the object and its metadata. Folders on the way to the
+//object are only removed once they are empty, so keys that share part
+//of their path are left alone.
+func (b *FSBackend) Delete(id string, key string) error{
+	b.moveLock.Lock()
+	defer b.moveLock.Unlock()
+
+	for _, path := range []string{b.objectPath(id, key), b.path(id, key)}{
+		if err := b.removeFiles(path, id); err != nil{
+			return err
+		}
+	}
+
+	if _, ok := b.index.get(id, key); ok{
+		if err := b.index.delete(id, key); err != nil{
+			return err
+		}
+	}
+	return nil
+}
+
+//removeFiles removes the object at path, its metadata file
+//and the folders of id that are left empty
+func (b *FSBackend) removeFiles(path string, id string) error{
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist){
+		return err
+	}
+	if err := os.Remove(path + metaExt); err != nil && !errors.Is(err, os.ErrNotExist){
+		return err
+	}
+
+	b.pruneDirs(filepath.Dir(path), fmt.Sprintf("%s/%s", b.Root, id))
+	return nil
+}
+
+//pruneDirs removes dir and its parents for as long as they are
+//empty, stopping after stop, which is removed last
+func (b *FSBackend) pruneDirs(dir string, stop string){
+	dir, stop = filepath.Clean(dir), filepath.Clean(stop)
+	for strings.HasPrefix(dir, stop){
+		//fails on the first folder that still holds something
+		if err := os.Remove(dir); err != nil{
+			return
+		}
+		if dir == stop{
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (b *FSBackend) List(id string, prefix string) ([]ObjectMeta, error){
+	return b.index.list(id, prefix), nil
+}
+
+func (b *FSBackend) IDs() ([]string, error){
+	return b.index.ids(), nil
+}
+
+func (b *FSBackend) Clear() error{
+	b.moveLock.Lock()
+	defer b.moveLock.Unlock()
+
+	if err := b.index.clear(); err != nil{
+		return err
+	}
+	b.layout = nil
+	return os.RemoveAll(b.Root)
+}
+
+//RebuildIndex throws the index away and builds it again from
+//the metadata files that sit next to every object, an object
+//without one is indexed with what bareObjectMeta makes of it
+func (b *FSBackend) RebuildIndex() error{
+	metas := []ObjectMeta{}
+	//objects next to their metadata, and every other file
+	known := make(map[string]bool)
+	bare := []string{}
+
+	err := filepath.WalkDir(b.Root, func(path string, d fs.DirEntry, err error) error{
+		if err != nil{
+			return err
+		}
+		//left behind by a write that never finished
+		if !d.IsDir() && strings.HasSuffix(path, tmpExt){
+			os.Remove(path)
+			return nil
+		}
+		if d.IsDir(){
+			return nil
+		}
+		if !strings.HasSuffix(path, metaExt){
+			bare = append(bare, path)
+			return nil
+		}
+
+		by, err := os.ReadFile(path)
+		if err != nil{
+			return err
+		}
+
+		var meta ObjectMeta
+		if err := json.Unmarshal(by, &meta); err != nil{
+			log.Printf("skipping unreadable metadata file %s: %s", path, err)
+			return nil
+		}
+		//the object is next to its metadata, whatever layout put it there
+		if rel, err := filepath.Rel(b.Root, strings.TrimSuffix(path, metaExt)); err == nil{
+			meta.Path = filepath.ToSlash(rel)
+		}
+		known[strings.TrimSuffix(path, metaExt)] = true
+		metas = append(metas, meta)
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist){
+		return err
+	}
+
+	//objects from before the metadata was kept next to them
+	for _, path := range bare{
+		if known[path]{
+			continue
+		}
+		meta, ok, err := b.bareObjectMeta(path)
+		if err != nil{
+			log.Printf("skipping %s, it has no metadata and can't be read: %s", path, err)
+			continue
+		}
+		if !ok{
+			continue
+		}
+		log.Printf("indexing %s, which has no metadata, as [%s] of (%s)", path, meta.Key, meta.ID)
+		metas = append(metas, meta)
+	}
+
+	log.Printf("rebuilt index of [%s] with %d objects", b.Root, len(metas))
+	return b.index.reset(metas)
+}
+
+//bareObjectMeta makes up the metadata of an object that has none from
+//its file. It goes in the index under the path it has below the folder
+//of its ID, which is the key in the plain layout. The key of a layout
+//that hashes keys can't be told from the path, the object can still be
+//listed, exported and deleted. Files of the root itself aren't objects.
+func (b *FSBackend) bareObjectMeta(path string) (ObjectMeta, bool, error){
+	rel, err := filepath.Rel(b.Root, path)
+	if err != nil{
+		return ObjectMeta{}, false, err
+	}
+	rel = filepath.ToSlash(rel)
+
+	//the store keeps its own objects under a folder name and the ID
+	parts := strings.Split(rel, "/")
+	n := 0
+	for n < len(parts) - 1 && isInternalFolder(parts[n]){
+		n++
+	}
+	n++
+	if n >= len(parts){
+		return ObjectMeta{}, false, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil{
+		return ObjectMeta{}, false, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil{
+		return ObjectMeta{}, false, err
+	}
+	info, err := f.Stat()
+	if err != nil{
+		return ObjectMeta{}, false, err
+	}
+
+	return ObjectMeta{
+		ID: 		strings.Join(parts[:n], "/"),
+		Key: 		strings.Join(parts[n:], "/"),
+		Path: 		rel,
+		Size: 		size,
+		Checksum: 	hex.EncodeToString(hash.Sum(nil)),
+		CreatedAt: 	info.ModTime(),
+		ModifiedAt: info.ModTime(),
+	}, true, nil
+}
+
+//atomicFile is written under a temporary name that is unique to the
+//writer, so concurrent writers to the same path never share a file
+type atomicFile struct{
+	*os.File
+	path 	string
+	done 	bool
+}
+
+func createAtomic(path string) (*atomicFile, error){
+	dir, name := filepath.Split(path)
+	f, err := os.CreateTemp(dir, name + ".*" + tmpExt)
+	if err != nil{
+		return nil, err
+	}
+	return &atomicFile{File: f, path: path}, nil
+}
+
+//Commit syncs the file to disk and renames it over the final path.
+//The directory is synced as well, so the rename survives a crash.
+func (f *atomicFile) Commit() error{
+	if f.done{
+		return fmt.Errorf("(%s) was already committed or aborted", f.path)
+	}
+	f.done = true
+
+	if err := f.Sync(); err != nil{
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil{
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil{
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(f.path))
+}
+
+//Abort throws the temporary file away, it does nothing after Commit
+func (f *atomicFile) Abort(){
+	if f.done{
+		return
+	}
+	f.done = true
+	f.Close()
+	os.Remove(f.Name())
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+//KeyHasher makes the hex digest a key is known by outside the node that
+//owns it, on the network and in the CAS layout. Every node of a network
+//has to use the same one.
+type KeyHasher interface{
+	HashKey(key string) string
+}
+
+//SHA256KeyHasher is the SHA-256 of the key. Anyone who guesses a
+//key can tell it is stored, use HMACKeyHasher if that matters.
+type SHA256KeyHasher struct{}
+
+func (SHA256KeyHasher) HashKey(key string) string{
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+//HMACKeyHasher is the HMAC-SHA256 of the key under Secret, so
+//nobody without the secret learns anything from the digests
+type HMACKeyHasher struct{
+	Secret []byte
+}
+
+func (h HMACKeyHasher) HashKey(key string) string{
+	mac := hmac.New(sha256.New, h.Secret)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//hashKey is the key the peers store the file of key under
+func (s *FileServer) hashKey(key string) string{
+	return s.KeyHasher.HashKey(key)
+}
+
+//chunkID is the ID a chunk goes to the peers under instead of the
+//sha256 of its plaintext, keyed with Enckey so a peer can't tell which
+//content it holds by hashing a guess
+func (s *FileServer) chunkID(hash string) string{
+	return hex.EncodeToString(s.sealChecksum([]byte("chunk/" + hash)))
+}
+
+//sealChecksum is the HMAC-SHA256 of sum under Enckey, what the peers
+//get in place of the checksum of a chunked file
+func (s *FileServer) sealChecksum(sum []byte) []byte{
+	mac := hmac.New(sha256.New, s.Enckey)
+	mac.Write(sum)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//journal of the index, kept in the root of the store
+	indexFileName = "index.log"
+
+	//every object has a file next to it with its metadata,
+	//that is what the index is rebuilt from
+	metaExt = ".meta"
+
+	//rewrite the journal once it has this many more
+	//records than there are objects in the index
+	indexCompactSlack = 1024
+)
+
+//ObjectMeta is what the store knows about an object
+type ObjectMeta struct{
+	ID 			string
+	Key 		string
+	//Path of the object relative to the root of the store,
+	//set by backends that keep every object in its own file
+	Path 		string 				`json:",omitempty"`
+	Size 		int64
+	//Checksum is the hex encoded sha256 of the object as it was written,
+	//for a chunked object the bytes of its chunks one after another
+	Checksum 	string
+	Chunked 	bool 				`json:",omitempty"`
+	//Codec is the name of the codec the object is compressed with
+	//in the backend, Size and Checksum are of the uncompressed bytes
+	Codec 		string 				`json:",omitempty"`
+	//VersionID tells the versions of a key apart when the store keeps them
+	VersionID 	string 				`json:",omitempty"`
+	//ExpiresAt is when the object expires, the zero time means never
+	ExpiresAt 	time.Time
+	//Cached is set for a copy of an object the node doesn't own
+	Cached 		bool 				`json:",omitempty"`
+	//Hashed is set when the key already is the digest a KeyHasher made
+	//of the key of the owner, the key of a replica
+	Hashed 		bool 				`json:",omitempty"`
+	//EncVersion is the version of the header in front of the ciphertext
+	//of a replica or its chunks, see encVersion
+	EncVersion 	int 				`json:",omitempty"`
+	CreatedAt 	time.Time
+	ModifiedAt 	time.Time
+	Metadata 	map[string]string 	`json:",omitempty"`
+}
+
+//indexRecord is a single line of the journal
+type indexRecord struct{
+	Op 		string
+	Meta 	ObjectMeta
+}
+
+const (
+	indexOpPut = "put"
+	indexOpDelete = "delete"
+)
+
+//index keeps the metadata of every object in memory and persists it
+//in an append only journal. Every record is synced before the write
+//that caused it returns, and a torn record at the end of the journal
+//(a crash half way through an append) is dropped when it is loaded.
+type index struct{
+	mu 			sync.RWMutex
+	path 		string
+	journal 	*os.File
+	//number of records in the journal
+	records 	int
+	entries 	map[string]map[string]ObjectMeta
+}
+
+//newIndex returns an empty index journaled at path,
+//an empty path keeps the index in memory only
+func newIndex(path string) *index{
+	return &index{
+		path: 		path,
+		entries: 	make(map[string]map[string]ObjectMeta),
+	}
+}
+
+func openIndex(root string) (*index, error){
+	idx := newIndex(fmt.Sprintf("%s/%s", root, indexFileName))
+
+	if _, err := idx.load(); err != nil{
+		return nil, err
+	}
+	return idx, nil
+}
+
+//openJournal opens the journal for appending the first time it is
+//needed, so an empty store doesn't leave an index file behind
+func (idx *index) openJournal() error{
+	if idx.journal != nil{
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(idx.path), os.ModePerm); err != nil{
+		return err
+	}
+
+	good, err := idx.load()
+	if err != nil{
+		return err
+	}
+
+	journal, err := os.OpenFile(idx.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil{
+		return err
+	}
+
+	//cut off whatever was torn at the end, so new records start on a clean line
+	if err := journal.Truncate(good); err != nil{
+		journal.Close()
+		return err
+	}
+	if _, err := journal.Seek(good, io.SeekStart); err != nil{
+		journal.Close()
+		return err
+	}
+
+	idx.journal = journal
+	return nil
+}
+
+//load replays the journal and returns the offset of the end
+//of the last complete record
+func (idx *index) load() (int64, error){
+	f, err := os.Open(idx.path)
+	if errors.Is(err, os.ErrNotExist){
+		return 0, nil
+	}
+	if err != nil{
+		return 0, err
+	}
+	defer f.Close()
+
+	idx.entries = make(map[string]map[string]ObjectMeta)
+	idx.records = 0
+
+	var good int64
+	r := bufio.NewReader(f)
+	for{
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF{
+			//a line without its newline never finished being written
+			break
+		}
+		if err != nil{
+			return 0, err
+		}
+
+		var rec indexRecord
+		if err := json.Unmarshal(line, &rec); err != nil{
+			log.Printf("index journal is torn at offset %d, dropping the rest", good)
+			break
+		}
+
+		idx.apply(rec)
+		idx.records++
+		good += int64(len(line))
+	}
+	return good, nil
+}
+
+func (idx *index) apply(rec indexRecord){
+	switch rec.Op{
+	case indexOpPut:
+		keys, ok := idx.entries[rec.Meta.ID]
+		if !ok{
+			keys = make(map[string]ObjectMeta)
+			idx.entries[rec.Meta.ID] = keys
+		}
+		keys[rec.Meta.Key] = rec.Meta
+
+	case indexOpDelete:
+		delete(idx.entries[rec.Meta.ID], rec.Meta.Key)
+		if len(idx.entries[rec.Meta.ID]) == 0{
+			delete(idx.entries, rec.Meta.ID)
+		}
+	}
+}
+
+//append applies the record and syncs it to the journal
+func (idx *index) append(rec indexRecord) error{
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if len(idx.path) == 0{
+		idx.apply(rec)
+		return nil
+	}
+
+	if err := idx.openJournal(); err != nil{
+		return err
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil{
+		return err
+	}
+
+	if _, err := idx.journal.Write(append(b, '\n')); err != nil{
+		return err
+	}
+	if err := idx.journal.Sync(); err != nil{
+		return err
+	}
+
+	idx.apply(rec)
+	idx.records++
+
+	if idx.records > idx.count() * 2 + indexCompactSlack{
+		if err := idx.compact(); err != nil{
+			log.Printf("compacting index failed: %s", err)
+		}
+	}
+	return nil
+}
+
+func (idx *index) put(meta ObjectMeta) error{
+	return idx.append(indexRecord{Op: indexOpPut, Meta: meta})
+}
+
+func (idx *index) delete(id string, key string) error{
+	return idx.append(indexRecord{Op: indexOpDelete, Meta: ObjectMeta{ID: id, Key: key}})
+}
+
+func (idx *index) get(id string, key string) (ObjectMeta, bool){
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	meta, ok := idx.entries[id][key]
+	return meta, ok
+}
+
+//list returns the objects of id whose key starts with prefix, sorted by key
+func (idx *index) list(id string, prefix string) []ObjectMeta{
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	metas := []ObjectMeta{}
+	for key, meta := range idx.entries[id]{
+		if strings.HasPrefix(key, prefix){
+			metas = append(metas, meta)
+		}
+	}
+
+	sort.Slice(metas, func(i, j int) bool{
+		return metas[i].Key < metas[j].Key
+	})
+	return metas
+}
+
+//ids returns every ID that has objects in the index
+func (idx *index) ids() []string{
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	ids := make([]string, 0, len(idx.entries))
+	for id := range idx.entries{
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (idx *index) count() int{
+	n := 0
+	for _, keys := range idx.entries{
+		n += len(keys)
+	}
+	return n
+}
+
+//compact rewrites the journal with one record per object. The new
+//journal is synced and renamed over the old one, so a crash leaves
+//either of the two in place. mu must be held.
+func (idx *index) compact() error{
+	buf := new(bytes.Buffer)
+	records := 0
+	for _, keys := range idx.entries{
+		for _, meta := range keys{
+			b, err := json.Marshal(indexRecord{Op: indexOpPut, Meta: meta})
+			if err != nil{
+				return err
+			}
+			buf.Write(append(b, '\n'))
+			records++
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(idx.path), os.ModePerm); err != nil{
+		return err
+	}
+
+	if err := writeFileAtomic(idx.path, buf.Bytes()); err != nil{
+		return err
+	}
+
+	journal, err := os.OpenFile(idx.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil{
+		return err
+	}
+	if idx.journal != nil{
+		idx.journal.Close()
+	}
+	idx.journal = journal
+	idx.records = records
+	return nil
+}
+
+//reset replaces everything in the index with metas
+func (idx *index) reset(metas []ObjectMeta) error{
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.entries = make(map[string]map[string]ObjectMeta)
+	for _, meta := range metas{
+		idx.apply(indexRecord{Op: indexOpPut, Meta: meta})
+	}
+	if len(idx.path) == 0{
+		return nil
+	}
+	return idx.compact()
+}
+
+//clear forgets every object and closes the journal,
+//it is used when the whole store is wiped
+func (idx *index) clear() error{
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.entries = make(map[string]map[string]ObjectMeta)
+	idx.records = 0
+	if idx.journal == nil{
+		return nil
+	}
+
+	err := idx.journal.Close()
+	idx.journal = nil
+	return err
+}
+
+//writeFileAtomic replaces the file at path with b, readers
+//see either the old contents or all of the new ones
+func writeFileAtomic(path string, b []byte) error{
+	f, err := createAtomic(path)
+	if err != nil{
+		return err
+	}
+	defer f.Abort()
+
+	if _, err := f.Write(b); err != nil{
+		return err
+	}
+	return f.Commit()
+}
+
+//syncDir syncs a directory so a rename inside of it survives a crash
+func syncDir(dir string) error{
+	d, err := os.Open(dir)
+	if err != nil{
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
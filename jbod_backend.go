@@ -0,0 +1,539 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//the objects of the failed disks are recorded in this
+//file in the root of every healthy disk
+const jbodLostFileName = "lost.json"
+
+type JBODBackendOpts struct{
+	//Roots are the folders the disks are mounted on, one per disk
+	Roots 				[]string
+	PathTransformFunc 	PathTransformFunc
+	HashedPathTransformFunc PathTransformFunc
+	//KeyHasher and Layout are those of every disk, see FSBackendOpts
+	KeyHasher 			KeyHasher
+	Layout 				string
+}
+
+//JBODBackend spreads the objects over several disks, each one a
+//FSBackend of its own. A new object goes to a disk picked at random
+//weighted by free space, and stays there when it is replaced.
+//
+//A disk that fails an operation, or the check Lost runs, is taken out
+//and the node carries on with the others. What was on it is reported
+//by Lost until it has been stored again on a healthy disk, after a
+//restart as well since the list is kept on the healthy disks.
+type JBODBackend struct{
+	JBODBackendOpts
+
+	mu 		sync.RWMutex
+	disks 	[]*jbodDisk
+	//objects of the failed disks, by ID and key
+	lost 	map[string]ObjectMeta
+
+	//held while the lost objects are written to the disks
+	lostLock 	sync.Mutex
+}
+
+type jbodDisk struct{
+	root 	string
+	backend *FSBackend
+	//why the disk was taken out, nil while it is healthy
+	failed 	error
+}
+
+//DiskStatus is the state of one disk of a JBODBackend
+type DiskStatus struct{
+	Root 	string
+	//Err is why the disk was taken out, nil while it is healthy
+	Err 	error
+	Free 	uint64
+	Total 	uint64
+}
+
+func NewJBODBackend(opts JBODBackendOpts) (*JBODBackend, error){
+	if len(opts.Roots) == 0{
+		return nil, fmt.Errorf("a JBOD backend needs at least one root")
+	}
+
+	b := &JBODBackend{
+		JBODBackendOpts: 	opts,
+		lost: 				make(map[string]ObjectMeta),
+	}
+	for _, root := range opts.Roots{
+		d := &jbodDisk{
+			root: 		root,
+			backend: 	NewFSBackend(FSBackendOpts{
+				Root: 						root,
+				PathTransformFunc: 			opts.PathTransformFunc,
+				HashedPathTransformFunc: 	opts.HashedPathTransformFunc,
+				KeyHasher: 					opts.KeyHasher,
+				Layout: 					opts.Layout,
+			}),
+		}
+		if err := os.MkdirAll(root, os.ModePerm); err != nil{
+			d.failed = err
+			log.Printf("disk [%s] is not usable, carrying on without it: %s", root, err)
+		}
+		b.disks = append(b.disks, d)
+	}
+
+	//what failed before the restart, a disk that came back has it again
+	for _, d := range b.healthy(){
+		if err := b.loadLost(d); err != nil{
+			log.Printf("reading the lost objects recorded on disk [%s] failed: %s", d.root, err)
+		}
+	}
+	return b, nil
+}
+
+//healthy returns the disks that weren't taken out
+func (b *JBODBackend) healthy() []*jbodDisk{
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	disks := []*jbodDisk{}
+	for _, d := range b.disks{
+		if d.failed == nil{
+			disks = append(disks, d)
+		}
+	}
+	return disks
+}
+
+//check takes the disk out if err says it is failing, a missing
+//object doesn't. It returns err.
+func (b *JBODBackend) check(d *jbodDisk, err error) error{
+	if err == nil || errors.Is(err, os.ErrNotExist){
+		return err
+	}
+	b.fail(d, err)
+	return err
+}
+
+//fail takes the disk out and records what was on it as lost
+func (b *JBODBackend) fail(d *jbodDisk, err error){
+	b.mu.Lock()
+	if d.failed != nil{
+		b.mu.Unlock()
+		return
+	}
+	d.failed = err
+	b.mu.Unlock()
+
+	log.Printf("disk [%s] failed, carrying on without it: %s", d.root, err)
+	b.recordLost(d)
+}
+
+func lostKey(id string, key string) string{
+	return id + "\x00" + key
+}
+
+//recordLost adds the objects the index of the failed disk knows to the
+//lost ones. The index is in memory and outlives the disk, not a restart.
+func (b *JBODBackend) recordLost(d *jbodDisk){
+	metas := []ObjectMeta{}
+	ids, _ := d.backend.IDs()
+	for _, id := range ids{
+		list, _ := d.backend.List(id, "")
+		metas = append(metas, list...)
+	}
+
+	b.mu.Lock()
+	for _, meta := range metas{
+		b.lost[lostKey(meta.ID, meta.Key)] = meta
+	}
+	b.mu.Unlock()
+
+	b.saveLost()
+}
+
+//saveLost writes the lost objects to every healthy disk, any one
+//of them is enough to know them after a restart
+func (b *JBODBackend) saveLost(){
+	b.lostLock.Lock()
+	defer b.lostLock.Unlock()
+
+	b.mu.RLock()
+	metas := make([]ObjectMeta, 0, len(b.lost))
+	for _, meta := range b.lost{
+		metas = append(metas, meta)
+	}
+	b.mu.RUnlock()
+	sort.Slice(metas, func(i, j int) bool{
+		return lostKey(metas[i].ID, metas[i].Key) < lostKey(metas[j].ID, metas[j].Key)
+	})
+
+	by, err := json.Marshal(metas)
+	if err != nil{
+		log.Printf("recording the lost objects failed: %s", err)
+		return
+	}
+	for _, d := range b.healthy(){
+		path := fmt.Sprintf("%s/%s", d.root, jbodLostFileName)
+		if err := writeFileAtomic(path, by); err != nil{
+			log.Printf("recording the lost objects on disk [%s] failed: %s", d.root, err)
+		}
+	}
+}
+
+//loadLost adds the lost objects recorded on the disk
+func (b *JBODBackend) loadLost(d *jbodDisk) error{
+	by, err := os.ReadFile(fmt.Sprintf("%s/%s", d.root, jbodLostFileName))
+	if errors.Is(err, os.ErrNotExist){
+		return nil
+	}
+	if err != nil{
+		return err
+	}
+
+	var metas []ObjectMeta
+	if err := json.Unmarshal(by, &metas); err != nil{
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, meta := range metas{
+		k := lostKey(meta.ID, meta.Key)
+		if old, ok := b.lost[k]; !ok || meta.ModifiedAt.After(old.ModifiedAt){
+			b.lost[k] = meta
+		}
+	}
+	return nil
+}
+
+//locate returns the healthy disk with the object on it. Should a disk
+//that came back hold an old copy as well, the newest copy wins.
+func (b *JBODBackend) locate(id string, key string) (*jbodDisk, ObjectMeta, error){
+	var (
+		found 	*jbodDisk
+		meta 	ObjectMeta
+	)
+	for _, d := range b.healthy(){
+		m, err := d.backend.Stat(id, key)
+		if err != nil{
+			continue
+		}
+		if found == nil || m.ModifiedAt.After(meta.ModifiedAt){
+			found, meta = d, m
+		}
+	}
+	if found == nil{
+		return nil, ObjectMeta{}, errNotExist(id, key)
+	}
+	return found, meta, nil
+}
+
+//pick chooses the disk for a new object, at random weighted by how
+//much room every disk has left. Disks whose room isn't known all
+//weigh the same.
+func (b *JBODBackend) pick() (*jbodDisk, error){
+	disks := b.healthy()
+	if len(disks) == 0{
+		return nil, fmt.Errorf("every disk of the JBOD failed")
+	}
+
+	weights := make([]uint64, len(disks))
+	var total uint64
+	for i, d := range disks{
+		free, _, err := diskSpace(d.root)
+		if err != nil{
+			weights = nil
+			break
+		}
+		weights[i] = free
+		total += free
+	}
+	if weights == nil || total == 0{
+		return disks[rand.Intn(len(disks))], nil
+	}
+
+	n := rand.Uint64() % total
+	for i, w := range weights{
+		if n < w{
+			return disks[i], nil
+		}
+		n -= w
+	}
+	return disks[len(disks) - 1], nil
+}
+
+func (b *JBODBackend) Put(id string, key string) (BlobWriter, error){
+	d, _, err := b.locate(id, key)
+	if err != nil{
+		if d, err = b.pick(); err != nil{
+			return nil, err
+		}
+	}
+
+	w, err := d.backend.Put(id, key)
+	if err != nil{
+		return nil, b.check(d, err)
+	}
+	return &jbodBlobWriter{BlobWriter: w, backend: b, disk: d, id: id, key: key}, nil
+}
+
+//jbodBlobWriter takes its disk out when writing to it fails
+type jbodBlobWriter struct{
+	BlobWriter
+	backend *JBODBackend
+	disk 	*jbodDisk
+	id 		string
+	key 	string
+}
+
+func (w *jbodBlobWriter) Write(p []byte) (int, error){
+	n, err := w.BlobWriter.Write(p)
+	return n, w.backend.check(w.disk, err)
+}
+
+func (w *jbodBlobWriter) Commit(meta ObjectMeta) error{
+	if err := w.backend.check(w.disk, w.BlobWriter.Commit(meta)); err != nil{
+		return err
+	}
+
+	//an old copy on a disk that came back goes
+	for _, d := range w.backend.healthy(){
+		if d != w.disk{
+			w.backend.check(d, d.backend.Delete(w.id, w.key))
+		}
+	}
+	return nil
+}
+
+func (b *JBODBackend) Get(id string, key string) (int64, io.ReadCloser, error){
+	return b.ReadRange(id, key, 0, 0)
+}
+
+func (b *JBODBackend) ReadRange(id string, key string, offset int64, length int64) (int64, io.ReadCloser, error){
+	d, _, err := b.locate(id, key)
+	if err != nil{
+		return 0, nil, err
+	}
+	n, r, err := d.backend.ReadRange(id, key, offset, length)
+	return n, r, b.check(d, err)
+}
+
+func (b *JBODBackend) Stat(id string, key string) (ObjectMeta, error){
+	_, meta, err := b.locate(id, key)
+	return meta, err
+}
+
+func (b *JBODBackend) SetMeta(meta ObjectMeta) error{
+	d, _, err := b.locate(meta.ID, meta.Key)
+	if err != nil{
+		return err
+	}
+	return b.check(d, d.backend.SetMeta(meta))
+}
+
+func (b *JBODBackend) Delete(id string, key string) error{
+	for _, d := range b.healthy(){
+		if err := b.check(d, d.backend.Delete(id, key)); err != nil{
+			return err
+		}
+	}
+	return nil
+}
+
+//List merges the objects of the healthy disks
+func (b *JBODBackend) List(id string, prefix string) ([]ObjectMeta, error){
+	newest := make(map[string]ObjectMeta)
+	for _, d := range b.healthy(){
+		metas, err := d.backend.List(id, prefix)
+		if err != nil{
+			return nil, err
+		}
+		for _, meta := range metas{
+			if old, ok := newest[meta.Key]; !ok || meta.ModifiedAt.After(old.ModifiedAt){
+				newest[meta.Key] = meta
+			}
+		}
+	}
+
+	metas := make([]ObjectMeta, 0, len(newest))
+	for _, meta := range newest{
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool{
+		return metas[i].Key < metas[j].Key
+	})
+	return metas, nil
+}
+
+func (b *JBODBackend) IDs() ([]string, error){
+	seen := make(map[string]bool)
+	ids := []string{}
+	for _, d := range b.healthy(){
+		diskIDs, err := d.backend.IDs()
+		if err != nil{
+			return nil, err
+		}
+		for _, id := range diskIDs{
+			if !seen[id]{
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (b *JBODBackend) Clear() error{
+	//the record of the lost objects goes with the disks
+	b.mu.Lock()
+	b.lost = make(map[string]ObjectMeta)
+	b.mu.Unlock()
+
+	for _, d := range b.healthy(){
+		if err := b.check(d, d.backend.Clear()); err != nil{
+			return err
+		}
+		//the root is the mount point, it has to stay
+		if err := b.check(d, os.MkdirAll(d.root, os.ModePerm)); err != nil{
+			return err
+		}
+	}
+	return nil
+}
+
+//Check writes a probe file to every healthy disk and takes
+//out the ones that can't be written to
+func (b *JBODBackend) Check(){
+	for _, d := range b.healthy(){
+		f, err := os.CreateTemp(d.root, ".probe")
+		if err == nil{
+			err = f.Close()
+			os.Remove(f.Name())
+		}
+		//a missing root fails the disk too, it was unmounted
+		if err != nil{
+			b.fail(d, err)
+		}
+	}
+}
+
+//Disks reports the state of every disk
+func (b *JBODBackend) Disks() []DiskStatus{
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	status := []DiskStatus{}
+	for _, d := range b.disks{
+		s := DiskStatus{Root: d.root, Err: d.failed}
+		s.Free, s.Total, _ = diskSpace(d.root)
+		status = append(status, s)
+	}
+	return status
+}
+
+//Lost checks the disks and returns the objects that were on a disk
+//that failed and aren't on a healthy one, as far as the index of the
+//failed disk knew them when it failed. The ones stored again since
+//are dropped from the record.
+func (b *JBODBackend) Lost() ([]ObjectMeta, error){
+	b.Check()
+
+	b.mu.RLock()
+	recorded := make([]ObjectMeta, 0, len(b.lost))
+	for _, meta := range b.lost{
+		recorded = append(recorded, meta)
+	}
+	b.mu.RUnlock()
+
+	lost := []ObjectMeta{}
+	found := []ObjectMeta{}
+	for _, meta := range recorded{
+		if _, _, err := b.locate(meta.ID, meta.Key); err == nil{
+			found = append(found, meta)
+			continue
+		}
+		lost = append(lost, meta)
+	}
+	sort.Slice(lost, func(i, j int) bool{
+		return lostKey(lost[i].ID, lost[i].Key) < lostKey(lost[j].ID, lost[j].Key)
+	})
+
+	if len(found) > 0{
+		b.mu.Lock()
+		for _, meta := range found{
+			delete(b.lost, lostKey(meta.ID, meta.Key))
+		}
+		b.mu.Unlock()
+		b.saveLost()
+	}
+	return lost, nil
+}
+
+//lostReporter is a backend that can lose objects without them
+//being deleted, the way a JBOD loses a disk
+type lostReporter interface{
+	Lost() ([]ObjectMeta, error)
+}
+
+//Lost returns the objects the backend lost and that have to be stored
+//again. An object that lost one of its chunks is lost as a whole, old
+//versions and quarantined objects aren't brought back.
+func (s *Store) Lost() ([]ObjectMeta, error){
+	lr, ok := s.Backend.(lostReporter)
+	if !ok{
+		return nil, nil
+	}
+	metas, err := lr.Lost()
+	if err != nil{
+		return nil, err
+	}
+
+	lost := []ObjectMeta{}
+	//hashes of the lost chunks of every ID
+	chunks := make(map[string]map[string]bool)
+	for _, meta := range metas{
+		switch{
+		case strings.HasPrefix(meta.ID, chunksFolderName + "/"):
+			id := strings.TrimPrefix(meta.ID, chunksFolderName + "/")
+			if chunks[id] == nil{
+				chunks[id] = make(map[string]bool)
+			}
+			chunks[id][meta.Key] = true
+		case !isInternalID(meta.ID):
+			lost = append(lost, meta)
+		}
+	}
+
+	for id, hashes := range chunks{
+		current, err := s.Backend.List(id, "")
+		if err != nil{
+			return nil, err
+		}
+		for _, meta := range current{
+			if !meta.Chunked{
+				continue
+			}
+			m, err := s.readManifest(id, meta.Key)
+			if err != nil{
+				continue
+			}
+			for _, c := range m.Chunks{
+				if hashes[c.Hash]{
+					lost = append(lost, meta)
+					break
+				}
+			}
+		}
+	}
+	return lost, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	//the layout of an FSBackend is recorded in this file of its root
+	layoutFileName = "layout.json"
+
+	layoutPlain = "plain"
+	layoutCustom = "custom"
+	//the layout of SHA256KeyHasher, named before layouts were derived from the hasher
+	layoutSHA256 = "cas-sha256-digests"
+)
+
+//casLayout names the layout NewCASPathTransformFunc makes with h. The
+//name holds the digest h makes of a fixed key, so a root opened with
+//another hasher, or an HMACKeyHasher with another secret, is noticed.
+func casLayout(h KeyHasher) string{
+	if _, ok := h.(SHA256KeyHasher); ok{
+		return layoutSHA256
+	}
+
+	digest := h.HashKey(layoutFileName)
+	if len(digest) > 16{
+		digest = digest[:16]
+	}
+	return "cas-" + digest
+}
+
+//fsLayout is what the root of an FSBackend records about where its objects are
+type fsLayout struct{
+	//Name of the layout new objects are written in
+	Name 		string
+	//Version goes up every time the root is opened with another layout
+	Version 	int
+	//From is the layout objects are still being moved from,
+	//empty once Migrate moved every one of them
+	From 		string 	`json:",omitempty"`
+}
+
+func (b *FSBackend) layoutPath() string{
+	return fmt.Sprintf("%s/%s", b.Root, layoutFileName)
+}
+
+//openLayout reads the layout the root records and, when the backend
+//was opened with another one, records that objects have to move
+func (b *FSBackend) openLayout() error{
+	b.moveLock.Lock()
+	defer b.moveLock.Unlock()
+
+	by, err := os.ReadFile(b.layoutPath())
+	if errors.Is(err, os.ErrNotExist){
+		//a root from before layouts were recorded is in
+		//the one it is opened with, unless Migrate finds otherwise
+		return b.saveLayout(fsLayout{Name: b.Layout, Version: 1})
+	}
+	if err != nil{
+		return err
+	}
+
+	var l fsLayout
+	if err := json.Unmarshal(by, &l); err != nil{
+		return fmt.Errorf("reading %s: %w", b.layoutPath(), err)
+	}
+	if l.Name == b.Layout{
+		b.layout = &l
+		return nil
+	}
+
+	log.Printf("[%s] is laid out as (%s), objects move to (%s) as they are written or migrated", b.Root, l.Name, b.Layout)
+	//still moving from an earlier one, that is where most objects are
+	from := l.Name
+	if len(l.From) > 0{
+		from = l.From
+	}
+	return b.saveLayout(fsLayout{Name: b.Layout, Version: l.Version + 1, From: from})
+}
+
+//saveLayout records the layout in the root. moveLock must be held.
+func (b *FSBackend) saveLayout(l fsLayout) error{
+	if l.Version == 0{
+		l.Version = 1
+	}
+	by, err := json.Marshal(l)
+	if err != nil{
+		return err
+	}
+	if err := os.MkdirAll(b.Root, os.ModePerm); err != nil{
+		return err
+	}
+	if err := writeFileAtomic(b.layoutPath(), by); err != nil{
+		return err
+	}
+	b.layout = &l
+	return nil
+}
+
+//Migrate moves every object that isn't where PathTransformFunc puts it,
+//one at a time while the backend keeps serving, and records in the root
+//that the move is done. It returns how many objects it moved.
+func (b *FSBackend) Migrate() (int, error){
+	moved := 0
+	for _, id := range b.index.ids(){
+		for _, meta := range b.index.list(id, ""){
+			ok, err := b.migrateObject(meta.ID, meta.Key)
+			if err != nil{
+				return moved, fmt.Errorf("moving [%s] of (%s) to layout (%s): %w", meta.Key, meta.ID, b.Layout, err)
+			}
+			if ok{
+				moved++
+			}
+		}
+	}
+
+	b.moveLock.Lock()
+	defer b.moveLock.Unlock()
+
+	l := fsLayout{Name: b.Layout}
+	if b.layout != nil{
+		l.Version = b.layout.Version
+	}
+	if err := b.saveLayout(l); err != nil{
+		return moved, err
+	}
+	log.Printf("[%s] moved (%d) objects to layout (%s)", b.Root, moved, b.Layout)
+	return moved, nil
+}
+
+//migrateObject moves an object of an earlier layout and its metadata
+//to where the layout puts it, and tells whether it had to be moved
+func (b *FSBackend) migrateObject(id string, key string) (bool, error){
+	b.moveLock.Lock()
+	defer b.moveLock.Unlock()
+
+	//looked up again, it may have been written or deleted since
+	meta, ok := b.index.get(id, key)
+	if !ok{
+		return false, nil
+	}
+	rel := b.metaRelPath(meta)
+	if meta.Path == rel{
+		return false, nil
+	}
+
+	from, to := b.objectPath(id, key), fmt.Sprintf("%s/%s", b.Root, rel)
+	if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil{
+		return false, err
+	}
+	if err := os.Rename(from, to); err != nil{
+		return false, err
+	}
+	if err := syncDir(filepath.Dir(to)); err != nil{
+		return false, err
+	}
+	if err := b.saveMeta(meta, rel); err != nil{
+		return false, err
+	}
+
+	//the object is gone from there already, this takes its metadata
+	return true, b.removeFiles(from, id)
+}
+
+//layoutMigrator is a backend that can move its objects to another layout
+type layoutMigrator interface{
+	Migrate() (int, error)
+}
+
+//Migrate moves the objects of every healthy disk to the layout
+func (b *JBODBackend) Migrate() (int, error){
+	moved := 0
+	for _, d := range b.healthy(){
+		n, err := d.backend.Migrate()
+		moved += n
+		if err := b.check(d, err); err != nil{
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+//Migrate moves the objects of every tier that has a layout
+func (b *TieredBackend) Migrate() (int, error){
+	moved := 0
+	for _, t := range b.Tiers{
+		lm, ok := t.Backend.(layoutMigrator)
+		if !ok{
+			continue
+		}
+		n, err := lm.Migrate()
+		moved += n
+		if err != nil{
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+//MigrateLayout moves the objects of the backend to the layout it was
+//opened with, for a backend that lays objects out on disk. Objects of
+//the old layout stay readable while they are moved.
+func (s *Store) MigrateLayout() (int, error){
+	lm, ok := s.Backend.(layoutMigrator)
+	if !ok{
+		return 0, nil
+	}
+	return lm.Migrate()
+}
+
+//MigrateLayout moves the files of this server to the layout its
+//backend was opened with, while the server keeps serving them
+func (s *FileServer) MigrateLayout() (int, error){
+	return s.store.MigrateLayout()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+//errCantLink is returned by a backend that can't link
+//the objects of the backend it wraps
+var errCantLink = errors.New("objects can't be linked")
+
+//linker is a backend that can store an object again under another ID
+//and key without copying its bytes. The two are independent afterwards,
+//writing or deleting one leaves the other alone.
+type linker interface{
+	//Link stores the object of key under id again as to,
+	//whose ID and Key say where
+	Link(id string, key string, to ObjectMeta) error
+}
+
+//Link hard links the file of the object at the path of to, the
+//files are never written to in place so they can share an inode
+func (b *FSBackend) Link(id string, key string, to ObjectMeta) error{
+	b.moveLock.Lock()
+	defer b.moveLock.Unlock()
+
+	if _, ok := b.index.get(id, key); !ok{
+		return errNotExist(id, key)
+	}
+
+	from, dst := b.objectPath(id, key), fmt.Sprintf("%s/%s", b.Root, b.metaRelPath(to))
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil{
+		return err
+	}
+	//left behind by a link that failed half way
+	if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist){
+		return err
+	}
+	if err := os.Link(from, dst); err != nil{
+		return err
+	}
+	if err := syncDir(filepath.Dir(dst)); err != nil{
+		return err
+	}
+	return b.saveMeta(to, b.metaRelPath(to))
+}
+
+//Link shares the bytes of the object, they are never written to after Commit
+func (b *MemoryBackend) Link(id string, key string, to ObjectMeta) error{
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	data, ok := b.blobs[id][key]
+	if !ok{
+		return errNotExist(id, key)
+	}
+
+	keys, ok := b.blobs[to.ID]
+	if !ok{
+		keys = make(map[string][]byte)
+		b.blobs[to.ID] = keys
+	}
+	keys[to.Key] = data
+	return b.index.put(to)
+}
+
+//Link links the encrypted object in the backend it wraps, its IV and
+//ciphertext don't depend on where it is stored, only its metadata is
+//sealed again
+func (b *EncryptedBackend) Link(id string, key string, to ObjectMeta) error{
+	l, ok := b.Backend.(linker)
+	if !ok{
+		return errCantLink
+	}
+
+	sealed, err := b.seal(to)
+	if err != nil{
+		return err
+	}
+	return l.Link(id, b.name(key), sealed)
+}
+
+//copyObject stores the object of meta again as to. A backend that can
+//link the object does that, every other one gets a copy of its bytes.
+//chunkLock must be held.
+func (s *Store) copyObject(meta ObjectMeta, to ObjectMeta) error{
+	if l, ok := s.Backend.(linker); ok{
+		//a filesystem without hard links still gets the copy
+		if err := l.Link(meta.ID, meta.Key, to); err == nil{
+			return nil
+		}
+	}
+
+	_, r, err := s.Backend.Get(meta.ID, meta.Key)
+	if err != nil{
+		return err
+	}
+	defer r.Close()
+
+	w, err := s.Backend.Put(to.ID, to.Key)
+	if err != nil{
+		return err
+	}
+	defer w.Abort()
+
+	if _, err := io.Copy(w, r); err != nil{
+		return err
+	}
+	return w.Commit(to)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/Hemansh24/HyperFS/p2p"
+)
+
+//default and largest number of keys in a single page
+const (
+	defaultListLimit = 100
+	maxListLimit = 1000
+)
+
+//List returns every object of id whose key starts with prefix, sorted
+//by key, leaving out the expired ones. It is answered from the
+//backend's metadata and never reads the objects themselves.
+func (s *Store) List(id string, prefix string) ([]ObjectMeta, error){
+	metas, err := s.Backend.List(id, prefix)
+	if err != nil{
+		return nil, err
+	}
+
+	now := time.Now()
+	live := metas[:0]
+	for _, meta := range metas{
+		if !meta.Expired(now){
+			live = append(live, meta)
+		}
+	}
+	return live, nil
+}
+
+//ListPage returns up to limit objects of id whose key starts with prefix
+//and comes after cursor, together with the cursor of the next page. The
+//next cursor is empty once there is nothing left.
+func (s *Store) ListPage(id string, prefix string, cursor string, limit int) ([]ObjectMeta, string, error){
+	if limit <= 0{
+		limit = defaultListLimit
+	}
+	limit = min(limit, maxListLimit)
+
+	metas, err := s.List(id, prefix)
+	if err != nil{
+		return nil, "", err
+	}
+
+	start := sort.Search(len(metas), func(i int) bool{
+		return metas[i].Key > cursor
+	})
+	metas = metas[start:]
+
+	if len(metas) <= limit{
+		return metas, "", nil
+	}
+	metas = metas[:limit]
+	return metas, metas[len(metas) - 1].Key, nil
+}
+
+//ListIterator walks the objects of an ID a page at a time
+type ListIterator struct{
+	store 		*Store
+	id 			string
+	prefix 		string
+	pageSize 	int
+
+	cursor 		string
+	page 		[]ObjectMeta
+	cur 		ObjectMeta
+	done 		bool
+	err 		error
+}
+
+//Iterate returns an iterator over the objects of id whose key starts
+//with prefix, fetching pageSize objects from the index at a time
+func (s *Store) Iterate(id string, prefix string, pageSize int) *ListIterator{
+	return &ListIterator{
+		store: 		s,
+		id: 		id,
+		prefix: 	prefix,
+		pageSize: 	pageSize,
+	}
+}
+
+//Next moves to the next object and reports whether there was one
+func (it *ListIterator) Next() bool{
+	for len(it.page) == 0{
+		if it.done || it.err != nil{
+			return false
+		}
+
+		page, next, err := it.store.ListPage(it.id, it.prefix, it.cursor, it.pageSize)
+		if err != nil{
+			it.err = err
+			return false
+		}
+
+		it.page = page
+		it.cursor = next
+		it.done = len(next) == 0
+	}
+
+	it.cur = it.page[0]
+	it.page = it.page[1:]
+	return true
+}
+
+//Meta returns the object the iterator is at
+func (it *ListIterator) Meta() ObjectMeta{
+	return it.cur
+}
+
+func (it *ListIterator) Err() error{
+	return it.err
+}
+
+//MessageListKeys asks a peer for a page of the keys it stores under ID
+type MessageListKeys struct{
+	ID 		string
+	Prefix 	string
+	Cursor 	string
+	Limit 	int
+}
+
+//listPage is streamed back in response to a MessageListKeys
+type listPage struct{
+	Objects []ObjectMeta
+	Next 	string
+}
+
+//ClusterObject is a key found while listing the cluster
+//and the addresses of the nodes that store it
+type ClusterObject struct{
+	ObjectMeta
+	Nodes []string
+}
+
+//ListCluster returns a page of the keys stored under id by this node
+//and every peer, merged and sorted by key. Pass the returned cursor
+//back in to get the next page, it is empty once everything was seen.
+//Peers store replicas under the hashed key, so those keys show up
+//hashed as well.
+func (s *FileServer) ListCluster(id string, prefix string, cursor string, limit int) ([]ClusterObject, string, error){
+	if limit <= 0{
+		limit = defaultListLimit
+	}
+	limit = min(limit, maxListLimit)
+
+	objects := make(map[string]*ClusterObject)
+	more := false
+
+	add := func(node string, page listPage){
+		for _, meta := range page.Objects{
+			obj, ok := objects[meta.Key]
+			if !ok{
+				obj = &ClusterObject{ObjectMeta: meta}
+				objects[meta.Key] = obj
+			}
+			obj.Nodes = append(obj.Nodes, node)
+		}
+		if len(page.Next) > 0{
+			more = true
+		}
+	}
+
+	local, next, err := s.store.ListPage(id, prefix, cursor, limit)
+	if err != nil{
+		return nil, "", err
+	}
+	add(s.Transport.Addr(), listPage{Objects: local, Next: next})
+
+	msg := Message{
+		Payload: MessageListKeys{
+			ID: 	id,
+			Prefix: prefix,
+			Cursor: cursor,
+			Limit: 	limit,
+		},
+	}
+
+	for _, peer := range s.peerList(){
+		page, err := s.listPeer(peer, &msg)
+		if err != nil{
+			log.Printf("listing keys on peer %s failed: %s", peer.RemoteAddr(), err)
+			continue
+		}
+		add(peer.RemoteAddr().String(), page)
+	}
+
+	result := make([]ClusterObject, 0, len(objects))
+	for _, obj := range objects{
+		result = append(result, *obj)
+	}
+	sort.Slice(result, func(i, j int) bool{
+		return result[i].Key < result[j].Key
+	})
+
+	//every node returned its first limit keys after the cursor, so the
+	//first limit keys of the merge are the same for the whole cluster
+	if len(result) > limit{
+		result = result[:limit]
+		more = true
+	}
+
+	if !more || len(result) == 0{
+		return result, "", nil
+	}
+	return result, result[len(result) - 1].Key, nil
+}
+
+func (s *FileServer) listPeer(peer p2p.Peer, msg *Message) (listPage, error){
+	var page listPage
+
+	if err := s.sendTo(peer, msg); err != nil{
+		return page, err
+	}
+
+	if err := peer.WaitStream(responseTimeout); err != nil{
+		return page, err
+	}
+
+	var size int64
+	if err := binary.Read(peer, binary.LittleEndian, &size); err != nil{
+		return page, err
+	}
+	if err := checkLength(size); err != nil{
+		peer.CloseStream()
+		return page, err
+	}
+
+	buf := make([]byte, size)
+	_, err := io.ReadFull(peer, buf)
+	peer.CloseStream()
+	if err != nil{
+		return page, err
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(buf)).Decode(&page)
+	return page, err
+}
+
+func (s *FileServer) handleMessageListKeys(from string, msg MessageListKeys) error{
+	peer, ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+
+	//an empty page for an invalid ID
+	var (
+		objects []ObjectMeta
+		next string
+	)
+	err := checkRemoteID(msg.ID)
+	if err == nil{
+		objects, next, err = s.store.ListPage(msg.ID, msg.Prefix, msg.Cursor, msg.Limit)
+	}
+	if err != nil{
+		//still answer, the peer is waiting for a page
+		log.Printf("[%s] listing keys failed: %s", s.Transport.Addr(), err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(listPage{Objects: objects, Next: next}); err != nil{
+		return err
+	}
+
+	return peer.Hold(func(w io.Writer) error{
+		w.Write([]byte{p2p.IncomingStream})
+		binary.Write(w, binary.LittleEndian, int64(buf.Len()))
+		_, err := w.Write(buf.Bytes())
+		return err
+	})
+}
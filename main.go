@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"strings"
 	"time"
 	"github.com/Hemansh24/HyperFS/p2p"
@@ -27,10 +28,11 @@ func makeServer(listenAddr string, nodes ...string)*FileServer{
 
 	fileServerOpts := FileServerOpts{
 		Enckey: 			newEncryptionkey(),		
-		StorageRoot: 		safeStorageRoot,
-		PathTransformFunc: 	CASPathTransformFunc,
+		Backend: 			newNodeBackend(safeStorageRoot),
 		Transport: 			tcpTransport,	
 		BootstrapNodes: 	nodes,
+		Tombstones: 		true,
+		KeyHasher: 			nodeKeyHasher,
 
 	}
 
@@ -42,7 +44,28 @@ func makeServer(listenAddr string, nodes ...string)*FileServer{
 	return s
 }
 
+//nodeKeyHasher makes the digests the files are sent and laid out by,
+//every node of the network uses it
+var nodeKeyHasher KeyHasher = SHA256KeyHasher{}
+
+//newNodeBackend is the backend a node keeps its files in under root,
+//the export and import commands open it the same way
+func newNodeBackend(root string) Backend{
+	return NewFSBackend(FSBackendOpts{
+		Root: 		root,
+		KeyHasher: 	nodeKeyHasher,
+	})
+}
+
 func main() {
+	//hyperfs export -root 3000_network -o backup.tar, or import
+	if len(os.Args) > 1{
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil{
+			log.Fatal(err)
+		}
+		return
+	}
+
     s1 := makeServer(":3000", "")
     s2 := makeServer(":4000", ":3000")
     s3 := makeServer(":5000", ":3000", ":4000")
@@ -78,6 +101,7 @@ func main() {
 		if err != nil{
 			log.Fatal(err)
 		}
+		r.Close()
 	
 		fmt.Println(string(b))
 	}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+//MemoryBackend keeps everything in memory, it is meant for tests
+//and for nodes that only cache what they fetch
+type MemoryBackend struct{
+	mu 		sync.RWMutex
+	blobs 	map[string]map[string][]byte
+	index 	*index
+}
+
+func NewMemoryBackend() *MemoryBackend{
+	return &MemoryBackend{
+		blobs: 	make(map[string]map[string][]byte),
+		index: 	newIndex(""),
+	}
+}
+
+func (b *MemoryBackend) Put(id string, key string) (BlobWriter, error){
+	return &memoryBlobWriter{backend: b, id: id, key: key}, nil
+}
+
+//memoryBlobWriter collects the object and swaps it in on Commit
+type memoryBlobWriter struct{
+	bytes.Buffer
+	backend *MemoryBackend
+	id 		string
+	key 	string
+}
+
+func (w *memoryBlobWriter) Commit(meta ObjectMeta) error{
+	b := w.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	keys, ok := b.blobs[w.id]
+	if !ok{
+		keys = make(map[string][]byte)
+		b.blobs[w.id] = keys
+	}
+	keys[w.key] = w.Bytes()
+
+	meta.ID, meta.Key = w.id, w.key
+	return b.index.put(meta)
+}
+
+func (w *memoryBlobWriter) Abort(){
+	w.Reset()
+}
+
+func (b *MemoryBackend) Get(id string, key string) (int64, io.ReadCloser, error){
+	return b.ReadRange(id, key, 0, 0)
+}
+
+func (b *MemoryBackend) ReadRange(id string, key string, offset int64, length int64) (int64, io.ReadCloser, error){
+	b.mu.RLock()
+	data, ok := b.blobs[id][key]
+	b.mu.RUnlock()
+	if !ok{
+		return 0, nil, errNotExist(id, key)
+	}
+
+	n, err := rangeSize(key, int64(len(data)), offset, length)
+	if err != nil{
+		return 0, nil, err
+	}
+
+	//blobs are never written to after Commit, so the slice can be shared
+	return n, io.NopCloser(bytes.NewReader(data[offset : offset + n])), nil
+}
+
+func (b *MemoryBackend) Stat(id string, key string) (ObjectMeta, error){
+	meta, ok := b.index.get(id, key)
+	if !ok{
+		return ObjectMeta{}, errNotExist(id, key)
+	}
+	return meta, nil
+}
+
+func (b *MemoryBackend) SetMeta(meta ObjectMeta) error{
+	if _, ok := b.index.get(meta.ID, meta.Key); !ok{
+		return errNotExist(meta.ID, meta.Key)
+	}
+	return b.index.put(meta)
+}
+
+func (b *MemoryBackend) Delete(id string, key string) error{
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.blobs[id], key)
+	if len(b.blobs[id]) == 0{
+		delete(b.blobs, id)
+	}
+	return b.index.delete(id, key)
+}
+
+func (b *MemoryBackend) List(id string, prefix string) ([]ObjectMeta, error){
+	return b.index.list(id, prefix), nil
+}
+
+func (b *MemoryBackend) IDs() ([]string, error){
+	return b.index.ids(), nil
+}
+
+func (b *MemoryBackend) Clear() error{
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.blobs = make(map[string]map[string][]byte)
+	return b.index.clear()
+}
@@ -1,9 +1,16 @@
 package p2p
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
+//MaxMessageSize is the largest message DefaultDecoder reads, the length
+//prefix comes off the wire so a bigger one is never allocated for.
+//Streams that follow a message aren't limited by it.
+const MaxMessageSize = 64 << 20
+
 // a contract, if you want to be a decoder,
 //you must hava a function Decode that takes
 //in an io.Reader and a pointer to Message
@@ -39,12 +46,31 @@ func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error{
 		return nil
 	}
 
-	buf := make([]byte, 1028)
-	n, err := r.Read(buf)
-	if err != nil{
+	//messages are prefixed with their length, so we read exactly one
+	//message and never eat into a stream that is sent right after it
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil{
 		return err
 	}
+	if size > MaxMessageSize{
+		return fmt.Errorf("message of (%d) bytes is larger than the maximum of (%d)", size, MaxMessageSize)
+	}
 
-	msg.Payload = buf[:n]
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil{
+		return err
+	}
+
+	msg.Payload = buf
 	return nil
+}
+
+//EncodeMessage frames a payload the way DefaultDecoder expects it,
+//the IncomingMessage byte followed by the length of the payload
+func EncodeMessage(payload []byte) []byte{
+	buf := make([]byte, 5 + len(payload))
+	buf[0] = IncomingMessage
+	binary.LittleEndian.PutUint32(buf[1:5], uint32(len(payload)))
+	copy(buf[5:], payload)
+	return buf
 }
\ No newline at end of file
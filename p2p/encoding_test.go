@@ -0,0 +1,25 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDefaultDecoder(t *testing.T) {
+	var rpc RPC
+	if err := (DefaultDecoder{}).Decode(bytes.NewReader(EncodeMessage([]byte("foo"))), &rpc); err != nil {
+		t.Fatal(err)
+	}
+	if string(rpc.Payload) != "foo" {
+		t.Errorf("have payload %q, want %q", rpc.Payload, "foo")
+	}
+
+	//a length prefix over the maximum is turned down before anything
+	//is allocated for it, even though no payload follows
+	buf := []byte{IncomingMessage, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(buf[1:], MaxMessageSize+1)
+	if err := (DefaultDecoder{}).Decode(bytes.NewReader(buf), &rpc); err == nil {
+		t.Error("decoded a message larger than MaxMessageSize")
+	}
+}
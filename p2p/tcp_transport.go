@@ -2,9 +2,11 @@ package p2p
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 //TCPPeer represents a remote node/peer in a TCP connection
@@ -18,6 +20,12 @@ type TCPPeer struct {
 	//and outbound is false
 	outbound bool
 	wg *sync.WaitGroup
+	//streaming holds a token while a stream is open
+	streaming chan struct{}
+
+	//sendLock keeps what two goroutines send from
+	//being mixed up on the connection
+	sendLock sync.Mutex
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer{
@@ -25,13 +33,31 @@ func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer{
 		Conn : conn,
 		outbound : outbound,
 		wg: 	&sync.WaitGroup{},
+		streaming: make(chan struct{}, 1),
 	}
 }
 
 func (p *TCPPeer) CloseStream() {
+	//the token is still there if nobody waited for the stream
+	select{
+	case <- p.streaming:
+	default:
+	}
 	p.wg.Done()
 }
 
+//WaitStream waits until the read loop got to a stream the peer sent, only
+//then is what follows on the connection the stream and not a message the
+//peer sent before it
+func (p *TCPPeer) WaitStream(timeout time.Duration) error{
+	select{
+	case <- p.streaming:
+		return nil
+	case <- time.After(timeout):
+		return fmt.Errorf("peer %s sent no stream in %s", p.RemoteAddr(), timeout)
+	}
+}
+
 type TCPTransportOpts struct{
 	//This stores the address of the peer as a string 
 	ListenAddr 		string
@@ -54,11 +80,25 @@ type TCPTransport struct{
 	rpcch chan RPC
 }
 
+//Send writes b to the peer in one piece
 func (p *TCPPeer) Send(b []byte) error{
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+
 	_, err := p.Conn.Write(b)
 	return err
 }
 
+//Hold gives fn the connection to itself, so what it writes in many
+//writes, a stream or a message with the stream that follows it, reaches
+//the peer in one piece. fn writes to w, Send would wait for it.
+func (p *TCPPeer) Hold(fn func(w io.Writer) error) error{
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+
+	return fn(p.Conn)
+}
+
 //This is a constructor function that returns a new instance of TCPTransport
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport{
 	//creates a new instance of TCPTransport and returns a pointer to it
@@ -172,6 +212,7 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 
 		if rpc.Stream {
 			peer.wg.Add(1)
+			peer.streaming <- struct{}{}
 			fmt.Printf("[%s] incoming stream, waiting...\n", conn.RemoteAddr())
 			peer.wg.Wait()
 			fmt.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
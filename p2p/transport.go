@@ -1,11 +1,20 @@
 package p2p
-import "net"
+import (
+	"io"
+	"net"
+	"time"
+)
 
 //Peer is an interface that represents a remote node/peer
 //anyone that we connect to or that connects to us is a peer
 type Peer interface{
 	net.Conn
 	Send(([]byte)) 	error
+	//Hold runs fn with the connection to itself, everything
+	//written to the peer must go through Send or Hold
+	Hold(func(io.Writer) error) error
+	//WaitStream waits for the stream the peer was asked for to start
+	WaitStream(time.Duration) error
 	CloseStream()
 }
 
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultPackDirName = "ggnetwork_pack"
+	defaultSegmentSize int64 = 64 << 20
+	defaultCompactRatio = 0.5
+	packSegmentExt = ".pack"
+)
+
+//kinds of records in a packfile
+const (
+	//an object, its metadata followed by its bytes
+	packOpPut byte = 'p'
+	//new metadata for an object that is already in the pack
+	packOpMeta byte = 'm'
+	//the object is gone, only its ID and key are recorded
+	packOpDelete byte = 'd'
+)
+
+//packRecordHeader is in front of every record, followed by
+//MetaLen bytes of JSON metadata and DataLen bytes of object
+type packRecordHeader struct{
+	Op 		byte
+	MetaLen uint32
+	DataLen int64
+}
+
+var packRecordHeaderSize = int64(binary.Size(packRecordHeader{}))
+
+type PackBackendOpts struct{
+	//Dir holds the segment files of the pack
+	Dir string
+	//SegmentSize is how large a segment grows before
+	//appends move on to a new one
+	SegmentSize int64
+	//CompactRatio is the share of dead bytes at which a full
+	//segment gets compacted, 0 means half of it
+	CompactRatio float64
+}
+
+//PackBackend appends objects to large segment files and keeps the
+//offset of each one in memory, so lots of small objects cost a few
+//files instead of one file (and a trail of folders) each.
+//
+//Only the last segment is appended to. Deleted and replaced objects
+//stay behind as dead bytes until their segment is compacted: the live
+//records are copied to the end of the pack and the segment is removed.
+//Reads go on while that happens, a reader keeps the old segment open
+//until it is closed.
+type PackBackend struct{
+	PackBackendOpts
+
+	mu 			sync.RWMutex
+	segments 	map[int]*packSegment
+	//the segment appends go to
+	active 		*packSegment
+	locs 		map[string]map[string]packLoc
+	index 		*index
+
+	//only one compaction runs at a time
+	compactLock sync.Mutex
+	compacting 	atomic.Bool
+	background 	sync.WaitGroup
+}
+
+//packSegment is one file of the pack
+type packSegment struct{
+	id 		int
+	path 	string
+	file 	*os.File
+	//end of the last complete record, where the next one goes
+	end 	int64
+	//bytes of the put records that are still the current version
+	//of their object and of the deletes that still hide an older
+	//one, the rest of the segment is dead
+	live 	int64
+	//ID and key of every object the segment has a put record of
+	puts 	map[string]bool
+	//readers that still hold the segment open
+	readers sync.WaitGroup
+}
+
+//packLoc is where the bytes of an object are in the pack
+type packLoc struct{
+	seg 	*packSegment
+	offset 	int64
+	size 	int64
+	//length of the whole record, header and metadata included
+	record 	int64
+}
+
+//packRecord is a record read back from a segment
+type packRecord struct{
+	op 		byte
+	meta 	ObjectMeta
+	loc 	packLoc
+}
+
+func NewPackBackend(opts PackBackendOpts) (*PackBackend, error){
+	if len(opts.Dir) == 0{
+		opts.Dir = defaultPackDirName
+	}
+	if opts.SegmentSize <= 0{
+		opts.SegmentSize = defaultSegmentSize
+	}
+	if opts.CompactRatio <= 0{
+		opts.CompactRatio = defaultCompactRatio
+	}
+
+	if err := os.MkdirAll(opts.Dir, os.ModePerm); err != nil{
+		return nil, err
+	}
+
+	b := &PackBackend{
+		PackBackendOpts: 	opts,
+		segments: 			make(map[int]*packSegment),
+		locs: 				make(map[string]map[string]packLoc),
+		index: 				newIndex(""),
+	}
+	if err := b.load(); err != nil{
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *PackBackend) segmentPath(id int) string{
+	return filepath.Join(b.Dir, fmt.Sprintf("%08d%s", id, packSegmentExt))
+}
+
+//load replays every segment in order, a record torn
+//by a crash is cut off so appends start clean
+func (b *PackBackend) load() error{
+	entries, err := os.ReadDir(b.Dir)
+	if err != nil{
+		return err
+	}
+
+	var ids []int
+	for _, e := range entries{
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, packSegmentExt){
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, packSegmentExt))
+		if err != nil{
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids{
+		seg, err := b.openSegment(id)
+		if err != nil{
+			return err
+		}
+
+		info, err := seg.file.Stat()
+		if err != nil{
+			return err
+		}
+
+		records, end := seg.scan(info.Size())
+		if end < info.Size(){
+			log.Printf("packfile %s is torn at offset %d, dropping the rest", seg.path, end)
+			if err := seg.file.Truncate(end); err != nil{
+				return err
+			}
+		}
+		seg.end = end
+
+		for _, rec := range records{
+			b.apply(rec.op, rec.meta, rec.loc)
+		}
+	}
+
+	if b.active == nil{
+		if _, err := b.openSegment(1); err != nil{
+			return err
+		}
+	}
+
+	for _, seg := range b.segments{
+		if b.compactable(seg){
+			b.compactLater()
+			break
+		}
+	}
+	return nil
+}
+
+//openSegment opens (or creates) the segment and makes it the active one
+func (b *PackBackend) openSegment(id int) (*packSegment, error){
+	path := b.segmentPath(id)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil{
+		return nil, err
+	}
+
+	seg := &packSegment{id: id, path: path, file: f, puts: make(map[string]bool)}
+	b.segments[id] = seg
+	b.active = seg
+	return seg, nil
+}
+
+//scan reads the records of the segment up to size, it stops at the first
+//torn one and returns the records together with the end of the last one
+func (seg *packSegment) scan(size int64) ([]packRecord, int64){
+	var records []packRecord
+
+	headerBytes := make([]byte, packRecordHeaderSize)
+	var offset int64
+	for offset + packRecordHeaderSize <= size{
+		if _, err := seg.file.ReadAt(headerBytes, offset); err != nil{
+			break
+		}
+
+		var h packRecordHeader
+		binary.Read(bytes.NewReader(headerBytes), binary.LittleEndian, &h)
+
+		dataOffset := offset + packRecordHeaderSize + int64(h.MetaLen)
+		if h.DataLen < 0 || dataOffset + h.DataLen > size{
+			break
+		}
+
+		metaBytes := make([]byte, h.MetaLen)
+		if _, err := seg.file.ReadAt(metaBytes, offset + packRecordHeaderSize); err != nil{
+			break
+		}
+
+		var meta ObjectMeta
+		if err := json.Unmarshal(metaBytes, &meta); err != nil{
+			break
+		}
+
+		records = append(records, packRecord{
+			op: 	h.Op,
+			meta: 	meta,
+			loc: 	packLoc{
+				seg: 	seg,
+				offset: dataOffset,
+				size: 	h.DataLen,
+				record: dataOffset + h.DataLen - offset,
+			},
+		})
+		offset = dataOffset + h.DataLen
+	}
+
+	return records, offset
+}
+
+//apply brings the offsets and the index up to date with a
+//record and counts the bytes it makes dead. mu must be held.
+func (b *PackBackend) apply(op byte, meta ObjectMeta, loc packLoc){
+	switch op{
+	case packOpPut:
+		keys, ok := b.locs[meta.ID]
+		if !ok{
+			keys = make(map[string]packLoc)
+			b.locs[meta.ID] = keys
+		}
+		if old, ok := keys[meta.Key]; ok{
+			old.seg.live -= old.record
+		}
+		keys[meta.Key] = loc
+		loc.seg.live += loc.record
+		loc.seg.puts[meta.ID + "/" + meta.Key] = true
+		b.index.put(meta)
+
+	case packOpMeta:
+		b.index.put(meta)
+
+	case packOpDelete:
+		if old, ok := b.locs[meta.ID][meta.Key]; ok{
+			old.seg.live -= old.record
+		}
+		//a delete has to stay around for as long as a put
+		//it hides is in the pack
+		if loc.seg != nil && b.hiddenPut(loc.seg, meta.ID, meta.Key){
+			loc.seg.live += loc.record
+		}
+		delete(b.locs[meta.ID], meta.Key)
+		if len(b.locs[meta.ID]) == 0{
+			delete(b.locs, meta.ID)
+		}
+		b.index.delete(meta.ID, meta.Key)
+	}
+}
+
+//appendRecord writes a record at the end of the active segment and syncs
+//it, a full segment is closed off first. mu must be held.
+func (b *PackBackend) appendRecord(op byte, meta ObjectMeta, data []byte) (packLoc, error){
+	metaBytes, err := json.Marshal(meta)
+	if err != nil{
+		return packLoc{}, err
+	}
+
+	if b.active.end >= b.SegmentSize{
+		full := b.active
+		if _, err := b.openSegment(full.id + 1); err != nil{
+			return packLoc{}, err
+		}
+		if b.compactable(full){
+			b.compactLater()
+		}
+	}
+	seg := b.active
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, packRecordHeader{
+		Op: 		op,
+		MetaLen: 	uint32(len(metaBytes)),
+		DataLen: 	int64(len(data)),
+	})
+	buf.Write(metaBytes)
+	dataOffset := seg.end + int64(buf.Len())
+	buf.Write(data)
+
+	if _, err := seg.file.WriteAt(buf.Bytes(), seg.end); err != nil{
+		//whatever made it to disk is torn and gets cut off on the next load
+		return packLoc{}, err
+	}
+	if err := seg.file.Sync(); err != nil{
+		return packLoc{}, err
+	}
+
+	seg.end += int64(buf.Len())
+	return packLoc{
+		seg: 	seg,
+		offset: dataOffset,
+		size: 	int64(len(data)),
+		record: int64(buf.Len()),
+	}, nil
+}
+
+func (b *PackBackend) Put(id string, key string) (BlobWriter, error){
+	return &packBlobWriter{backend: b, id: id, key: key}, nil
+}
+
+//packBlobWriter collects the object and appends it on Commit,
+//the pack is meant for objects small enough to hold in memory
+type packBlobWriter struct{
+	bytes.Buffer
+	backend *PackBackend
+	id 		string
+	key 	string
+}
+
+func (w *packBlobWriter) Commit(meta ObjectMeta) error{
+	b := w.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	meta.ID, meta.Key = w.id, w.key
+	loc, err := b.appendRecord(packOpPut, meta, w.Bytes())
+	if err != nil{
+		return err
+	}
+
+	old, replaced := b.locs[w.id][w.key]
+	b.apply(packOpPut, meta, loc)
+	if replaced && b.compactable(old.seg){
+		b.compactLater()
+	}
+	return nil
+}
+
+func (w *packBlobWriter) Abort(){
+	w.Reset()
+}
+
+func (b *PackBackend) Get(id string, key string) (int64, io.ReadCloser, error){
+	return b.ReadRange(id, key, 0, 0)
+}
+
+func (b *PackBackend) ReadRange(id string, key string, offset int64, length int64) (int64, io.ReadCloser, error){
+	b.mu.RLock()
+	loc, ok := b.locs[id][key]
+	if ok{
+		//holds the segment open if a compaction moves the object meanwhile
+		loc.seg.readers.Add(1)
+	}
+	b.mu.RUnlock()
+	if !ok{
+		return 0, nil, errNotExist(id, key)
+	}
+
+	n, err := rangeSize(key, loc.size, offset, length)
+	if err != nil{
+		loc.seg.readers.Done()
+		return 0, nil, err
+	}
+
+	//records are never written to once they are in the pack
+	return n, &segmentReader{
+		SectionReader: 	io.NewSectionReader(loc.seg.file, loc.offset + offset, n),
+		seg: 			loc.seg,
+	}, nil
+}
+
+//segmentReader lets go of its segment when it is closed
+type segmentReader struct{
+	*io.SectionReader
+	seg 	*packSegment
+	once 	sync.Once
+}
+
+func (r *segmentReader) Close() error{
+	r.once.Do(r.seg.readers.Done)
+	return nil
+}
+
+func (b *PackBackend) Stat(id string, key string) (ObjectMeta, error){
+	meta, ok := b.index.get(id, key)
+	if !ok{
+		return ObjectMeta{}, errNotExist(id, key)
+	}
+	return meta, nil
+}
+
+func (b *PackBackend) SetMeta(meta ObjectMeta) error{
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.locs[meta.ID][meta.Key]; !ok{
+		return errNotExist(meta.ID, meta.Key)
+	}
+
+	if _, err := b.appendRecord(packOpMeta, meta, nil); err != nil{
+		return err
+	}
+	b.apply(packOpMeta, meta, packLoc{})
+	return nil
+}
+
+func (b *PackBackend) Delete(id string, key string) error{
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	old, ok := b.locs[id][key]
+	if !ok{
+		return nil
+	}
+
+	meta := ObjectMeta{ID: id, Key: key}
+	loc, err := b.appendRecord(packOpDelete, meta, nil)
+	if err != nil{
+		return err
+	}
+	b.apply(packOpDelete, meta, loc)
+
+	if b.compactable(old.seg){
+		b.compactLater()
+	}
+	return nil
+}
+
+func (b *PackBackend) List(id string, prefix string) ([]ObjectMeta, error){
+	return b.index.list(id, prefix), nil
+}
+
+func (b *PackBackend) IDs() ([]string, error){
+	return b.index.ids(), nil
+}
+
+//compactable reports whether enough of a full segment is dead
+//to be worth copying the rest of it. mu must be held.
+func (b *PackBackend) compactable(seg *packSegment) bool{
+	if seg == b.active || seg.end == 0{
+		return false
+	}
+	return float64(seg.end - seg.live) >= b.CompactRatio * float64(seg.end)
+}
+
+//compactLater starts a compaction in the background
+//unless one is already on its way
+func (b *PackBackend) compactLater(){
+	if !b.compacting.CompareAndSwap(false, true){
+		return
+	}
+
+	b.background.Add(1)
+	go func(){
+		defer b.background.Done()
+		defer b.compacting.Store(false)
+
+		if err := b.Compact(); err != nil{
+			log.Printf("compacting packfile %s failed: %s", b.Dir, err)
+		}
+	}()
+}
+
+//Compact reclaims the space of deleted and replaced objects. Every full
+//segment that is at least CompactRatio dead has its live records copied
+//to the end of the pack and is removed. Reads and writes go on meanwhile.
+func (b *PackBackend) Compact() error{
+	b.compactLock.Lock()
+	defer b.compactLock.Unlock()
+
+	b.mu.RLock()
+	var segs []*packSegment
+	for _, seg := range b.segments{
+		if b.compactable(seg){
+			segs = append(segs, seg)
+		}
+	}
+	b.mu.RUnlock()
+
+	sort.Slice(segs, func(i, j int) bool{
+		return segs[i].id < segs[j].id
+	})
+
+	for _, seg := range segs{
+		if err := b.compactSegment(seg); err != nil{
+			return fmt.Errorf("compacting %s: %w", seg.path, err)
+		}
+	}
+	return nil
+}
+
+//compactSegment moves what is still needed out of a full segment and
+//removes it. The lock is only taken one record at a time, so readers
+//and writers get in between. compactLock must be held.
+func (b *PackBackend) compactSegment(seg *packSegment) error{
+	//nothing is appended to a full segment, it can be read without the lock
+	records, _ := seg.scan(seg.end)
+
+	copied := make(map[string]bool)
+	for _, rec := range records{
+		id, key := rec.meta.ID, rec.meta.Key
+
+		var data []byte
+		if rec.op == packOpPut{
+			b.mu.RLock()
+			cur, ok := b.locs[id][key]
+			b.mu.RUnlock()
+			if !ok || cur != rec.loc{
+				continue
+			}
+
+			data = make([]byte, rec.loc.size)
+			if _, err := seg.file.ReadAt(data, rec.loc.offset); err != nil{
+				return err
+			}
+		}
+
+		if err := b.moveRecord(seg, rec, data, copied); err != nil{
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.retire(seg)
+}
+
+//moveRecord appends a record of a segment being compacted again if it is
+//still needed once the segment is gone:
+//  - a put that is still the current version of its object
+//  - metadata of an object whose bytes are in an older segment
+//  - a delete of an object that an older segment still holds
+func (b *PackBackend) moveRecord(seg *packSegment, rec packRecord, data []byte, copied map[string]bool) error{
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id, key := rec.meta.ID, rec.meta.Key
+	cur, live := b.locs[id][key]
+	seen := copied[id + "/" + key]
+
+	switch rec.op{
+	case packOpPut:
+		//replaced or deleted while its bytes were being read
+		if !live || cur != rec.loc{
+			return nil
+		}
+
+		meta, _ := b.index.get(id, key)
+		loc, err := b.appendRecord(packOpPut, meta, data)
+		if err != nil{
+			return err
+		}
+		b.apply(packOpPut, meta, loc)
+
+	case packOpMeta:
+		if !live || seen || cur.seg.id >= seg.id{
+			return nil
+		}
+
+		meta, _ := b.index.get(id, key)
+		if _, err := b.appendRecord(packOpMeta, meta, nil); err != nil{
+			return err
+		}
+
+	case packOpDelete:
+		if live || seen || !b.hiddenPut(seg, id, key){
+			return nil
+		}
+
+		loc, err := b.appendRecord(packOpDelete, rec.meta, nil)
+		if err != nil{
+			return err
+		}
+		b.apply(packOpDelete, rec.meta, loc)
+	}
+
+	copied[id + "/" + key] = true
+	return nil
+}
+
+//hiddenPut reports whether a segment from before seg has a put record
+//of the object, which a replay would bring back without a delete
+//after it. mu must be held.
+func (b *PackBackend) hiddenPut(seg *packSegment, id string, key string) bool{
+	for _, older := range b.segments{
+		if older.id < seg.id && older.puts[id + "/" + key]{
+			return true
+		}
+	}
+	return false
+}
+
+//retire removes a segment nothing points to anymore. The file is closed
+//once the last reader that still has it open is done. mu must be held.
+func (b *PackBackend) retire(seg *packSegment) error{
+	delete(b.segments, seg.id)
+	err := os.Remove(seg.path)
+
+	go func(){
+		seg.readers.Wait()
+		seg.file.Close()
+	}()
+	return err
+}
+
+func (b *PackBackend) Clear() error{
+	b.compactLock.Lock()
+	defer b.compactLock.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	next := b.active.id + 1
+	for _, seg := range b.segments{
+		if err := b.retire(seg); err != nil{
+			return err
+		}
+	}
+
+	b.locs = make(map[string]map[string]packLoc)
+	if _, err := b.openSegment(next); err != nil{
+		return err
+	}
+	return b.index.clear()
+}
+
+//Close waits for a running compaction and closes the
+//segment files, the backend can't be used afterwards
+func (b *PackBackend) Close() error{
+	b.background.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.segments == nil{
+		return errors.New("packfile is already closed")
+	}
+
+	var errs []error
+	for _, seg := range b.segments{
+		if err := seg.file.Close(); err != nil{
+			errs = append(errs, fmt.Errorf("closing packfile %s: %w", seg.path, err))
+		}
+	}
+	b.segments = nil
+	return errors.Join(errs...)
+}
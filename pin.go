@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+//metadata of an object that must stay on the node
+const pinnedKey = "pinned"
+
+//ErrPinned is returned for a delete of a pinned object
+var ErrPinned = errors.New("object is pinned")
+
+//Pinned reports whether the object is pinned. Nothing deletes a pinned
+//object, not expiry, eviction or pruning, until it is unpinned.
+func (m ObjectMeta) Pinned() bool{
+	return m.Metadata[pinnedKey] == "true"
+}
+
+//withPin returns metadata with the pin set or cleared, leaving md as it is
+func withPin(md map[string]string, pinned bool) map[string]string{
+	out := make(map[string]string, len(md) + 1)
+	for k, v := range md{
+		out[k] = v
+	}
+	if pinned{
+		out[pinnedKey] = "true"
+	} else{
+		delete(out, pinnedKey)
+	}
+	if len(out) == 0{
+		return nil
+	}
+	return out
+}
+
+//Pin keeps the object on the node until it is unpinned
+func (s *Store) Pin(id string, key string) error{
+	return s.setPinned(id, key, true)
+}
+
+//Unpin lets the object be deleted again
+func (s *Store) Unpin(id string, key string) error{
+	return s.setPinned(id, key, false)
+}
+
+func (s *Store) setPinned(id string, key string, pinned bool) error{
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
+
+	meta, err := s.Backend.Stat(id, key)
+	if err != nil{
+		return err
+	}
+	if meta.Pinned() == pinned{
+		return nil
+	}
+
+	meta.Metadata = withPin(meta.Metadata, pinned)
+	return s.Backend.SetMeta(meta)
+}
+
+//Pin keeps the file on this node, fetching it first if it is only on
+//the peers. Recursive pins every block below a DAG or directory root.
+func (s *FileServer) Pin(key string, recursive bool) error{
+	if recursive{
+		return s.walkDAG(key, true, s.pin)
+	}
+	return s.pin(key)
+}
+
+//Unpin lets the file be evicted or deleted again, recursive
+//unpins the blocks below a DAG or directory root
+func (s *FileServer) Unpin(key string, recursive bool) error{
+	if recursive{
+		return s.walkDAG(key, false, s.unpin)
+	}
+	return s.unpin(key)
+}
+
+func (s *FileServer) pin(key string) error{
+	if !s.store.Has(s.ID, key){
+		r, err := s.GetWithOpts(key, GetOpts{Cache: true})
+		if err != nil{
+			return err
+		}
+		if err := r.Close(); err != nil{
+			return err
+		}
+	}
+
+	if err := s.store.Pin(s.ID, key); err != nil{
+		return err
+	}
+	fmt.Printf("[%s] pinned (%s)\n", s.Transport.Addr(), key)
+	return nil
+}
+
+func (s *FileServer) unpin(key string) error{
+	err := s.store.Unpin(s.ID, key)
+	if errors.Is(err, os.ErrNotExist){
+		//nothing left to unpin
+		return nil
+	}
+	return err
+}
+
+//walkDAG calls fn for the block and every block below it. Blocks
+//that aren't on the node are fetched if fetch is set and skipped
+//otherwise, along with everything below them.
+func (s *FileServer) walkDAG(cid string, fetch bool, fn func(string) error) error{
+	if !fetch && !s.store.Has(s.ID, cid){
+		return nil
+	}
+
+	//a block from a peer is verified and kept on the node
+	node, err := s.getBlock(cid)
+	if err != nil{
+		return err
+	}
+	if err := fn(cid); err != nil{
+		return err
+	}
+
+	for _, link := range node.Links{
+		if err := s.walkDAG(link.CID, fetch, fn); err != nil{
+			return err
+		}
+	}
+	return nil
+}
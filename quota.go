@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ErrQuotaExceeded is returned for a write that would take an ID
+//or the node over its quota, nothing is written when it is
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+//Quota limits what is stored, a limit that is 0 is off
+type Quota struct{
+	MaxBytes 	int64
+	MaxObjects 	int
+}
+
+func (q Quota) limited() bool{
+	return q.MaxBytes > 0 || q.MaxObjects > 0
+}
+
+//Usage is what an ID or the node stores. Old versions count, objects
+//that expired but weren't swept yet as well, and Bytes are the sizes
+//of the objects as they were written.
+type Usage struct{
+	Bytes 	int64
+	Objects int
+}
+
+//UsageReport is the usage of every ID and of the whole node
+type UsageReport struct{
+	Node 	Usage
+	IDs 	map[string]Usage
+}
+
+//usageCounter keeps the usage of every ID up to date as objects are
+//committed and deleted, so a write doesn't add up the whole store
+type usageCounter struct{
+	mu 		sync.Mutex
+	//loaded is false until the counters were added up from the
+	//backend, the usage is added up on every call until then
+	loaded 	bool
+	ids 	map[string]Usage
+	node 	Usage
+}
+
+//usageOwner returns the ID the objects stored under ns count towards,
+//old versions count towards the ID of their object and the rest of the
+//store's own objects towards nobody
+func usageOwner(ns string) (string, bool){
+	if !isInternalID(ns){
+		return ns, true
+	}
+	if id, ok := strings.CutPrefix(ns, versionsFolderName + "/"); ok && !isInternalID(id){
+		return id, true
+	}
+	return "", false
+}
+
+//loadUsage adds up what every ID stores to start the counters from,
+//it is done when the store is opened and cleared
+func (s *Store) loadUsage() error{
+	report, err := s.scanUsage()
+
+	u := &s.usage
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err != nil{
+		u.loaded = false
+		return err
+	}
+	u.ids, u.node, u.loaded = report.IDs, report.Node, true
+	return nil
+}
+
+//countUsage adds an object of size bytes stored under ns to the counters,
+//or takes it off them when objects is negative
+func (s *Store) countUsage(ns string, size int64, objects int){
+	id, ok := usageOwner(ns)
+	if !ok{
+		return
+	}
+
+	u := &s.usage
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.loaded{
+		return
+	}
+	usage := u.ids[id]
+	usage.Bytes += size
+	usage.Objects += objects
+	if usage.Objects <= 0{
+		delete(u.ids, id)
+	} else{
+		u.ids[id] = usage
+	}
+	u.node.Bytes += size
+	u.node.Objects += objects
+}
+
+//quotaOf returns the quota of an ID
+func (s *Store) quotaOf(id string) Quota{
+	if q, ok := s.Quotas[id]; ok{
+		return q
+	}
+	return s.Quota
+}
+
+//usageOf returns what an ID stores, its objects and their old
+//versions, along with what the whole node stores
+func (s *Store) usageOf(id string) (Usage, Usage, error){
+	u := &s.usage
+	u.mu.Lock()
+	if u.loaded{
+		defer u.mu.Unlock()
+		return u.ids[id], u.node, nil
+	}
+	u.mu.Unlock()
+
+	report, err := s.scanUsage()
+	if err != nil{
+		return Usage{}, Usage{}, err
+	}
+	return report.IDs[id], report.Node, nil
+}
+
+//Usage reports what every ID and the whole node stores
+func (s *Store) Usage() (UsageReport, error){
+	u := &s.usage
+	u.mu.Lock()
+	if u.loaded{
+		defer u.mu.Unlock()
+
+		report := UsageReport{Node: u.node, IDs: make(map[string]Usage, len(u.ids))}
+		for id, usage := range u.ids{
+			report.IDs[id] = usage
+		}
+		return report, nil
+	}
+	u.mu.Unlock()
+
+	return s.scanUsage()
+}
+
+//scanUsage adds up what every ID stores from the objects in the backend
+func (s *Store) scanUsage() (UsageReport, error){
+	all, err := s.Backend.IDs()
+	if err != nil{
+		return UsageReport{}, err
+	}
+
+	report := UsageReport{IDs: make(map[string]Usage)}
+	for _, ns := range all{
+		id, ok := usageOwner(ns)
+		if !ok{
+			continue
+		}
+		metas, err := s.Backend.List(ns, "")
+		if err != nil{
+			return UsageReport{}, err
+		}
+
+		u := report.IDs[id]
+		for _, meta := range metas{
+			u.Bytes += meta.Size
+			u.Objects++
+		}
+		if u.Objects > 0{
+			report.IDs[id] = u
+		}
+	}
+
+	for _, u := range report.IDs{
+		report.Node.Bytes += u.Bytes
+		report.Node.Objects += u.Objects
+	}
+	return report, nil
+}
+
+//quotaRoom returns how many bytes a write of key may have, -1 if there
+//is no limit, or ErrQuotaExceeded if one more object doesn't fit
+func (s *Store) quotaRoom(id string, key string) (int64, error){
+	room := int64(-1)
+	if isInternalID(id) || (!s.quotaOf(id).limited() && !s.NodeQuota.limited()){
+		return room, nil
+	}
+
+	//an object that is replaced for good makes room for the write
+	var freed int64
+	added := 1
+	if old, err := s.Backend.Stat(id, key); err == nil && (!s.Versioning || old.Expired(time.Now())){
+		freed, added = old.Size, 0
+	}
+
+	check := func(scope string, q Quota, u Usage) error{
+		if q.MaxObjects > 0 && u.Objects + added > q.MaxObjects{
+			return fmt.Errorf("%s stores (%d) objects of (%d): %w", scope, u.Objects, q.MaxObjects, ErrQuotaExceeded)
+		}
+		if q.MaxBytes > 0{
+			left := max(q.MaxBytes - u.Bytes + freed, 0)
+			if room < 0 || left < room{
+				room = left
+			}
+		}
+		return nil
+	}
+
+	u, node, err := s.usageOf(id)
+	if err != nil{
+		return 0, err
+	}
+	if err := check(fmt.Sprintf("ID (%s)", id), s.quotaOf(id), u); err != nil{
+		return 0, err
+	}
+	if err := check("the node", s.NodeQuota, node); err != nil{
+		return 0, err
+	}
+	return room, nil
+}
+
+//checkQuota fails with ErrQuotaExceeded if an object of size
+//bytes can't be stored under key
+func (s *Store) checkQuota(id string, key string, size int64) error{
+	room, err := s.quotaRoom(id, key)
+	if err != nil{
+		return err
+	}
+	if room >= 0 && size > room{
+		return errQuota(id, key, room)
+	}
+	return nil
+}
+
+func errQuota(id string, key string, room int64) error{
+	return fmt.Errorf("[%s] of (%s) is larger than the (%d) bytes left: %w", key, id, room, ErrQuotaExceeded)
+}
+
+//Usage reports what every ID and the whole node stores on this server
+func (s *FileServer) Usage() (UsageReport, error){
+	return s.store.Usage()
+}
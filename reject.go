@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Hemansh24/HyperFS/p2p"
+)
+
+//how long the sender of a file waits for the peer to answer it, and
+//the peer for the stream once it told the sender to go ahead
+const (
+	storeAnswerTimeout = time.Second * 10
+	storeStreamTimeout = time.Second * 10
+)
+
+//how a peer answered a file it was asked to store
+const (
+	storeAccepted byte = iota
+	rejectQuota
+	rejectStorage
+	rejectFailed
+)
+
+//MessageStoreAnswer answers a MessageStoreFile or a MessageStoreChunks
+//before anything is streamed, a file that was turned down because it
+//doesn't fit in the quota or on the disk is never sent
+type MessageStoreAnswer struct{
+	ID 		string
+	Key 	string
+	//Reason is why the file was turned down, storeAccepted if it wasn't
+	Reason 	byte
+	Err 	string
+}
+
+//rejectionReason returns why err turns a store down
+func rejectionReason(err error) byte{
+	switch{
+	case err == nil:
+		return storeAccepted
+	case errors.Is(err, ErrQuotaExceeded):
+		return rejectQuota
+	case errors.Is(err, ErrInsufficientStorage):
+		return rejectStorage
+	}
+	return rejectFailed
+}
+
+//isRejection tells whether err is a peer turning a file down
+//because it has no room for it
+func isRejection(err error) bool{
+	reason := rejectionReason(err)
+	return reason == rejectQuota || reason == rejectStorage
+}
+
+//checkRemoteID fails for an ID a peer may not name in a message,
+//the IDs the store keeps its own objects under among them
+func checkRemoteID(id string) error{
+	if len(id) == 0 || isInternalID(id){
+		return fmt.Errorf("invalid ID (%s)", id)
+	}
+	return nil
+}
+
+//checkReplicaID fails for an ID a peer may not store or prune
+//files under, which also rules out the ID of this node
+func (s *FileServer) checkReplicaID(id string) error{
+	if err := checkRemoteID(id); err != nil{
+		return err
+	}
+	if id == s.ID{
+		return fmt.Errorf("peers keep no files under the ID (%s) of this node", id)
+	}
+	return nil
+}
+
+//answerStore tells the sender of a file whether to stream it, err
+//is why it may not. It returns err, or the error sending the answer.
+func (s *FileServer) answerStore(peer p2p.Peer, id string, key string, err error) error{
+	answer := MessageStoreAnswer{
+		ID: 	id,
+		Key: 	key,
+		Reason: rejectionReason(err),
+	}
+	if err != nil{
+		answer.Err = err.Error()
+	}
+
+	msg := Message{Payload: answer}
+	if sendErr := s.sendTo(peer, &msg); sendErr != nil{
+		log.Printf("answering peer %s failed: %s", peer.RemoteAddr(), sendErr)
+		if err == nil{
+			return sendErr
+		}
+	}
+	//so it stops sending what won't fit
+	if rejectionReason(err) == rejectStorage{
+		s.advertiseCapacity(peer)
+	}
+	return err
+}
+
+//askToStore sends the message announcing a file to the peer and waits for
+//its answer, the peer is waiting for the stream when it returns nil
+func (s *FileServer) askToStore(peer p2p.Peer, key string, msg *Message) error{
+	addr := peer.RemoteAddr().String()
+	ch := make(chan error, 1)
+
+	s.answerLock.Lock()
+	s.answers[addr + "/" + key] = ch
+	s.answerLock.Unlock()
+
+	defer func(){
+		s.answerLock.Lock()
+		delete(s.answers, addr + "/" + key)
+		s.answerLock.Unlock()
+	}()
+
+	if err := s.sendTo(peer, msg); err != nil{
+		return err
+	}
+
+	select{
+	case err := <- ch:
+		return err
+	case <- time.After(storeAnswerTimeout):
+		return fmt.Errorf("peer %s did not answer for (%s) in %s", addr, key, storeAnswerTimeout)
+	case <- s.qiutch:
+		return fmt.Errorf("[%s] stopped before peer %s answered", s.Transport.Addr(), addr)
+	}
+}
+
+func (s *FileServer) handleMessageStoreAnswer(from string, msg MessageStoreAnswer) error{
+	s.answerLock.Lock()
+	defer s.answerLock.Unlock()
+
+	ch, ok := s.answers[from + "/" + msg.Key]
+	if !ok || msg.ID != s.ID{
+		return nil
+	}
+
+	var err error
+	switch msg.Reason{
+	case storeAccepted:
+	case rejectQuota:
+		err = fmt.Errorf("peer %s did not store (%s): %w", from, msg.Key, ErrQuotaExceeded)
+	case rejectStorage:
+		err = fmt.Errorf("peer %s did not store (%s): %w", from, msg.Key, ErrInsufficientStorage)
+	default:
+		err = fmt.Errorf("peer %s did not store (%s): %s", from, msg.Key, msg.Err)
+	}
+	if err != nil{
+		log.Printf("[%s] peer %s did not store (%s): %s", s.Transport.Addr(), from, msg.Key, msg.Err)
+	}
+
+	select{
+	case ch <- err:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+//corrupted objects of an ID are moved under the ID "quarantine/<id>",
+//IDs are hex so this can never clash with one of them
+const quarantineFolderName = "quarantine"
+
+//ScrubOpts controls a pass of the scrubber over the store
+type ScrubOpts struct{
+	//BytesPerSecond caps how fast objects are read back from disk,
+	//so a scrub doesn't starve everything else. 0 means no limit.
+	BytesPerSecond int64
+	//Interval is the pause between two passes of StartScrub
+	Interval time.Duration
+}
+
+//ScrubReport is what a single pass of the scrubber found
+type ScrubReport struct{
+	Checked 	int
+	Corrupted 	[]ObjectMeta
+	//Lost are the objects the backend lost, say with a failed disk
+	Lost 		[]ObjectMeta
+	//Repaired are the corrupted and lost objects that were fetched
+	//again from a peer
+	Repaired 	[]ObjectMeta
+}
+
+//throttledReader keeps reads under a rate by sleeping
+//whenever it gets ahead of it
+type throttledReader struct{
+	r 		io.Reader
+	rate 	int64
+	start 	time.Time
+	read 	int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error){
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+
+	due := t.start.Add(time.Duration(t.read * int64(time.Second) / t.rate))
+	if wait := time.Until(due); wait > 0{
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+//quarantineNamespace is the ID the corrupted objects of id are moved to
+func quarantineNamespace(id string) string{
+	return quarantineFolderName + "/" + id
+}
+
+//Verify reads the object back and checks it against the checksum in
+//its metadata, reading at most rate bytes per second when rate is
+//not 0. A bad object fails with ErrChecksumMismatch.
+func (s *Store) Verify(id string, key string, rate int64) error{
+	meta, err := s.Stat(id, key)
+	if err != nil{
+		return err
+	}
+	return s.verifyObject(meta, rate)
+}
+
+func (s *Store) verifyObject(meta ObjectMeta, rate int64) error{
+	_, r, err := s.readStream(meta)
+	if err != nil{
+		//the metadata says it is there, so a missing object is corruption too
+		return fmt.Errorf("[%s] %w: %s", meta.Key, ErrChecksumMismatch, err)
+	}
+	defer r.Close()
+
+	var src io.Reader = r
+	if rate > 0{
+		src = &throttledReader{r: r, rate: rate, start: time.Now()}
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, src); err != nil{
+		return fmt.Errorf("[%s] %w: %s", meta.Key, ErrChecksumMismatch, err)
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != meta.Checksum{
+		return fmt.Errorf("[%s] %w", meta.Key, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+//Quarantine moves a corrupted object out of the way, under the ID
+//"quarantine/<id>", so it can be looked at later. For a chunked object
+//every chunk that fails its own checksum is moved as well, so writing
+//the object again doesn't reuse a bad chunk.
+func (s *Store) Quarantine(id string, key string) error{
+	meta, err := s.Stat(id, key)
+	if err != nil{
+		return err
+	}
+
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
+
+	var m *Manifest
+	if meta.Chunked{
+		if m, err = s.readManifest(id, key); err != nil{
+			return err
+		}
+
+		for _, hash := range m.uniqueHashes(){
+			chunk, err := s.Stat(chunkNamespace(id), hash)
+			if err != nil{
+				continue
+			}
+			if err := s.verifyObject(chunk, 0); err == nil{
+				continue
+			}
+			if err := s.moveObject(chunk, quarantineNamespace(chunkNamespace(id))); err != nil{
+				return err
+			}
+		}
+	}
+
+	if err := s.moveObject(meta, quarantineNamespace(id)); err != nil{
+		return err
+	}
+	if m != nil{
+		s.releaseChunks(id, m)
+	}
+
+	log.Printf("quarantined corrupted object [%s] of (%s)", key, id)
+	return nil
+}
+
+//moveObject stores an object and its metadata under another ID,
+//linked when the backend can, and deletes the original.
+//chunkLock must be held.
+func (s *Store) moveObject(meta ObjectMeta, to string) error{
+	moved := meta
+	moved.ID, moved.Path = to, ""
+	if err := s.copyObject(meta, moved); err != nil{
+		return err
+	}
+	s.countUsage(to, meta.Size, 1)
+
+	if err := s.Backend.Delete(meta.ID, meta.Key); err != nil{
+		return err
+	}
+	s.countUsage(meta.ID, -meta.Size, -1)
+	return nil
+}
+
+//Scrub reads back every object in the store and checks it against its
+//checksum. Corrupted objects are quarantined and fetched again from a
+//peer that has a healthy copy, so are the objects the backend lost.
+func (s *FileServer) Scrub(opts ScrubOpts) (ScrubReport, error){
+	report := ScrubReport{}
+
+	//lost objects were never corrupted, they only have to be stored again
+	lost, err := s.store.Lost()
+	if err != nil{
+		return report, err
+	}
+	for _, meta := range lost{
+		report.Lost = append(report.Lost, meta)
+		if err := s.repair(meta); err != nil{
+			log.Printf("[%s] bringing back lost [%s] failed: %s", s.Transport.Addr(), meta.Key, err)
+			continue
+		}
+		report.Repaired = append(report.Repaired, meta)
+	}
+
+	ids, err := s.store.IDs()
+	if err != nil{
+		return report, err
+	}
+
+	for _, id := range ids{
+		metas, err := s.store.List(id, "")
+		if err != nil{
+			return report, err
+		}
+
+		for _, meta := range metas{
+			report.Checked++
+
+			err := s.store.Verify(id, meta.Key, opts.BytesPerSecond)
+			if err == nil || !errors.Is(err, ErrChecksumMismatch){
+				//gone in the meantime or not readable right now,
+				//neither says anything about the data
+				continue
+			}
+
+			log.Printf("[%s] scrub: %s", s.Transport.Addr(), err)
+			report.Corrupted = append(report.Corrupted, meta)
+
+			if err := s.store.Quarantine(id, meta.Key); err != nil{
+				log.Printf("[%s] quarantining [%s] failed: %s", s.Transport.Addr(), meta.Key, err)
+				continue
+			}
+
+			if err := s.repair(meta); err != nil{
+				log.Printf("[%s] repairing [%s] failed: %s", s.Transport.Addr(), meta.Key, err)
+				continue
+			}
+			report.Repaired = append(report.Repaired, meta)
+		}
+	}
+
+	return report, nil
+}
+
+//StartScrub runs Scrub in the background every opts.Interval
+//(an hour if it is not set) until the server is stopped
+func (s *FileServer) StartScrub(opts ScrubOpts){
+	if opts.Interval <= 0{
+		opts.Interval = time.Hour
+	}
+
+	go func(){
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+
+		for{
+			select{
+			case <- ticker.C:
+				report, err := s.Scrub(opts)
+				if err != nil{
+					log.Printf("[%s] scrub failed: %s", s.Transport.Addr(), err)
+					continue
+				}
+				log.Printf("[%s] scrubbed %d objects, %d corrupted, %d lost, %d repaired", s.Transport.Addr(), report.Checked, len(report.Corrupted), len(report.Lost), len(report.Repaired))
+
+			case <- s.qiutch:
+				return
+			}
+		}
+	}()
+}
+
+//repair fetches a healthy copy of a quarantined or lost object from the peers
+func (s *FileServer) repair(meta ObjectMeta) error{
+	wopts := WriteOpts{Checksum: meta.Checksum, Metadata: meta.Metadata, VersionID: meta.VersionID, ExpiresAt: meta.ExpiresAt, Cached: meta.Cached, Hashed: meta.Hashed}
+
+	//our own files are decrypted on the way in, like any other Get
+	if meta.ID == s.ID{
+		f, err := s.openRemote(meta.Key, 0, 0)
+		if err != nil{
+			return err
+		}
+		defer f.Close()
+
+		_, err = s.store.WriteWithOpts(meta.ID, meta.Key, f, wopts)
+		return err
+	}
+
+	//a replica is stored as it was sent, so another replica is copied as is
+	if meta.Chunked{
+		return fmt.Errorf("chunked replica [%s] can only be repaired by its owner storing it again", meta.Key)
+	}
+
+	peer, header, err := s.fetchObject(meta.ID, meta.Key, "", 0, 0)
+	if err != nil{
+		return err
+	}
+	lr := io.LimitReader(peer, header.Size)
+	defer func(){
+		io.Copy(io.Discard, lr)
+		peer.CloseStream()
+	}()
+
+	if header.Chunked{
+		return fmt.Errorf("peer %s sent replica [%s] chunked", peer.RemoteAddr(), meta.Key)
+	}
+
+	//it comes with the header of the version the peers send now,
+	//which a replica from before the codec byte doesn't have
+	wopts.Unchunked = true
+	wopts.EncVersion = encVersion
+	if meta.EncVersion != encVersion{
+		wopts.Checksum = ""
+		if header.Checksum != ([sha256.Size]byte{}){
+			wopts.Checksum = hex.EncodeToString(header.Checksum[:])
+		}
+	}
+	_, err = s.store.WriteWithOpts(meta.ID, meta.Key, lr, wopts)
+	return err
+}
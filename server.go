@@ -3,8 +3,12 @@ package main
 //Capital is public
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
@@ -17,10 +21,44 @@ import (
 type FileServerOpts struct {
 	ID 					string
 	Enckey 				[]byte
-	StorageRoot       	string
-	PathTransformFunc 	PathTransformFunc
+	//Backend is where the files are kept, a filesystem backend under
+	//the default root laid out by the digests of KeyHasher when it is nil
+	Backend 			Backend
 	Transport         	p2p.Transport
 	BootstrapNodes	  	[]string
+	//Chunking stores files as deduplicated content defined chunks
+	//and only replicates the chunks a peer doesn't have yet
+	Chunking 			bool
+	//Codec compresses files on disk and before they are encrypted
+	//for the peers, nil leaves them uncompressed
+	Codec 				Codec
+	//Versioning keeps the old versions of a file when it is stored
+	//again, on this node and on the peers
+	Versioning 			bool
+	//Retention decides which old versions are pruned, everywhere
+	Retention 			RetentionPolicy
+	//Quota limits what every ID stores on this node unless Quotas has
+	//one of its own for it, NodeQuota limits all of them together
+	Quota 				Quota
+	Quotas 				map[string]Quota
+	NodeQuota 			Quota
+	//Cache limits what the replicas of other nodes' files and
+	//the files Get cached may store on this node
+	Cache 				CacheOpts
+	//MinFreeSpace is how many bytes of the disk are kept free,
+	//files that would eat into them are turned down
+	MinFreeSpace 		int64
+	//KeyHasher makes the key a file is sent to the peers under, SHA-256
+	//when it is nil. A backend laid out by NewCASPathTransformFunc with
+	//the same one keeps the file and its replicas at the path named by
+	//that key.
+	KeyHasher 			KeyHasher
+	//NodeKey encrypts the files on the disks of this node, its own as
+	//well as the replicas, they are only decrypted when they are read
+	NodeKey 			[]byte
+	//Tombstones records the files deleted on this node, for
+	//incremental exports
+	Tombstones 			bool
 }
 
 type FileServer struct{
@@ -31,16 +69,55 @@ type FileServer struct{
 
 	store 	*Store
 
-	qiutch 	chan struct{}
+	//the files being stored wait here for the answers
+	//of the peers, by peer address and key
+	answerLock 	sync.Mutex
+	answers 	map[string]chan error
+
+	//room every peer advertised last, by address
+	capacityLock 	sync.Mutex
+	capacities 		map[string]Capacity
+
+	//messages of the peers waiting for handleLoop
+	handlech 	chan inboundMessage
+	qiutch 		chan struct{}
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
 
+	if opts.KeyHasher == nil{
+		opts.KeyHasher = SHA256KeyHasher{}
+	}
+
+	//the files and the replicas of the peers
+	//are laid out by the same digests
+	if opts.Backend == nil{
+		opts.Backend = NewFSBackend(FSBackendOpts{KeyHasher: opts.KeyHasher})
+	}
+
 	storeOpts := StoreOpts{
 
-		Root: opts.StorageRoot,
+		Backend: opts.Backend,
+
+		Chunking: opts.Chunking,
+
+		Codec: opts.Codec,
+
+		Versioning: opts.Versioning,
 
-		PathTransformFunc: opts.PathTransformFunc,
+		Quota: opts.Quota,
+
+		Quotas: opts.Quotas,
+
+		NodeQuota: opts.NodeQuota,
+
+		Cache: opts.Cache,
+
+		MinFreeSpace: opts.MinFreeSpace,
+
+		NodeKey: opts.NodeKey,
+
+		Tombstones: opts.Tombstones,
 	}
 
 	if len(opts.ID) == 0{
@@ -52,44 +129,51 @@ func NewFileServer(opts FileServerOpts) *FileServer {
 		FileServerOpts: opts,
 		store:          NewStore(storeOpts),
 		qiutch: 		make(chan struct{}),	
+		handlech: 		make(chan inboundMessage, 1024),
 		peers: 			make(map[string]p2p.Peer),
+		answers: 		make(map[string]chan error),
+		capacities: 	make(map[string]Capacity),
 	}
 }
 
-func (s *FileServer) stream(msg *Message) error {
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+//sendTo sends a gob encoded message to a single peer
+func (s *FileServer) sendTo(peer p2p.Peer, msg *Message) error{
+	b, err := encodeMessage(msg)
+	if err != nil{
 		return err
 	}
+	return peer.Send(b)
+}
+
+//encodeMessage gob encodes a message and frames it for
+//the wire, for a message that has to go out with a stream
+func encodeMessage(msg *Message) ([]byte, error){
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil{
+		return nil, err
+	}
+	return p2p.EncodeMessage(buf.Bytes()), nil
+}
 
+//peer looks up a connected peer by its remote address
+func (s *FileServer) peer(addr string) (p2p.Peer, bool){
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
 
-	for _, peer := range s.peers {
-		if err := peer.Send(buf.Bytes()); err != nil {
-			log.Printf("broadcast to peer %s failed: %s", peer.RemoteAddr(), err)
-		}
-	}
-
-	return nil
+	peer, ok := s.peers[addr]
+	return peer, ok
 }
 
-func (s *FileServer) broadcast(msg *Message) error {
-
-	buf := new(bytes.Buffer)
-	//encodes the storage key for transmission
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil{
-		return err
-	}
+//peerList returns a snapshot of the connected peers
+func (s *FileServer) peerList() []p2p.Peer{
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
 
-	//sends the small, gob encoded metadata message to every peer
-	for _, peer := range(s.peers){
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil{
-			return err
-		}
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers{
+		peers = append(peers, peer)
 	}
-	return nil
+	return peers
 }
 
 type Message struct{
@@ -100,94 +184,437 @@ type MessageStoreFile struct{
 	ID string
 	Key string
 	Size int64
+	//Checksum is the hex encoded sha256 of the Size bytes that follow
+	Checksum string
+	//VersionID the replica is stored as, so it is the same on every node
+	VersionID string
+	//ExpiresAt is when the replica expires, the same time as the file
+	ExpiresAt time.Time
 }
 
 type MessageGetFile struct{
 	ID string
 	Key string
+	//Offset and Length select a range of the plaintext,
+	//a Length of 0 means until the end of the file
+	Offset int64
+	Length int64
+	//VersionID selects an old version, empty for the current one
+	VersionID string
+}
+
+//fileHeader is streamed back in front of every file we
+//serve in response to a MessageGetFile
+type fileHeader struct{
+	//number of bytes that follow the header,
+	//fileNotFound if we don't have the file
+	Size 	int64
+	//Chunked is set when the file is sent chunk by chunk,
+	//see serveChunked for the layout
+	Chunked bool
+	//Checksum is the sha256 of everything that follows the header, or
+	//of the plaintext for a chunked file. It is only set when the whole
+	//stored file is sent, all zero otherwise.
+	Checksum [sha256.Size]byte
+}
+
+//size sent back in place of the file size when
+//the requested file does not exist on this node
+const fileNotFound = -1
+
+//how long a request waits for the peer to start streaming its response
+const responseTimeout = time.Second * 10
+
+//checkLength fails for a length a peer sent that nothing can be
+//allocated for, before anything is
+func checkLength(n int64) error{
+	if n < 0 || n > p2p.MaxMessageSize{
+		return fmt.Errorf("peer sent an invalid length (%d)", n)
+	}
+	return nil
+}
+
+//sendFileHeader starts the response stream to a MessageGetFile,
+//w is the connection to the peer held with Hold
+func sendFileHeader(w io.Writer, header fileHeader) error{
+	if _, err := w.Write([]byte{p2p.IncomingStream}); err != nil{
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, header)
+}
+
+//sendFileNotFound answers a MessageGetFile for a file we can't serve
+func sendFileNotFound(peer p2p.Peer) error{
+	return peer.Hold(func(w io.Writer) error{
+		return sendFileHeader(w, fileHeader{Size: fileNotFound})
+	})
+}
+
+//GetOpts controls how Get reads a file that is not stored on this node
+type GetOpts struct{
+	//Cache writes the file into the local store while it is being
+	//streamed to the caller, so the next Get is served from disk
+	//until the cache tier evicts it
+	Cache bool
+}
+
+//Get streams the file to the caller. If we don't have it locally the
+//decrypted bytes come straight off a peer's connection without touching
+//our disk, the returned reader must be closed to free the connection.
+func (s *FileServer) Get(key string) (io.ReadCloser, error){
+	return s.GetWithOpts(key, GetOpts{})
 }
 
 //checks if the server already has the key or not
-func (s *FileServer) Get(key string) (io.Reader, error){
+//If key is a content identifier the data is checked against it while it
+//is read, so a bad copy fails with ErrContentMismatch instead of being
+//handed out (or cached) as the real thing.
+func (s *FileServer) GetWithOpts(key string, opts GetOpts) (io.ReadCloser, error){
 	if s.store.Has(s.ID,key){
+		s.store.recordLookup(true)
 		fmt.Printf("[%s] serving file (%s) from local\n", s.Transport.Addr(), key)
 		_, r, err := s.store.Read(s.ID, key)
-		return r, err
+		if err != nil || !isContentID(key){
+			return r, err
+		}
+
+		v, err := newVerifyReader(r, key)
+		if err != nil{
+			r.Close()
+			return nil, err
+		}
+		return &verifiedReadCloser{verifyReader: v, Closer: r}, nil
 	}
+	s.store.recordLookup(false)
 	fmt.Printf("[%s] Dont have file (%s) locally, fetching from network... \n", s.Transport.Addr(), key)
-	msg := Message{
-		Payload: MessageGetFile{
-			ID : s.ID,
-			Key: hashKey(key),
-		},
-	}
 
-	if err := s.broadcast(&msg); err != nil{
+	f, err := s.openRemote(key, 0, 0)
+	if err != nil{
 		return nil, err
 	}
 
-	time.Sleep(time.Millisecond * 500)
-
-	for _, peer := range s.peers{
-		//First read the file size so that we can limit the amount of bytes we read from the connection
-		//so that we don't keep hanging
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
-		n, err := s.store.WriteDecrypt(s.Enckey, s.ID, key, io.LimitReader(peer, fileSize))
+	if isContentID(key){
+		v, err := newVerifyReader(f.Reader, key)
 		if err != nil{
+			f.Close()
 			return nil, err
 		}
+		f.Reader = v
+	}
 
-		fmt.Printf("[%s] Recieved bytes (%d) over the network from (%s)\n",s.Transport.Addr(), n, peer.RemoteAddr())
+	if opts.Cache{
+		f.cacheTo(s.store, s.ID, key)
+	}
+	return f, nil
+}
+
+//GetRange returns length bytes of the file starting at offset, a length
+//of 0 reads to the end of the file. Only the requested range travels over
+//the network, unless the file was compressed, and the peer serving it
+//never decrypts anything.
+func (s *FileServer) GetRange(key string, offset int64, length int64) (io.ReadCloser, error){
+	if s.store.Has(s.ID, key){
+		s.store.recordLookup(true)
+		fmt.Printf("[%s] serving range of file (%s) from local\n", s.Transport.Addr(), key)
+		_, r, err := s.store.ReadRange(s.ID, key, offset, length)
+		return r, err
+	}
+
+	s.store.recordLookup(false)
+	return s.openRemote(key, offset, length)
+}
+
+//openRemote finds a peer that has the file and returns a reader
+//that decrypts the requested range as it comes in
+func (s *FileServer) openRemote(key string, offset int64, length int64) (*remoteFile, error){
+	return s.openRemoteVersion(key, "", offset, length)
+}
+
+//openRemoteVersion is openRemote for a version of the file,
+//an empty versionID is the current version
+func (s *FileServer) openRemoteVersion(key string, versionID string, offset int64, length int64) (*remoteFile, error){
+	peer, header, err := s.fetch(key, versionID, offset, length)
+	if err != nil{
+		return nil, err
+	}
+
+	//limit the amount of bytes we read from the connection
+	//so that we don't keep hanging
+	lr := io.LimitReader(peer, header.Size)
+
+	fail := func(err error) (*remoteFile, error){
+		io.Copy(io.Discard, lr)
 		peer.CloseStream()
+		return nil, err
+	}
+
+	//catch a file that went bad on the peer's disk or on the way here
+	var src io.Reader = lr
+	if header.Checksum != ([sha256.Size]byte{}) && !header.Chunked{
+		v, err := newChecksumReader(lr, hex.EncodeToString(header.Checksum[:]))
+		if err != nil{
+			return fail(err)
+		}
+		src = v
+	}
+
+	block, err := aes.NewCipher(s.Enckey)
+	if err != nil{
+		return fail(err)
 	}
 
-	_, r, err := s.store.Read(s.ID, key)
-	return r, err
+	fmt.Printf("[%s] Streaming (%d) bytes of (%s) from (%s)\n", s.Transport.Addr(), header.Size, key, peer.RemoteAddr())
+
+	if header.Chunked{
+		r, err := newChunkDecryptReader(block, src)
+		if err != nil{
+			return fail(err)
+		}
+
+		//the chunks are checked once they are decrypted, against
+		//the checksum replicateChunks sealed with the key
+		var plain io.Reader = r
+		if header.Checksum != ([sha256.Size]byte{}){
+			v, err := newChecksumReader(r, hex.EncodeToString(header.Checksum[:]))
+			if err != nil{
+				return fail(err)
+			}
+			v.seal = s.sealChecksum
+			plain = v
+		}
+		return &remoteFile{Reader: plain, peer: peer, conn: lr}, nil
+	}
+
+	//the peer sends the header of the file in front of the ciphertext range
+	codec, iv, err := readEncHeader(src)
+	if err != nil{
+		return fail(err)
+	}
+
+	if codec == nil{
+		return &remoteFile{
+			Reader: cipher.StreamReader{S: newCTRAt(block, iv, offset), R: src},
+			peer: 	peer,
+			conn: 	lr,
+		}, nil
+	}
+
+	//a compressed file comes whole, the range is cut out of the plaintext
+	r, err := codec.NewReader(cipher.StreamReader{S: cipher.NewCTR(block, iv), R: src})
+	if err != nil{
+		return fail(err)
+	}
+	if _, err := io.CopyN(io.Discard, r, offset); err != nil{
+		return fail(err)
+	}
+
+	var plain io.Reader = r
+	if length > 0{
+		plain = io.LimitReader(r, length)
+	}
+	return &remoteFile{Reader: plain, peer: peer, conn: lr}, nil
+}
+
+//remoteFile is a file being streamed from a peer. Until it is closed
+//the peer's read loop is paused, so it has to be closed even when the
+//caller stops reading early.
+type remoteFile struct{
+	io.Reader
+	peer 	p2p.Peer
+	//conn is what is left of the response on the connection
+	conn 	io.Reader
+
+	//set when the file is also written into the local store
+	cache 	*io.PipeWriter
+	cacheErr chan error
+
+	closed 	bool
+}
+
+//cacheTo tees everything the caller reads into the store
+func (f *remoteFile) cacheTo(store *Store, id string, key string){
+	pr, pw := io.Pipe()
+	f.cache = pw
+	f.cacheErr = make(chan error, 1)
+	f.Reader = io.TeeReader(f.Reader, pw)
+
+	go func(){
+		_, err := store.WriteWithOpts(id, key, pr, WriteOpts{Cached: true})
+		//unblock the tee if the write gave up half way
+		pr.CloseWithError(err)
+		f.cacheErr <- err
+	}()
+}
+
+func (f *remoteFile) Close() error{
+	if f.closed{
+		return nil
+	}
+	f.closed = true
+
+	var err error
+	if f.cache != nil{
+		//read whatever the caller skipped so the cached copy is complete
+		_, err = io.Copy(io.Discard, f.Reader)
+		f.cache.CloseWithError(err)
+		if cacheErr := <- f.cacheErr; err == nil{
+			err = cacheErr
+		}
+	}
+
+	io.Copy(io.Discard, f.conn)
+	f.peer.CloseStream()
+	return err
+}
+
+//fetch asks the peers one after another for a range of the file and
+//returns the first one that has it, along with the header of the
+//response waiting on its connection. The caller has to read the
+//response and then call CloseStream on the peer.
+func (s *FileServer) fetch(key string, versionID string, offset int64, length int64) (p2p.Peer, fileHeader, error){
+	return s.fetchObject(s.ID, s.hashKey(key), versionID, offset, length)
+}
+
+//fetchObject is fetch for the object the peers store as key under id
+func (s *FileServer) fetchObject(id string, key string, versionID string, offset int64, length int64) (p2p.Peer, fileHeader, error){
+	msg := Message{
+		Payload: MessageGetFile{
+			ID : id,
+			Key: key,
+			Offset: offset,
+			Length: length,
+			VersionID: versionID,
+		},
+	}
+
+	for _, peer := range s.peerList(){
+		if err := s.sendTo(peer, &msg); err != nil{
+			log.Printf("get request to peer %s failed: %s", peer.RemoteAddr(), err)
+			continue
+		}
+
+		if err := peer.WaitStream(responseTimeout); err != nil{
+			log.Printf("get request to peer %s failed: %s", peer.RemoteAddr(), err)
+			continue
+		}
+
+		var header fileHeader
+		if err := binary.Read(peer, binary.LittleEndian, &header); err != nil{
+			log.Printf("reading file header from peer %s failed: %s", peer.RemoteAddr(), err)
+			continue
+		}
+
+		if header.Size == fileNotFound{
+			peer.CloseStream()
+			continue
+		}
+		return peer, header, nil
+	}
+
+	return nil, fileHeader{}, fmt.Errorf("[%s] file (%s) not found on any peer", s.Transport.Addr(), key)
 }
 
 func (s *FileServer) Store(key string, r io.Reader) error{
+	return s.StoreWithOpts(key, r, WriteOpts{})
+}
 
+func (s *FileServer) storeFile(key string, r io.Reader, opts WriteOpts) error{
 	var (
 		filebuffer = new(bytes.Buffer)
 		tee = io.TeeReader(r, filebuffer)
 	)
-	size, err := s.store.Write(s.ID, key, tee)
+	size, err := s.store.WriteWithOpts(s.ID, key, tee, opts)
 	if err != nil{
 		 return err
 	}
-		
+
+	//a peer that turned the file down doesn't stop the others
+	rejected := s.replicate(key, size, filebuffer)
+	if rejected != nil && !isRejection(rejected){
+		return rejected
+	}
+
+	if err := s.PruneVersions(key); err != nil{
+		return err
+	}
+	return rejected
+}
+
+//replicate encrypts size bytes of plaintext from r and streams them
+//under the hashed key to every peer that has room for them and accepts
+//them. It returns the first rejection once every peer was tried.
+func (s *FileServer) replicate(key string, size int64, r io.Reader) error{
+	//encrypt up front, the peers check what they get against
+	//the checksum of the ciphertext before they keep it
+	var (
+		ciphertext = new(bytes.Buffer)
+		hash = sha256.New()
+	)
+	if _, err := copyEncrypt(s.Enckey, s.Codec, io.LimitReader(r, size), io.MultiWriter(ciphertext, hash)); err != nil{
+		return err
+	}
+
 	msg := Message{
 		Payload: MessageStoreFile{
 			ID : s.ID,
-			Key : hashKey(key),
-			Size: size + 16,
+			Key : s.hashKey(key),
+			Size: int64(ciphertext.Len()),
+			Checksum: hex.EncodeToString(hash.Sum(nil)),
+			VersionID: s.versionOf(key),
+			ExpiresAt: s.expiryOf(key),
 		},
 	}
-	if err := s.broadcast(&msg); err != nil{
-		return err
-	}
-
-	time.Sleep(time.Millisecond * 5)
+	var rejected error
+	for _, peer := range s.replicaPeers(int64(ciphertext.Len())){
+		err := s.askToStore(peer, s.hashKey(key), &msg)
+		if isRejection(err){
+			if rejected == nil{
+				rejected = err
+			}
+			continue
+		}
+		if err != nil{
+			return err
+		}
 
-	peers := []io.Writer{}
-	for _, peer := range(s.peers){
-		peers = append(peers, peer)
+		err = peer.Hold(func(w io.Writer) error{
+			if _, err := w.Write([]byte{p2p.IncomingStream}); err != nil{
+				return err
+			}
+			_, err := w.Write(ciphertext.Bytes())
+			return err
+		})
+		if err != nil{
+			return err
+		}
 	}
+	
+	fmt.Printf("[%s] recv and written (%d) to disk: \n",s.Transport.Addr(), ciphertext.Len())
+	return rejected
+}
 
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStream})
+//StoreContent is the content addressed version of Store. The file is
+//stored under its content identifier, which is returned so it can be
+//passed to Get, and whoever decrypts it later can check it against it.
+func (s *FileServer) StoreContent(r io.Reader) (string, error){
+	var (
+		buf = new(bytes.Buffer)
+		hash = sha256.New()
+	)
+	if _, err := io.Copy(io.MultiWriter(buf, hash), r); err != nil{
+		return "", err
+	}
 
-	n, err := copyEncrypt(s.Enckey, filebuffer, mw)
-	if err != nil{
-		return err
+	id := contentID(hash.Sum(nil))
+	if s.store.Has(s.ID, id){
+		//same content, nothing to do
+		return id, nil
 	}
-	
-	fmt.Printf("[%s] recv and written (%d) to disk: \n",s.Transport.Addr(), n)
-	time.Sleep(time.Second * 1)
-	
-	return nil
 
+	if err := s.Store(id, buf); err != nil{
+		return "", err
+	}
+	return id, nil
 }
 
 func (s *FileServer) Stop(){
@@ -206,6 +633,9 @@ func (s *FileServer) OnPeer(p p2p.Peer) error{
 
 	log.Printf("connected with remote peer %s", p.RemoteAddr())
 
+	//so it knows from the start whether there is room for its files
+	go s.advertiseCapacity(p)
+
 	return nil 
 }
 
@@ -216,6 +646,8 @@ func (s *FileServer) loop(){
 		s.Transport.Close()
 	}()
 
+	go s.handleLoop()
+
 	for{
 		select {
 
@@ -225,8 +657,17 @@ func (s *FileServer) loop(){
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil{
 				log.Println("decoding error: ",err)
 			}
-			if err := s.handleMessage(rpc.From, &msg); err !=nil{
-				log.Println("handle message error: ",err)
+
+			//answers don't wait behind the handlers, one may be waiting
+			//for the stream of a peer that is waiting for an answer
+			if answer, ok := msg.Payload.(MessageStoreAnswer); ok{
+				s.handleMessageStoreAnswer(rpc.From, answer)
+				continue
+			}
+			select{
+			case s.handlech <- inboundMessage{from: rpc.From, msg: msg}:
+			case <- s.qiutch:
+				return
 			}
 
 		case <- s.qiutch:
@@ -235,6 +676,27 @@ func (s *FileServer) loop(){
 	}
 }
 
+//inboundMessage is a message waiting for its handler
+type inboundMessage struct{
+	from 	string
+	msg 	Message
+}
+
+//handleLoop handles the messages of the peers one after another
+func (s *FileServer) handleLoop(){
+	for{
+		select{
+		case in := <- s.handlech:
+			if err := s.handleMessage(in.from, &in.msg); err !=nil{
+				log.Println("handle message error: ",err)
+			}
+
+		case <- s.qiutch:
+			return
+		}
+	}
+}
+
 func (s *FileServer) handleMessage(from string, msg *Message) error{
 	switch v := msg.Payload.(type) {
 
@@ -242,57 +704,152 @@ func (s *FileServer) handleMessage(from string, msg *Message) error{
 			return s.handleMessageStoreFile(from, v)
 		case MessageGetFile:
 			return s.handleMessageGetFile(from, v)
+		case MessageHasChunks:
+			return s.handleMessageHasChunks(from, v)
+		case MessageStoreChunks:
+			return s.handleMessageStoreChunks(from, v)
+		case MessageListKeys:
+			return s.handleMessageListKeys(from, v)
+		case MessagePruneVersions:
+			return s.handleMessagePruneVersions(from, v)
+		case MessageCapacity:
+			return s.handleMessageCapacity(from, v)
 	}
 	return nil
 }
 
 func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error{
-    if !s.store.Has(msg.ID, msg.Key){
-        return fmt.Errorf("[%s] need to serve file but (%s) does not exist on disk", s.Transport.Addr(), msg.Key)
-    }
-
-    fmt.Printf("[%s] Serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
-    fileSize, r, err := s.store.Read(msg.ID, msg.Key)
-    if err != nil{
-        return err
-    }
-
-    // Close the reader when done
-    if rc, ok := r.(io.ReadCloser); ok {
-        defer rc.Close()
-    }
-
-    peer, ok := s.peers[from]
-    if !ok {
-        return fmt.Errorf("peer %s not in map", from)
-    }
-
-    // Send metadata
-    peer.Send([]byte{p2p.IncomingStream})
-    binary.Write(peer, binary.LittleEndian, fileSize)
-    
-    // Copy the file data
-    n, err := io.Copy(peer, r)
-    if err != nil{
-        return err
-    }
-    
-    fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), n, from)
-    return nil
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	if err := checkRemoteID(msg.ID); err != nil{
+		sendFileNotFound(peer)
+		return err
+	}
+
+	meta, err := s.store.locateVersion(msg.ID, msg.Key, msg.VersionID)
+	if err != nil{
+		//tell the peer so it can ask someone else instead of waiting
+		sendFileNotFound(peer)
+		return fmt.Errorf("[%s] need to serve file but (%s) does not exist on disk", s.Transport.Addr(), msg.Key)
+	}
+
+	s.store.touch(meta)
+
+	if meta.Chunked{
+		return s.serveChunked(peer, msg, meta)
+	}
+
+	//we store the header of copyEncrypt followed by the ciphertext, the
+	//requested plaintext range is the same range of the ciphertext shifted
+	//by the header. Compressed plaintext can't be cut like that, so the
+	//whole file goes out and the peer cuts the range after decompressing.
+	header, err := s.readEncHeader(meta)
+	if err != nil{
+		sendFileNotFound(peer)
+		return err
+	}
+
+	offset, length := msg.Offset, msg.Length
+	if header[0] != codecNone{
+		offset, length = 0, 0
+	}
+
+	n, r, err := s.store.readMetaRange(meta, msg.ID, encHeaderLen(meta) + offset, length)
+	if err != nil{
+		sendFileNotFound(peer)
+		return err
+	}
+
+	// Close the reader when done
+	defer r.Close()
+
+	fmt.Printf("[%s] Serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
+
+	fh := fileHeader{Size: int64(len(header)) + n}
+	if offset == 0 && length == 0 && meta.EncVersion == encVersion{
+		//the whole stored file goes out as it is, so the peer can check it
+		hex.Decode(fh.Checksum[:], []byte(meta.Checksum))
+	}
+
+	var nn int64
+	err = peer.Hold(func(w io.Writer) error{
+		// Send metadata
+		if err := sendFileHeader(w, fh); err != nil{
+			return err
+		}
+		if _, err := w.Write(header); err != nil{
+			return err
+		}
+
+		// Copy the file data
+		nn, err = io.Copy(w, r)
+		return err
+	})
+	if err != nil{
+		return err
+	}
+
+	fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), nn, from)
+	return nil
+}
+
+//readEncHeader reads the codec and the IV that copyEncrypt put in
+//front of a stored file. A file from before the codec byte only starts
+//with the IV, it gets codecNone in front so it goes out like any other.
+func (s *FileServer) readEncHeader(meta ObjectMeta) ([]byte, error){
+	size := encHeaderLen(meta)
+	_, r, err := s.store.readMetaRange(meta, meta.ID, 0, size)
+	if err != nil{
+		return nil, err
+	}
+	defer r.Close()
+
+	header := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(r, header[encHeaderSize - size:]); err != nil{
+		return nil, err
+	}
+	return header, nil
 }
 
 func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error{
-	peer, ok := s.peers[from]
+	peer, ok := s.peer(from)
 	if !ok{
 		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
 	}
 
-	n, err := s.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
+	//turned down before the stream starts when it can't fit,
+	//so the sender knows right away and sends nothing
+	err := s.checkReplicaID(msg.ID)
+	if err == nil{
+		err = s.store.checkQuota(msg.ID, msg.Key, msg.Size)
+	}
+	if err == nil{
+		err = s.store.checkSpace(msg.Size)
+	}
+	if err := s.answerStore(peer, msg.ID, msg.Key, err); err != nil{
+		return err
+	}
+
+	if err := peer.WaitStream(storeStreamTimeout); err != nil{
+		return err
+	}
+	lr := io.LimitReader(peer, msg.Size)
+	n, err := s.store.WriteWithOpts(msg.ID, msg.Key, lr, WriteOpts{Checksum: msg.Checksum, VersionID: msg.VersionID, ExpiresAt: msg.ExpiresAt, Cached: true, Hashed: true, Unchunked: true, EncVersion: encVersion})
+
+	//drain what the write didn't read so the stream ends where it should
+	io.Copy(io.Discard, lr)
+	peer.CloseStream()
 	if err != nil{
+		//filled up after all, so it stops sending what won't fit
+		if rejectionReason(err) == rejectStorage{
+			s.advertiseCapacity(peer)
+		}
 		return err
 	}
 	fmt.Printf("[%s] written %d bytes to disk \n",s.Transport.Addr(), n)
-	peer.CloseStream()
 	return nil
 
 }
@@ -335,5 +892,11 @@ func (s *FileServer) Start() error{
 func init(){
 	gob.Register(MessageStoreFile{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageHasChunks{})
+	gob.Register(MessageStoreChunks{})
+	gob.Register(MessageListKeys{})
+	gob.Register(MessagePruneVersions{})
+	gob.Register(MessageStoreAnswer{})
+	gob.Register(MessageCapacity{})
 
 }
\ No newline at end of file
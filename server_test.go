@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Hemansh24/HyperFS/p2p"
+)
+
+//freeAddr is a local address nothing listens on
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+//startServer starts a server on a local address with opts
+func startServer(t *testing.T, opts FileServerOpts) (*FileServer, string) {
+	addr := freeAddr(t)
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    addr,
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	opts.Transport = tr
+	if opts.Enckey == nil {
+		opts.Enckey = newEncryptionkey()
+	}
+	if opts.Backend == nil {
+		opts.Backend = NewMemoryBackend()
+	}
+
+	s := NewFileServer(opts)
+	tr.OnPeer = s.OnPeer
+	go s.Start()
+	t.Cleanup(s.Stop)
+	return s, addr
+}
+
+//startPair starts a server and an origin that dials it, and waits
+//until they are connected
+func startPair(t *testing.T, peer FileServerOpts, origin FileServerOpts) (*FileServer, *FileServer) {
+	p, addr := startServer(t, peer)
+	o, _ := startServer(t, origin)
+	//the peer may not listen yet
+	waitFor(t, "the peer to listen", func() bool {
+		return o.Transport.Dial(addr) == nil
+	})
+	waitFor(t, "the servers to connect", func() bool {
+		return len(o.peerList()) == 1 && len(p.peerList()) == 1
+	})
+	return o, p
+}
+
+//waitFor polls ok until it holds or a few seconds went by
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatalf("gave up waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestServerReplicaPath(t *testing.T) {
+	hasher := HMACKeyHasher{Secret: []byte("network secret")}
+	newBackend := func() *FSBackend {
+		return NewFSBackend(FSBackendOpts{Root: t.TempDir(), KeyHasher: hasher})
+	}
+	ob, pb := newBackend(), newBackend()
+	o, _ := startPair(t,
+		FileServerOpts{Backend: pb, KeyHasher: hasher},
+		FileServerOpts{Backend: ob, KeyHasher: hasher})
+
+	if err := o.Store("picture.png", bytes.NewReader([]byte("pixels"))); err != nil {
+		t.Fatal(err)
+	}
+	var replica ObjectMeta
+	waitFor(t, "the replica", func() bool {
+		m, err := pb.Stat(o.ID, o.hashKey("picture.png"))
+		replica = m
+		return err == nil
+	})
+	file, err := ob.Stat(o.ID, "picture.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the file and its replica are both at the path of the digest
+	if replica.Path != file.Path {
+		t.Errorf("replica at %s, the file at %s", replica.Path, file.Path)
+	}
+	if want := o.ID + "/" + casPathKey(hasher.HashKey("picture.png")).FullPath(); file.Path != want {
+		t.Errorf("file at %s, not at the path of its digest", file.Path)
+	}
+}
+
+//waitForReplica waits until the peer stores the replica of the file of key
+func waitForReplica(t *testing.T, o *FileServer, p *FileServer, key string) ObjectMeta {
+	t.Helper()
+	var meta ObjectMeta
+	waitFor(t, "the replica of "+key, func() bool {
+		m, err := p.store.Stat(o.ID, o.hashKey(key))
+		meta = m
+		return err == nil
+	})
+	return meta
+}
+
+//reader returns a func that reads what Get returns to the end and closes it
+func reader(t *testing.T) func(io.ReadCloser, error) []byte {
+	return func(r io.ReadCloser, err error) []byte {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+}
+
+func TestServerGet(t *testing.T) {
+	o, p := startPair(t, FileServerOpts{}, FileServerOpts{})
+	read := reader(t)
+	data := []byte("a file that only the peer keeps")
+	if err := o.Store("doc", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	waitForReplica(t, o, p, "doc")
+	if err := o.store.Delete(o.ID, "doc"); err != nil {
+		t.Fatal(err)
+	}
+
+	//streamed from the peer without touching the disk
+	if have := read(o.Get("doc")); !bytes.Equal(have, data) {
+		t.Errorf("have %q, want %q", have, data)
+	}
+	if o.store.Has(o.ID, "doc") {
+		t.Error("expected Get to leave nothing on the disk")
+	}
+
+	//only the range travels
+	if have := read(o.GetRange("doc", 2, 4)); !bytes.Equal(have, data[2:6]) {
+		t.Errorf("have %q for the range, want %q", have, data[2:6])
+	}
+	if have := read(o.GetRange("doc", 7, 0)); !bytes.Equal(have, data[7:]) {
+		t.Errorf("have %q for the rest, want %q", have, data[7:])
+	}
+
+	//cached while it is streamed
+	if have := read(o.GetWithOpts("doc", GetOpts{Cache: true})); !bytes.Equal(have, data) {
+		t.Errorf("have %q, want %q", have, data)
+	}
+	meta, err := o.store.Stat(o.ID, "doc")
+	if err != nil {
+		t.Fatal("expected the file cached by Get")
+	}
+	if !meta.Cached || meta.Size != int64(len(data)) {
+		t.Errorf("cached copy is %+v", meta)
+	}
+}
+
+func TestServerLegacyReplica(t *testing.T) {
+	o, p := startPair(t, FileServerOpts{}, FileServerOpts{})
+	read := reader(t)
+	data := []byte("a replica stored before the codec byte")
+	if err := o.Store("doc", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if meta := waitForReplica(t, o, p, "doc"); meta.EncVersion != encVersion {
+		t.Errorf("expected the replica to record header version %d, got %+v", encVersion, meta)
+	}
+
+	//what the peer kept back then: the bare IV followed by the ciphertext
+	block, err := aes.NewCipher(o.Enckey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := make([]byte, aes.BlockSize+len(data))
+	rand.Read(legacy[:aes.BlockSize])
+	cipher.NewCTR(block, legacy[:aes.BlockSize]).XORKeyStream(legacy[aes.BlockSize:], data)
+	opts := WriteOpts{Cached: true, Hashed: true, Unchunked: true}
+	if _, err := p.store.WriteWithOpts(o.ID, o.hashKey("doc"), bytes.NewReader(legacy), opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.store.Delete(o.ID, "doc"); err != nil {
+		t.Fatal(err)
+	}
+
+	if have := read(o.Get("doc")); !bytes.Equal(have, data) {
+		t.Errorf("have %q, want %q", have, data)
+	}
+	if have := read(o.GetRange("doc", 17, 5)); !bytes.Equal(have, data[17:22]) {
+		t.Errorf("have %q for the range, want %q", have, data[17:22])
+	}
+}
+
+func TestServerChunkReplication(t *testing.T) {
+	o, p := startPair(t, FileServerOpts{Chunking: true}, FileServerOpts{Chunking: true})
+	read := reader(t)
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := o.Store("big", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if meta := waitForReplica(t, o, p, "big"); !meta.Chunked {
+		t.Errorf("expected the replica to be chunked, got %+v", meta)
+	}
+
+	//the peer knows the chunks and the checksum only by keyed IDs
+	m, err := p.store.readManifest(o.ID, o.hashKey("big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := o.store.readManifest(o.ID, "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range local.Chunks {
+		if m.Chunks[i].Hash != o.chunkID(c.Hash) || p.store.HasChunk(o.ID, c.Hash) {
+			t.Fatalf("chunk %d went to the peer as (%s)", i, m.Chunks[i].Hash)
+		}
+	}
+	if m.Checksum == local.Checksum || len(m.Checksum) == 0 {
+		t.Errorf("the peer got the checksum %q of the plaintext", m.Checksum)
+	}
+
+	//a file sharing most of its chunks only sends the ones the peer lacks
+	edited := append([]byte("a new header"), data...)
+	if err := o.Store("edited", bytes.NewReader(edited)); err != nil {
+		t.Fatal(err)
+	}
+	waitForReplica(t, o, p, "edited")
+
+	for key, want := range map[string][]byte{"big": data, "edited": edited} {
+		if err := o.store.Delete(o.ID, key); err != nil {
+			t.Fatal(err)
+		}
+		if have := read(o.Get(key)); !bytes.Equal(have, want) {
+			t.Errorf("[%s] does not match after the round trip", key)
+		}
+	}
+}
+
+func TestServerReplicaVersionAndExpiry(t *testing.T) {
+	o, p := startPair(t, FileServerOpts{Versioning: true}, FileServerOpts{Versioning: true})
+	expires := time.Now().Add(time.Hour).Round(time.Second)
+	if err := o.StoreWithOpts("doc", bytes.NewReader([]byte("v1")), WriteOpts{ExpiresAt: expires}); err != nil {
+		t.Fatal(err)
+	}
+	meta := waitForReplica(t, o, p, "doc")
+	if meta.VersionID != o.versionOf("doc") || len(meta.VersionID) == 0 {
+		t.Errorf("replica has version %q, the file %q", meta.VersionID, o.versionOf("doc"))
+	}
+	if !meta.ExpiresAt.Equal(expires) {
+		t.Errorf("replica expires at %s, want %s", meta.ExpiresAt, expires)
+	}
+
+	//a new version replaces the replica, which keeps the old one
+	first := meta.VersionID
+	if err := o.Store("doc", bytes.NewReader([]byte("v2"))); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the second version", func() bool {
+		m, err := p.store.Stat(o.ID, o.hashKey("doc"))
+		meta = m
+		return err == nil && m.VersionID != first
+	})
+	if meta.VersionID != o.versionOf("doc") {
+		t.Errorf("replica has version %q, the file %q", meta.VersionID, o.versionOf("doc"))
+	}
+	if _, err := p.store.StatVersion(o.ID, o.hashKey("doc"), first); err != nil {
+		t.Errorf("expected the replica to keep the first version: %v", err)
+	}
+}
+
+//spaceBackend reports free as the room it has left, nothing
+//until it is set, so its server advertises nothing at first
+type spaceBackend struct {
+	Backend
+	free atomic.Int64
+}
+
+func (b *spaceBackend) Space() (uint64, uint64, error) {
+	free := b.free.Load()
+	if free == 0 {
+		return 0, 0, errSpaceUnknown
+	}
+	return uint64(free), 1 << 30, nil
+}
+
+func TestServerRejection(t *testing.T) {
+	full := &spaceBackend{Backend: NewMemoryBackend()}
+	o, p := startPair(t, FileServerOpts{Backend: full, Quota: Quota{MaxBytes: 256}}, FileServerOpts{})
+
+	//over the quota of the peer, the file is still stored here
+	err := o.Store("big", bytes.NewReader(make([]byte, 1024)))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if !o.store.Has(o.ID, "big") {
+		t.Error("expected the file to be stored locally")
+	}
+	if p.store.Has(o.ID, o.hashKey("big")) {
+		t.Error("expected the peer to turn the file down")
+	}
+
+	//the disk of the peer filled up since it connected
+	full.free.Store(64)
+	err = o.Store("small", bytes.NewReader(make([]byte, 128)))
+	if !errors.Is(err, ErrInsufficientStorage) {
+		t.Errorf("expected ErrInsufficientStorage, got %v", err)
+	}
+
+	//and the peer said so, so nothing is sent to it anymore
+	waitFor(t, "the capacity of the peer", func() bool {
+		return len(o.PeerCapacity()) == 1
+	})
+	if err := o.Store("small", bytes.NewReader(make([]byte, 128))); err != nil {
+		t.Errorf("expected the peer to be skipped, got %v", err)
+	}
+	if p.store.Has(o.ID, o.hashKey("small")) {
+		t.Error("expected the peer to have no replica")
+	}
+}
+
+func TestServerRejectsInternalIDs(t *testing.T) {
+	o, p := startPair(t, FileServerOpts{}, FileServerOpts{})
+	peer := o.peerList()[0]
+
+	for _, id := range []string{chunkNamespace(o.ID), versionNamespace(o.ID), tombstoneNamespace(o.ID), p.ID} {
+		msg := Message{
+			Payload: MessageStoreFile{ID: id, Key: "forged", Size: 4},
+		}
+		if err := o.sendTo(peer, &msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//handled one after another, so the forged ones were handled by now
+	if err := o.Store("real", bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal(err)
+	}
+	waitForReplica(t, o, p, "real")
+	if ids, _ := p.store.Backend.IDs(); len(ids) != 1 || ids[0] != o.ID {
+		t.Errorf("peer stored under %v", ids)
+	}
+
+	//reads of an internal ID get an empty answer
+	if _, _, err := o.fetchObject(chunkNamespace(o.ID), "a", "", 0, 0); err == nil {
+		t.Error("expected nothing to be served from a chunk area")
+	}
+	page, err := o.listPeer(peer, &Message{Payload: MessageListKeys{ID: versionNamespace(o.ID)}})
+	if err != nil || len(page.Objects) != 0 {
+		t.Errorf("expected an empty page, got %v (%v)", page.Objects, err)
+	}
+}
+
+func TestServerMixedChunking(t *testing.T) {
+	data := make([]byte, 300<<10)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	for _, tc := range []struct {
+		name         string
+		origin, peer bool
+	}{
+		{"plain origin, chunking peer", false, true},
+		{"chunking origin, plain peer", true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o, p := startPair(t, FileServerOpts{Chunking: tc.peer}, FileServerOpts{Chunking: tc.origin})
+			read := reader(t)
+			if err := o.Store("file", bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			//a replica is chunked only when the owner sent its chunks
+			if meta := waitForReplica(t, o, p, "file"); meta.Chunked != tc.origin {
+				t.Errorf("replica chunked is %v, the owner chunks %v", meta.Chunked, tc.origin)
+			}
+			if err := o.store.Delete(o.ID, "file"); err != nil {
+				t.Fatal(err)
+			}
+			if have := read(o.Get("file")); !bytes.Equal(have, data) {
+				t.Error("file does not match after the round trip")
+			}
+			if have := read(o.GetRange("file", 1000, 5000)); !bytes.Equal(have, data[1000:6000]) {
+				t.Error("range does not match after the round trip")
+			}
+		})
+	}
+}
+
+//scriptedPeer answers every request with the bytes of r
+type scriptedPeer struct {
+	net.Conn
+	r io.Reader
+}
+
+func (p *scriptedPeer) Read(b []byte) (int, error)          { return p.r.Read(b) }
+func (p *scriptedPeer) Send([]byte) error                   { return nil }
+func (p *scriptedPeer) Hold(fn func(io.Writer) error) error { return fn(io.Discard) }
+func (p *scriptedPeer) WaitStream(time.Duration) error      { return nil }
+func (p *scriptedPeer) CloseStream()                        {}
+
+func TestServerBadLengths(t *testing.T) {
+	s := NewFileServer(FileServerOpts{Backend: NewMemoryBackend()})
+	answer := func(n int64) p2p.Peer {
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.LittleEndian, n)
+		return &scriptedPeer{r: buf}
+	}
+
+	//turned down before anything is allocated, a panic or
+	//running out of memory otherwise
+	for _, n := range []int64{-1, 1 << 62} {
+		if _, err := s.missingChunks(answer(n), []string{"a"}); err == nil {
+			t.Errorf("(%d) expected the chunk answer to be turned down", n)
+		}
+		if _, err := s.listPeer(answer(n), &Message{Payload: MessageListKeys{ID: s.ID}}); err == nil {
+			t.Errorf("(%d) expected the page to be turned down", n)
+		}
+	}
+
+	spans := new(bytes.Buffer)
+	binary.Write(spans, binary.LittleEndian, uint32(1<<31))
+	if _, err := newChunkDecryptReader(nil, spans); err == nil {
+		t.Error("expected the span list to be turned down")
+	}
+}
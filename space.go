@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/Hemansh24/HyperFS/p2p"
+)
+
+//ErrInsufficientStorage is returned for a write the disk has no room
+//for, nothing is written when it is
+var ErrInsufficientStorage = errors.New("insufficient storage")
+
+//errSpaceUnknown is returned by a backend that can't tell how much room it has
+var errSpaceUnknown = errors.New("free space is not known")
+
+//spaceReporter is a backend that knows how much room its disks have left
+type spaceReporter interface{
+	Space() (free uint64, total uint64, err error)
+}
+
+//Capacity is how much room a node has left for files
+type Capacity struct{
+	//Free is what can still be written, MinFreeSpace taken off
+	Free 	uint64
+	Total 	uint64
+	//Known is false for a backend that can't tell, say one in memory
+	Known 	bool
+}
+
+//existingDir returns dir or the closest folder above it that exists,
+//the root of a backend is only made by its first write
+func existingDir(dir string) string{
+	for{
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir{
+			return dir
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (b *FSBackend) Space() (uint64, uint64, error){
+	return diskSpace(existingDir(b.Root))
+}
+
+func (b *PackBackend) Space() (uint64, uint64, error){
+	return diskSpace(existingDir(b.Dir))
+}
+
+//Space adds up the healthy disks
+func (b *JBODBackend) Space() (uint64, uint64, error){
+	var free, total uint64
+	for _, d := range b.healthy(){
+		f, t, err := diskSpace(d.root)
+		if err != nil{
+			return 0, 0, err
+		}
+		free += f
+		total += t
+	}
+	return free, total, nil
+}
+
+//Space is the room of the first tier, new objects go there
+func (b *TieredBackend) Space() (uint64, uint64, error){
+	sr, ok := b.Tiers[0].Backend.(spaceReporter)
+	if !ok{
+		return 0, 0, fmt.Errorf("tier (%s): %w", b.Tiers[0].Name, errSpaceUnknown)
+	}
+	return sr.Space()
+}
+
+//Capacity reports how much room the backend has left
+func (s *Store) Capacity() (Capacity, error){
+	sr, ok := s.Backend.(spaceReporter)
+	if !ok{
+		return Capacity{}, nil
+	}
+	free, total, err := sr.Space()
+	if errors.Is(err, errSpaceUnknown){
+		return Capacity{}, nil
+	}
+	if err != nil{
+		return Capacity{}, err
+	}
+
+	c := Capacity{Total: total, Known: true}
+	if free > uint64(s.MinFreeSpace){
+		c.Free = free - uint64(s.MinFreeSpace)
+	}
+	return c, nil
+}
+
+//spaceRoom returns how many bytes a write may have before the disk is
+//down to MinFreeSpace, -1 if that isn't known, or ErrInsufficientStorage
+//if there is no room at all
+func (s *Store) spaceRoom() (int64, error){
+	c, err := s.Capacity()
+	if err != nil || !c.Known{
+		//a disk that can't be asked fails the write itself if it is full
+		return -1, nil
+	}
+	if c.Free == 0{
+		return 0, errSpace(0)
+	}
+	return int64(min(c.Free, math.MaxInt64)), nil
+}
+
+//checkSpace fails with ErrInsufficientStorage if size
+//bytes don't fit on the disk
+func (s *Store) checkSpace(size int64) error{
+	room, err := s.spaceRoom()
+	if err != nil{
+		return err
+	}
+	if room >= 0 && size > room{
+		return errSpace(room)
+	}
+	return nil
+}
+
+//minRoom returns the tighter of two limits, where -1 is no limit
+func minRoom(a int64, b int64) int64{
+	if a < 0 || (b >= 0 && b < a){
+		return b
+	}
+	return a
+}
+
+func errSpace(room int64) error{
+	return fmt.Errorf("only (%d) bytes of storage left: %w", room, ErrInsufficientStorage)
+}
+
+//noSpace turns a disk that filled up under a write
+//into ErrInsufficientStorage
+func noSpace(err error) error{
+	if errors.Is(err, syscall.ENOSPC) && !errors.Is(err, ErrInsufficientStorage){
+		return fmt.Errorf("%w: %s", ErrInsufficientStorage, err)
+	}
+	return err
+}
+
+//MessageCapacity advertises how much room the sender has
+//left, so the peers don't send it files it can't store
+type MessageCapacity struct{
+	Free 	uint64
+	Total 	uint64
+}
+
+//Capacity reports how much room this server has left
+func (s *FileServer) Capacity() (Capacity, error){
+	return s.store.Capacity()
+}
+
+//PeerCapacity returns the room every peer advertised last, by address
+func (s *FileServer) PeerCapacity() map[string]Capacity{
+	s.capacityLock.Lock()
+	defer s.capacityLock.Unlock()
+
+	capacities := make(map[string]Capacity, len(s.capacities))
+	for addr, c := range s.capacities{
+		capacities[addr] = c
+	}
+	return capacities
+}
+
+//advertiseCapacity sends the room this server has left to
+//the peers, to every peer when none are given
+func (s *FileServer) advertiseCapacity(peers ...p2p.Peer){
+	c, err := s.store.Capacity()
+	if err != nil{
+		log.Printf("[%s] reading the free space failed: %s", s.Transport.Addr(), err)
+		return
+	}
+	if !c.Known{
+		return
+	}
+
+	if len(peers) == 0{
+		peers = s.peerList()
+	}
+	msg := Message{
+		Payload: MessageCapacity{Free: c.Free, Total: c.Total},
+	}
+	for _, peer := range peers{
+		if err := s.sendTo(peer, &msg); err != nil{
+			log.Printf("advertising capacity to peer %s failed: %s", peer.RemoteAddr(), err)
+		}
+	}
+}
+
+//StartCapacityAdverts advertises the room this server has left to
+//every peer every interval (a minute if it is not set) until the
+//server is stopped. New peers are told when they connect.
+func (s *FileServer) StartCapacityAdverts(interval time.Duration){
+	if interval <= 0{
+		interval = time.Minute
+	}
+
+	go func(){
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for{
+			select{
+			case <- ticker.C:
+				s.advertiseCapacity()
+
+			case <- s.qiutch:
+				return
+			}
+		}
+	}()
+}
+
+func (s *FileServer) handleMessageCapacity(from string, msg MessageCapacity) error{
+	s.capacityLock.Lock()
+	defer s.capacityLock.Unlock()
+
+	s.capacities[from] = Capacity{Free: msg.Free, Total: msg.Total, Known: true}
+	return nil
+}
+
+//hasRoom tells whether the peer advertised room for size bytes,
+//a peer that didn't advertise anything is given the benefit of the doubt
+func (s *FileServer) hasRoom(peer p2p.Peer, size int64) bool{
+	s.capacityLock.Lock()
+	defer s.capacityLock.Unlock()
+
+	c, ok := s.capacities[peer.RemoteAddr().String()]
+	return !ok || size <= 0 || c.Free >= uint64(size)
+}
+
+//replicaPeers returns the peers that have room for a replica of size bytes
+func (s *FileServer) replicaPeers(size int64) []p2p.Peer{
+	peers := []p2p.Peer{}
+	for _, peer := range s.peerList(){
+		if !s.hasRoom(peer, size){
+			log.Printf("[%s] skipping peer %s, it has no room for (%d) bytes", s.Transport.Addr(), peer.RemoteAddr(), size)
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
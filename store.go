@@ -1,7 +1,7 @@
 package main
 
 import (
-	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -9,18 +9,37 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 const defaultRootFolderName = "ggnetwork"
 
-//Content Addressable Storage
+//files being written carry this extension until they are renamed into place
+const tmpExt = ".tmp"
+
+//Content Addressable Storage, the key is hashed with SHA-256
 func CASPathTransformFunc(key string) PathKey{
+	return casPathKey(SHA256KeyHasher{}.HashKey(key))
+}
+
+//NewCASPathTransformFunc lays keys out by the digest h makes of them,
+//which is the key a FileServer with the same KeyHasher sends for them
+func NewCASPathTransformFunc(h KeyHasher) PathTransformFunc{
+	return func(key string) PathKey{
+		return casPathKey(h.HashKey(key))
+	}
+}
 
-	//hashes the key using sha1
-	hash := sha1.Sum([]byte(key)) //[20]byte -> []byte : [:]
+//DigestPathTransformFunc lays out a key that already is a digest the
+//way the CAS layouts lay out the digest of a key, so a replica stored
+//under the digest is at the path of the file it copies
+func DigestPathTransformFunc(key string) PathKey{
+	return casPathKey(key)
+}
 
-	//make the hash readable into a string
-	hashStr := hex.EncodeToString(hash[:])
+//casPathKey makes folders out of the hex digest of a key
+func casPathKey(hashStr string) PathKey{
 
 	//split the hash into blocks of 5 characters
 	blocksize := 5
@@ -76,11 +95,43 @@ func (p PathKey) FullPath() string{
 
 //options for the store
 type StoreOpts struct {
-	//Root is the folder name of the root, containing
-	//all the folders/files of the system
-	Root 				string
-	
-	PathTransformFunc  	PathTransformFunc
+	//Backend keeps the objects and their metadata, a filesystem
+	//backend under the default root is used when it is nil
+	Backend 			Backend
+
+	//Chunking splits objects into content defined chunks that
+	//are shared between all the keys of an ID
+	Chunking 			bool
+
+	//Codec compresses objects (and chunks) before they go to the
+	//backend, data that doesn't compress is stored as is
+	Codec 				Codec
+
+	//Versioning keeps the old versions of an object when it is
+	//replaced or deleted, until they are pruned
+	Versioning 			bool
+
+	//Quota limits every ID unless Quotas has one of its own for
+	//it, NodeQuota limits all of them together
+	Quota 				Quota
+	Quotas 				map[string]Quota
+	NodeQuota 			Quota
+
+	//Cache limits what the objects the node doesn't own may store
+	Cache 				CacheOpts
+
+	//MinFreeSpace is how many bytes of the disk are kept free, writes
+	//that would eat into them fail with ErrInsufficientStorage
+	MinFreeSpace 		int64
+
+	//NodeKey encrypts everything the backend keeps when it is set,
+	//see EncryptedBackend
+	NodeKey 			[]byte
+
+	//Tombstones records every object removed with Delete until it is
+	//written again, so incremental exports carry the deletion. Cache
+	//evictions and expired objects leave none.
+	Tombstones 			bool
 }
 
 //does not transform the path, just returns the key as is
@@ -94,117 +145,496 @@ var DefaultPathTransformFunc = func(key string) PathKey{
 //the main store structure
 type Store struct {
 	StoreOpts
+
+	//guards the reference counts of the chunk area, and is held while
+	//an object is put in place so its data and metadata agree
+	chunkLock sync.Mutex
+
+	cache *cacheTier
+	usage usageCounter
 }
 
+//WriteOpts are the optional settings of a write
+type WriteOpts struct{
+	//Metadata is kept with the object and returned by Stat
+	Metadata map[string]string
+	//Checksum is the hex encoded sha256 the written bytes must have
+	//before any compression, the write fails with ErrChecksumMismatch
+	//and leaves the old object in place if they don't
+	Checksum string
+	//VersionID is the version ID the object gets when the store keeps
+	//versions, a new one is made up when it is empty
+	VersionID string
+	//ExpiresAt is when the object stops being served and gets
+	//swept, the zero time means never
+	ExpiresAt time.Time
+	//Cached marks a copy of an object the node doesn't own,
+	//the cache tier may evict it
+	Cached bool
+	//Hashed says the key already is the digest a KeyHasher made, a
+	//backend with a layout for those doesn't hash it again
+	Hashed bool
+	//Unchunked stores the object whole even when the store chunks,
+	//a replica is a ciphertext that is only served whole or by range
+	Unchunked bool
+	//EncVersion is recorded with ciphertext copyEncrypt made, for the
+	//object and, written with WriteChunks, for the chunks it sends
+	EncVersion int
+}
+
+var ErrChecksumMismatch = errors.New("object does not match its checksum")
+
 
 //Constructor for strore
 func NewStore(opts StoreOpts) *Store{
 
-	if len(opts.Root) == 0{
-		opts.Root = defaultRootFolderName
+	if opts.Backend == nil{
+		opts.Backend = NewFSBackend(FSBackendOpts{})
 	}
 
-	if opts.PathTransformFunc == nil{
-		opts.PathTransformFunc = DefaultPathTransformFunc
+	if len(opts.NodeKey) > 0{
+		opts.Backend = NewEncryptedBackend(opts.Backend, opts.NodeKey)
 	}
 
-	return &Store{
+	s := &Store{
 		StoreOpts : opts,
+		cache: 		newCacheTier(opts.Cache),
+	}
+	if err := s.loadUsage(); err != nil{
+		log.Printf("adding up the usage failed, it is added up on every write: %s", err)
 	}
+	return s
 }
 
 func (s *Store) Has(id string, key string) bool{
-	pathKey := s.PathTransformFunc(key)
+	_, err := s.Stat(id, key)
+	return err == nil
+}
+
+//Stat returns the metadata of an object. An expired object is
+//gone as far as the store is concerned, even before it is swept.
+func (s *Store) Stat(id string, key string) (ObjectMeta, error){
+	meta, err := s.Backend.Stat(id, key)
+	if err == nil && meta.Expired(time.Now()){
+		return ObjectMeta{}, errExpired(id, key)
+	}
+	return meta, err
+}
 
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+//IDs returns every ID that has objects in the store, leaving out
+//the ones the store uses for itself
+func (s *Store) IDs() ([]string, error){
+	all, err := s.Backend.IDs()
+	if err != nil{
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, id := range all{
+		if !isInternalID(id){
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
 
-	_, err := os.Stat(fullPathWithRoot)
+//isInternalID reports whether id is one the store keeps its own objects
+//under, those are made of a folder name and the ID they belong to
+func isInternalID(id string) bool{
+	return strings.Contains(id, "/")
+}
 
-	return !errors.Is(err, os.ErrNotExist)
+//isInternalFolder reports whether name is a folder an internal ID starts with
+func isInternalFolder(name string) bool{
+	switch name{
+	case chunksFolderName, versionsFolderName, quarantineFolderName, tombstonesFolderName:
+		return true
+	}
+	return false
 }
 
 func (s *Store) Clear() error{
-	return os.RemoveAll(s.Root)
+	defer s.cache.reset()
+	defer s.loadUsage()
+	return s.Backend.Clear()
 }
 
+//Delete removes the object and its metadata, and releases
+//the chunks of a chunked object
 func (s *Store) Delete(id string, key string) error{
-	
-	pathKey := s.PathTransformFunc(key)
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
 
-	defer func (){
-		log.Printf("Deleted [%s] from disk", pathKey.Filename)
-	}()
+	meta, err := s.Backend.Stat(id, key)
+	if errors.Is(err, os.ErrNotExist){
+		return nil
+	}
+	if err != nil{
+		return err
+	}
+	if err := s.deleteObject(meta, s.Versioning); err != nil{
+		return err
+	}
 
-	firstPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FirstPathName())
-	
-	//os.RemoveAll removes the entire directory tree
-	return os.RemoveAll(firstPathNameWithRoot)
+	//only what was deleted on purpose, evictions and expired objects
+	//are this node's business and would delete them on import
+	if s.Tombstones && !isInternalID(id){
+		if err := s.recordDeletion(id, key); err != nil{
+			log.Printf("recording the deletion of [%s] of (%s) failed: %s", key, id, err)
+		}
+	}
+	return nil
+}
+
+//deleteObject deletes the object stored as meta, keeping it as an old
+//version when archive is set. chunkLock must be held.
+func (s *Store) deleteObject(meta ObjectMeta, archive bool) error{
+	id, key := meta.ID, meta.Key
+	if meta.Pinned(){
+		return fmt.Errorf("deleting [%s] of (%s): %w", key, id, ErrPinned)
+	}
+
+	var (
+		m *Manifest
+		err error
+	)
+	switch{
+	case archive:
+		//the old version keeps the chunks
+		if _, err := s.archiveVersion(meta); err != nil{
+			return err
+		}
+	case meta.Chunked:
+		if m, err = s.readManifest(id, key); err != nil{
+			return err
+		}
+	}
+
+	if err := s.Backend.Delete(id, key); err != nil{
+		return err
+	}
+	s.countUsage(id, -meta.Size, -1)
+
+	//the chunks of the object are shared, so they are only
+	//released here and deleted once nothing else uses them
+	if m != nil{
+		s.releaseChunks(id, m)
+	}
+	s.uncache(id, key)
+
+	log.Printf("Deleted [%s] from disk", key)
+	return nil
+}
+
+//DeletePrefix deletes every object of id whose key starts with
+//prefix, except for the pinned ones, and returns how many were deleted
+func (s *Store) DeletePrefix(id string, prefix string) (int, error){
+	metas, err := s.List(id, prefix)
+	if err != nil{
+		return 0, err
+	}
+
+	n := 0
+	for _, meta := range metas{
+		if meta.Pinned(){
+			continue
+		}
+		if err := s.Delete(id, meta.Key); err != nil{
+			return n, err
+		}
+		n++
+	}
+	return n, nil
 }
 
 func (s *Store) Write(id string, key string, r io.Reader) (int64, error){
-	return s.writeStream(id, key, r)
+	return s.WriteWithOpts(id, key, r, WriteOpts{})
+}
+
+func (s *Store) WriteWithOpts(id string, key string, r io.Reader, opts WriteOpts) (int64, error){
+	var (
+		n int64
+		err error
+	)
+	if s.Chunking && !opts.Unchunked{
+		n, err = s.writeChunked(id, key, r, opts)
+	} else{
+		n, err = s.writeFile(id, key, r, opts)
+	}
+	return n, noSpace(err)
 }
 
 func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error){
-	
-	f, err := s.openFileForWriting(id,key)
+	return s.WriteDecryptWithOpts(encKey, id, key, r, WriteOpts{})
+}
+
+//WriteDecryptWithOpts decrypts r into the store, opts.Checksum
+//is checked against the plaintext
+func (s *Store) WriteDecryptWithOpts(encKey []byte, id string, key string, r io.Reader, opts WriteOpts) (int64, error){
+	dr, err := newDecryptReader(encKey, r)
 	if err != nil{
 		return 0, err
 	}
-	defer f.Close()
-	n, err := copyDecrypt(encKey, r, f)
-	return int64(n), err
+
+	//count the header like copyDecrypt does
+	n, err := s.WriteWithOpts(id, key, dr, opts)
+	return n + encHeaderSize, err
 }
 
 func (s *Store) writeStream(id string, key string, r io.Reader) (int64 ,error){
-	f, err := s.openFileForWriting(id, key)
+	return s.writeFile(id, key, r, WriteOpts{})
+}
+
+//writeFile stores r as a single object and records its metadata.
+//Nothing replaces the old object until all of r is written, so
+//a failed write leaves the old one alone.
+func (s *Store) writeFile(id string, key string, r io.Reader, opts WriteOpts) (int64 ,error){
+	//stop reading one byte after the quota or the room left
+	//on the disk, rather than at the commit
+	room, err := s.quotaRoom(id, key)
 	if err != nil{
 		return 0, err
 	}
-	defer f.Close()
-	return io.Copy(f, r)
-}
+	space, err := s.spaceRoom()
+	if err != nil{
+		return 0, err
+	}
+	if limit := minRoom(room, space); limit >= 0{
+		r = io.LimitReader(r, limit + 1)
+	}
+
+	w, err := s.Backend.Put(id, key)
+	if err != nil{
+		return 0, err
+	}
+	defer w.Abort()
 
-func (s *Store) Read(id string, key string) (int64,io.Reader, error){
-	return s.readStream(id, key)
+	codec, r, err := pickCodec(s.Codec, r)
+	if err != nil{
+		return 0, err
+	}
+
+	hash := sha256.New()
+	n, err := encode(codec, w, io.TeeReader(r, hash))
+	if err != nil{
+		return n, err
+	}
+	if room >= 0 && n > room{
+		return n, errQuota(id, key, room)
+	}
+	if space >= 0 && n > space{
+		return n, errSpace(space)
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if len(opts.Checksum) > 0 && opts.Checksum != checksum{
+		return n, fmt.Errorf("writing [%s]: %w", key, ErrChecksumMismatch)
+	}
+
+	meta := ObjectMeta{
+		ID: 		id,
+		Key: 		key,
+		Size: 		n,
+		Checksum: 	checksum,
+		Metadata: 	opts.Metadata,
+		VersionID: 	opts.VersionID,
+		ExpiresAt: 	opts.ExpiresAt,
+		Cached: 	opts.Cached,
+		Hashed: 	opts.Hashed,
+		EncVersion: opts.EncVersion,
+	}
+	if codec != nil{
+		meta.Codec = codec.Name()
+	}
+
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
+
+	return n, s.commitObject(w, meta)
 }
 
-func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error){
-	pathKey := s.PathTransformFunc(key)
-	fullPathKeyWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+//commitObject puts the object in place of whatever was stored under
+//its key. The object keeps its creation time when it is replaced, and
+//the chunks of a chunked object it replaces are released, unless the
+//store keeps the replaced object as an old version.
+//chunkLock must be held.
+func (s *Store) commitObject(w BlobWriter, meta ObjectMeta) error{
+	//checked again now that nothing else can be committed
+	if err := s.checkQuota(meta.ID, meta.Key, meta.Size); err != nil{
+		return err
+	}
+
+	now := time.Now()
+	meta.CreatedAt = now
+	meta.ModifiedAt = now
+
+	if s.Versioning && len(meta.VersionID) == 0{
+		meta.VersionID = newVersionID(now)
+	}
+
+	var (
+		old *Manifest
+		archived string
+		replaced *ObjectMeta
+	)
+	if oldMeta, err := s.Backend.Stat(meta.ID, meta.Key); err == nil{
+		replaced = &oldMeta
+
+		//an expired object is gone, it only wasn't swept yet
+		expired := oldMeta.Expired(now)
+		if !expired{
+			meta.CreatedAt = oldMeta.CreatedAt
+		}
+
+		//the pin is on the key, it stays when the object is replaced
+		if oldMeta.Pinned() && !meta.Pinned(){
+			meta.Metadata = withPin(meta.Metadata, true)
+		}
+
+		//the same version written again replaces itself
+		if s.Versioning && !expired && oldMeta.VersionID != meta.VersionID{
+			if archived, err = s.archiveVersion(oldMeta); err != nil{
+				return err
+			}
+		} else if oldMeta.Chunked{
+			old, _ = s.readManifest(meta.ID, meta.Key)
+		}
+	}
+
+	if err := w.Commit(meta); err != nil{
+		if len(archived) > 0{
+			//it is still the current version, and a copy holding
+			//no references of its own must not be pruned later
+			if s.Backend.Delete(versionNamespace(meta.ID), versionKey(meta.Key, archived)) == nil{
+				s.countUsage(versionNamespace(meta.ID), -replaced.Size, -1)
+			}
+		}
+		return err
+	}
+	s.countUsage(meta.ID, meta.Size, 1)
+	if replaced != nil{
+		s.countUsage(meta.ID, -replaced.Size, -1)
+	}
+	if !isInternalID(meta.ID){
+		if err := s.clearTombstone(meta.ID, meta.Key); err != nil{
+			log.Printf("clearing the tombstone of [%s] of (%s) failed: %s", meta.Key, meta.ID, err)
+		}
+	}
+
+	if old != nil{
+		s.releaseChunks(meta.ID, old)
+	}
+	s.cached(meta)
+	return nil
+}
 
-	file, err := os.Open(fullPathKeyWithRoot)
+//Read streams the whole object. It is checked against the checksum in
+//its metadata as it is read, and the reader fails with
+//ErrChecksumMismatch at the end if the stored data went bad.
+func (s *Store) Read(id string, key string) (int64,io.ReadCloser, error){
+	meta, err := s.Stat(id, key)
 	if err != nil{
 		return 0, nil, err
 	}
 
-	fi, err := file.Stat()
+	s.touch(meta)
+
+	n, r, err := s.readStream(meta)
+	if err != nil || len(meta.Checksum) == 0{
+		return n, r, err
+	}
+
+	v, err := newChecksumReader(r, meta.Checksum)
 	if err != nil{
+		r.Close()
 		return 0, nil, err
 	}
-	return fi.Size(), file, nil
+	return n, &verifiedReadCloser{verifyReader: v, Closer: r}, nil
 }
 
+func (s *Store) readStream(meta ObjectMeta) (int64, io.ReadCloser, error){
+	if meta.Chunked{
+		m, err := s.readManifest(meta.ID, meta.Key)
+		if err != nil{
+			return 0, nil, err
+		}
+		return m.Size, &chunkReader{store: s, id: meta.ID, spans: m.spans(0, 0)}, nil
+	}
 
+	return s.readObjectRange(meta, 0, 0)
+}
 
-func (s *Store) openFileForWriting(id string, key string) (*os.File, error){
-	//transform the key into a path
-	pathKey := s.PathTransformFunc(key)
+//readObjectRange reads a range of what was written to a single object,
+//decompressing it if it is stored compressed
+func (s *Store) readObjectRange(meta ObjectMeta, offset int64, length int64) (int64, io.ReadCloser, error){
+	codec, err := codecByName(meta.Codec)
+	if err != nil{
+		return 0, nil, err
+	}
+	if codec == nil{
+		return s.Backend.ReadRange(meta.ID, meta.Key, offset, length)
+	}
 
-	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
+	n, err := rangeSize(meta.Key, meta.Size, offset, length)
+	if err != nil{
+		return 0, nil, err
+	}
 
-	//MKdirAll makes the directory if it does not exist using
-	//the path name as the directory name
-	//os.ModePerm uses the default permissions which are read write execute
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil{
-		return nil, err
+	_, rc, err := s.Backend.Get(meta.ID, meta.Key)
+	if err != nil{
+		return 0, nil, err
 	}
 
-	fullPath := pathKey.FullPath()
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, fullPath)
+	r, err := codec.NewReader(rc)
+	if err != nil{
+		rc.Close()
+		return 0, nil, err
+	}
 
-	return os.Create(fullPathWithRoot)
+	//there is no seeking into compressed bytes,
+	//everything in front of the range is thrown away
+	if _, err := io.CopyN(io.Discard, r, offset); err != nil{
+		rc.Close()
+		return 0, nil, err
+	}
+	return n, &sectionReadCloser{Reader: io.LimitReader(r, n), Closer: rc}, nil
 }
 
+//ReadRange reads length bytes of the stored file starting at offset.
+//A length of 0 reads until the end of the file. The returned size is
+//the number of bytes the reader will produce.
+func (s *Store) ReadRange(id string, key string, offset int64, length int64) (int64, io.ReadCloser, error){
+	meta, err := s.Stat(id, key)
+	if err != nil{
+		return 0, nil, err
+	}
+	s.touch(meta)
+	return s.readMetaRange(meta, id, offset, length)
+}
 
+//readMetaRange reads a range of the object stored as meta, the chunks
+//of a chunked object are the ones of chunkID. Old versions are stored
+//under another ID than the one of their chunks.
+func (s *Store) readMetaRange(meta ObjectMeta, chunkID string, offset int64, length int64) (int64, io.ReadCloser, error){
+	if !meta.Chunked{
+		return s.readObjectRange(meta, offset, length)
+	}
 
+	m, err := s.readManifest(meta.ID, meta.Key)
+	if err != nil{
+		return 0, nil, err
+	}
+
+	n, err := rangeSize(meta.Key, m.Size, offset, length)
+	if err != nil{
+		return 0, nil, err
+	}
+	return n, &chunkReader{store: s, id: chunkID, spans: m.spans(offset, length)}, nil
+}
+
+//sectionReadCloser limits how much of a file is read while still
+//letting the caller close the underlying file
+type sectionReadCloser struct{
+	io.Reader
+	io.Closer
+}
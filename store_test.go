@@ -2,16 +2,27 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io/ioutil"	
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestPathTransformFunc(t *testing.T) {
 	key := "momsbestpicture"
 	pathKey := CASPathTransformFunc(key)
-	expectedFilename := "6804429f74181a63c50c3d81d733a12f14a353ff"
-	expectedPathName := "68044/29f74/181a6/3c50c/3d81d/733a1/2f14a/353ff"
+	expectedFilename := "b159a9f0a78305c07dbce386598952bfa30b6aabb46a98b072c9195348abf9ea"
+	expectedPathName := "b159a/9f0a7/8305c/07dbc/e3865/98952/bfa30/b6aab/b46a9/8b072/c9195/348ab"
 	if pathKey.PathName != expectedPathName {
 		t.Errorf("have %s want %s", pathKey.PathName, expectedPathName)
 	}
@@ -19,6 +30,16 @@ func TestPathTransformFunc(t *testing.T) {
 	if pathKey.Filename != expectedFilename {
 		t.Errorf("have %s want %s", pathKey.Filename, expectedFilename)
 	}
+
+	//a keyed layout hides the key from anyone without the secret
+	h := HMACKeyHasher{Secret: []byte("secret")}
+	keyed := NewCASPathTransformFunc(h)(key)
+	if keyed.Filename != h.HashKey(key) || keyed.Filename == expectedFilename {
+		t.Errorf("expected the keyed path to be the HMAC of the key, got %s", keyed.Filename)
+	}
+	if other := (HMACKeyHasher{Secret: []byte("other")}).HashKey(key); other == keyed.Filename {
+		t.Error("expected another secret to make another digest")
+	}
 }
 
 func TestStore(t *testing.T) {
@@ -58,15 +79,1195 @@ func TestStore(t *testing.T) {
 	}
 }
 
+func TestStoreReadRange(t *testing.T) {
+	fs := NewFSBackend(FSBackendOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	s := NewStore(StoreOpts{Backend: fs})
+	id := generateID()
+	data := []byte("0123456789abcdef")
+
+	if _, err := s.Write(id, "range", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, 0, "0123456789abcdef"},
+		{4, 4, "4567"},
+		{10, 0, "abcdef"},
+		{12, 100, "cdef"},
+		{16, 0, ""},
+	}
+
+	for _, tt := range tests {
+		n, r, err := s.ReadRange(id, "range", tt.offset, tt.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, _ := ioutil.ReadAll(r)
+		r.Close()
+
+		if string(b) != tt.want || n != int64(len(tt.want)) {
+			t.Errorf("have %s (%d) want %s", b, n, tt.want)
+		}
+	}
+
+	if _, _, err := s.ReadRange(id, "range", 17, 0); err == nil {
+		t.Error("expected an error reading past the end of the file")
+	}
+}
+
+func TestStoreChunkedDedup(t *testing.T) {
+	fs := NewFSBackend(FSBackendOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	s := NewStore(StoreOpts{Backend: fs, Chunking: true})
+	id := generateID()
+
+	data := make([]byte, 512*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	if _, err := s.Write(id, "a", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(id, "b", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := s.readManifest(id, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err := s.ReadRange(id, "b", 1000, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(b, data[1000:101000]) {
+		t.Error("range of chunked object does not match")
+	}
+
+	//both keys share the chunks, deleting one must keep them around
+	if err := s.Delete(id, "a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range m.Chunks {
+		if !s.HasChunk(id, c.Hash) {
+			t.Fatalf("chunk %s deleted while still in use", c.Hash)
+		}
+	}
+
+	_, r, err = s.Read(id, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(b, data) {
+		t.Error("chunked object does not match after deleting its twin")
+	}
+
+	if err := s.Delete(id, "b"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range m.Chunks {
+		if s.HasChunk(id, c.Hash) {
+			t.Errorf("chunk %s still on disk after its last user was deleted", c.Hash)
+		}
+	}
+}
+
+func TestStoreChunkedSlowWriter(t *testing.T) {
+	s := NewStore(StoreOpts{Backend: NewMemoryBackend(), Chunking: true})
+	id := generateID()
+
+	data := make([]byte, 512*1024)
+	rand.New(rand.NewSource(3)).Read(data)
+
+	//a write still waiting for its input doesn't hold up the others
+	pr, pw := io.Pipe()
+	done := make(chan error)
+	go func() {
+		_, err := s.Write(id, "slow", pr)
+		done <- err
+	}()
+	if _, err := pw.Write(data[:len(data)/2]); err != nil {
+		t.Fatal(err)
+	}
+
+	finished := make(chan error)
+	go func() {
+		if _, err := s.Write(id, "fast", bytes.NewReader(data)); err != nil {
+			finished <- err
+			return
+		}
+		//the chunks the slow write already has must outlive this
+		finished <- s.Delete(id, "fast")
+	}()
+	select {
+	case err := <-finished:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked behind a write waiting for its input")
+	}
+
+	pw.Write(data[len(data)/2:])
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err := s.Read(id, "slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(b, data) {
+		t.Error("slow write does not match")
+	}
+}
+
+func TestStoreWriteChunks(t *testing.T) {
+	src := NewStore(StoreOpts{Backend: NewMemoryBackend(), Chunking: true})
+	dst := NewStore(StoreOpts{Backend: NewMemoryBackend()})
+	id := generateID()
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+	if _, err := src.Write(id, "a", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	m, err := src.readManifest(id, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the chunks as they would go over the network, with their checksums
+	stream := new(bytes.Buffer)
+	missing := []ChunkRef{}
+	for _, hash := range m.uniqueHashes() {
+		_, r, err := src.readChunkRange(id, hash, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk, _ := io.ReadAll(r)
+		r.Close()
+
+		sum := sha256.Sum256(chunk)
+		missing = append(missing, ChunkRef{Hash: hash, Size: int64(len(chunk)), Checksum: hex.EncodeToString(sum[:])})
+		stream.Write(chunk)
+	}
+
+	//a chunk that went bad on the way fails the whole object
+	bad := bytes.Clone(stream.Bytes())
+	bad[len(bad)-1] ^= 0xff
+	err = dst.WriteChunks(id, "a", m, missing, bytes.NewReader(bad), WriteOpts{})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if dst.Has(id, "a") {
+		t.Error("object stored from a bad chunk")
+	}
+	for _, c := range missing {
+		if dst.HasChunk(id, c.Hash) {
+			t.Errorf("chunk %s left behind by the failed write", c.Hash)
+		}
+	}
+
+	if err := dst.WriteChunks(id, "a", m, missing, stream, WriteOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := dst.Read(id, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(have, data) {
+		t.Error("object does not match after its chunks were written")
+	}
+}
+
+func TestStoreIndex(t *testing.T) {
+	opts := FSBackendOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	}
+	fs := NewFSBackend(opts)
+	s := NewStore(StoreOpts{Backend: fs})
+	id := generateID()
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("dir/file_%d", i)
+		wopts := WriteOpts{Metadata: map[string]string{"n": fmt.Sprint(i)}}
+		if _, err := s.WriteWithOpts(id, key, bytes.NewReader([]byte(key)), wopts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete(id, "dir/file_3"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(s *Store) {
+		meta, err := s.Stat(id, "dir/file_7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Size != int64(len("dir/file_7")) || meta.Metadata["n"] != "7" || len(meta.Checksum) != 64 {
+			t.Errorf("unexpected metadata %+v", meta)
+		}
+		if s.Has(id, "dir/file_3") {
+			t.Error("deleted key is still in the index")
+		}
+	}
+
+	//the journal survives a restart, even with a torn record at the end
+	f, err := os.OpenFile(fs.index.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"Op":"put","Meta":{"ID":`))
+	f.Close()
+	check(NewStore(StoreOpts{Backend: NewFSBackend(opts)}))
+
+	//without the journal the index is rebuilt from the metadata files
+	if err := os.Remove(fs.index.path); err != nil {
+		t.Fatal(err)
+	}
+	check(NewStore(StoreOpts{Backend: NewFSBackend(opts)}))
+}
+
+func TestStoreList(t *testing.T) {
+	fs := NewFSBackend(FSBackendOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	s := NewStore(StoreOpts{Backend: fs})
+	id := generateID()
+
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("photos/%02d.jpg", i)
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Write(id, "notes.txt", bytes.NewReader([]byte("notes"))); err != nil {
+		t.Fatal(err)
+	}
+
+	metas, err := s.List(id, "photos/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 25 || metas[0].Key != "photos/00.jpg" || metas[24].Key != "photos/24.jpg" {
+		t.Fatalf("unexpected listing of %d keys", len(metas))
+	}
+
+	page, next, err := s.ListPage(id, "photos/", "photos/09.jpg", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 10 || page[0].Key != "photos/10.jpg" || next != "photos/19.jpg" {
+		t.Fatalf("unexpected page starting at %s, next cursor %s", page[0].Key, next)
+	}
+
+	keys := []string{}
+	it := s.Iterate(id, "photos/", 7)
+	for it.Next() {
+		keys = append(keys, it.Meta().Key)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 25 || keys[24] != "photos/24.jpg" {
+		t.Errorf("iterator returned %d keys", len(keys))
+	}
+}
+
+func TestStoreDelete(t *testing.T) {
+	fs := NewFSBackend(FSBackendOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: DefaultPathTransformFunc,
+	})
+	s := NewStore(StoreOpts{Backend: fs})
+	id := generateID()
+
+	//with the default transform "docs" lives in a folder above the other keys
+	keys := []string{"docs", "docs/a", "docs/b", "pics/c"}
+	for _, key := range keys {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Delete(id, "docs"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys[1:] {
+		if _, r, err := s.Read(id, key); err != nil {
+			t.Errorf("deleting docs took %s with it: %s", key, err)
+		} else {
+			r.Close()
+		}
+	}
+
+	n, err := s.DeletePrefix(id, "docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || s.Has(id, "docs/a") || !s.Has(id, "pics/c") {
+		t.Errorf("DeletePrefix deleted %d keys", n)
+	}
+	if _, err := os.Stat(filepath.Join(fs.Root, id, "docs")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("empty folders were not pruned")
+	}
+
+	if err := s.Delete(id, "pics/c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(fs.Root, id)); !errors.Is(err, os.ErrNotExist) {
+		t.Error("folder of the ID was not pruned")
+	}
+}
+
+func TestStoreChecksum(t *testing.T) {
+	fs := NewFSBackend(FSBackendOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	s := NewStore(StoreOpts{Backend: fs})
+	id := generateID()
+	key := "ledger.csv"
+	data := []byte("a,b,c\n1,2,3\n")
+
+	sum := sha256.Sum256([]byte("something else"))
+	_, err := s.WriteWithOpts(id, key, bytes.NewReader(data), WriteOpts{Checksum: hex.EncodeToString(sum[:])})
+	if !errors.Is(err, ErrChecksumMismatch) || s.Has(id, key) {
+		t.Fatalf("write with a wrong checksum was kept: %v", err)
+	}
+
+	if _, err := s.Write(id, key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(id, key, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	//flip a byte on disk
+	path := filepath.Join(fs.Root, id, CASPathTransformFunc(key).FullPath())
+	b, _ := os.ReadFile(path)
+	b[0] ^= 0xff
+	os.WriteFile(path, b, 0644)
+
+	_, r, err := s.Read(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(r)
+	r.Close()
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("reading a corrupted object gave %v", err)
+	}
+	if err := s.Verify(id, key, 1<<20); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("verify gave %v", err)
+	}
+
+	if err := s.Quarantine(id, key); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, key) {
+		t.Error("quarantined object is still in the index")
+	}
+	if _, err := os.Stat(filepath.Join(fs.Root, quarantineFolderName, id, CASPathTransformFunc(key).FullPath())); err != nil {
+		t.Error(err)
+	}
+}
+
+type failingReader struct {
+	n int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := min(len(p), r.n)
+	r.n -= n
+	return n, nil
+}
+
+func TestStoreAtomicWrite(t *testing.T) {
+	fs := NewFSBackend(FSBackendOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	s := NewStore(StoreOpts{Backend: fs})
+	id := generateID()
+	key := "report.pdf"
+
+	if _, err := s.Write(id, key, bytes.NewReader([]byte("old contents"))); err != nil {
+		t.Fatal(err)
+	}
+
+	//a write that fails half way leaves the old object in place
+	if _, err := s.Write(id, key, &failingReader{n: 4096}); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	_, r, err := s.Read(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if string(b) != "old contents" {
+		t.Fatalf("have %q after a failed write", b)
+	}
+
+	//concurrent writers never mix their data
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte('a' + i)}, 1<<16)
+			if _, err := s.Write(id, key, bytes.NewReader(data)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	_, r, err = s.Read(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = io.ReadAll(r)
+	r.Close()
+	if len(b) != 1<<16 || !bytes.Equal(b, bytes.Repeat(b[:1], 1<<16)) {
+		t.Fatal("object holds data of more than one writer")
+	}
+	meta, _ := s.Stat(id, key)
+	sum := sha256.Sum256(b)
+	if meta.Checksum != hex.EncodeToString(sum[:]) {
+		t.Error("index doesn't match the object on disk")
+	}
+
+	tmps, _ := filepath.Glob(filepath.Join(fs.Root, id, "*", "*", "*", "*", "*", "*", "*", "*", "*"+tmpExt))
+	if len(tmps) > 0 {
+		t.Errorf("temporary files left behind: %v", tmps)
+	}
+}
+
 func newStore() *Store {
-	opts := StoreOpts{
+	opts := FSBackendOpts{
 		PathTransformFunc: CASPathTransformFunc,
 	}
-	return NewStore(opts)
+	return NewStore(StoreOpts{Backend: NewFSBackend(opts)})
 }
 
 func teardown(t *testing.T, s *Store) {
 	if err := s.Clear(); err != nil {
 		t.Error(err)
 	}
-}
\ No newline at end of file
+}
+func TestStoreCodec(t *testing.T) {
+	fs := NewFSBackend(FSBackendOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	s := NewStore(StoreOpts{Backend: fs, Codec: GzipCodec{}})
+	id := generateID()
+
+	text := bytes.Repeat([]byte("0123456789 compressible text\n"), 2000)
+	noise := make([]byte, 16*1024)
+	rand.New(rand.NewSource(3)).Read(noise)
+
+	if _, err := s.Write(id, "text", bytes.NewReader(text)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(id, "noise", bytes.NewReader(noise)); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, _ := s.Stat(id, "text")
+	info, err := os.Stat(filepath.Join(fs.Root, meta.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Codec != "gzip" || meta.Size != int64(len(text)) || info.Size() >= meta.Size/10 {
+		t.Errorf("text is not compressed: %+v, %d bytes on disk", meta, info.Size())
+	}
+	if meta, _ := s.Stat(id, "noise"); len(meta.Codec) > 0 {
+		t.Errorf("incompressible data was compressed with %s", meta.Codec)
+	}
+
+	n, r, err := s.Read(id, "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || n != int64(len(text)) || !bytes.Equal(have, text) {
+		t.Fatalf("read back %d bytes: %v", len(have), err)
+	}
+
+	n, r, err = s.ReadRange(id, "text", 1000, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, _ = io.ReadAll(r)
+	r.Close()
+	if n != 50 || !bytes.Equal(have, text[1000:1050]) {
+		t.Errorf("have range %q", have)
+	}
+
+	if err := s.Verify(id, "text", 0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStoreVersions(t *testing.T) {
+	for _, chunking := range []bool{false, true} {
+		t.Run(fmt.Sprintf("chunking=%v", chunking), func(t *testing.T) {
+			b := NewFSBackend(FSBackendOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+			s := NewStore(StoreOpts{Backend: b, Chunking: chunking, Versioning: true})
+			id := generateID()
+
+			for i := 0; i < 4; i++ {
+				data := fmt.Sprintf("version %d", i)
+				if _, err := s.Write(id, "doc", bytes.NewReader([]byte(data))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			versions, err := s.ListVersions(id, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(versions) != 4 || !versions[0].Current || versions[1].Current {
+				t.Fatalf("have versions %+v", versions)
+			}
+
+			//newest first, so the last one is the first version written
+			_, r, err := s.ReadVersion(id, "doc", versions[3].VersionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			have, _ := io.ReadAll(r)
+			r.Close()
+			if string(have) != "version 0" {
+				t.Errorf("have %q for the first version", have)
+			}
+
+			pruned, err := s.PruneVersions(id, "doc", RetentionPolicy{KeepLast: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pruned) != 2 || pruned[0] != versions[2].VersionID {
+				t.Errorf("pruned %v", pruned)
+			}
+			if _, _, err := s.ReadVersion(id, "doc", versions[3].VersionID); err == nil {
+				t.Error("pruned version can still be read")
+			}
+
+			//deleting keeps the deleted version around as an old one
+			if err := s.Delete(id, "doc"); err != nil {
+				t.Fatal(err)
+			}
+			if s.Has(id, "doc") {
+				t.Error("deleted object is still there")
+			}
+			_, r, err = s.ReadVersion(id, "doc", versions[0].VersionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			have, _ = io.ReadAll(r)
+			r.Close()
+			if string(have) != "version 3" {
+				t.Errorf("have %q for the deleted version", have)
+			}
+
+			pruned, _ = s.PruneVersions(id, "doc", RetentionPolicy{KeepFor: time.Nanosecond})
+			if len(pruned) != 2 {
+				t.Errorf("pruned %v for being too old", pruned)
+			}
+			if ids, _ := b.IDs(); len(ids) != 0 {
+				t.Errorf("left behind once every version is gone: %v", ids)
+			}
+		})
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	for _, chunking := range []bool{false, true} {
+		s := NewStore(StoreOpts{Backend: NewMemoryBackend(), Chunking: chunking})
+		id := generateID()
+
+		expiresAt := time.Now().Add(50 * time.Millisecond)
+		if _, err := s.WriteWithOpts(id, "tmp", bytes.NewReader([]byte("build artifact")), WriteOpts{ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Write(id, "kept", bytes.NewReader([]byte("kept forever"))); err != nil {
+			t.Fatal(err)
+		}
+
+		meta, err := s.Stat(id, "tmp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !meta.ExpiresAt.Equal(expiresAt) {
+			t.Errorf("expected expiration %s, got %s", expiresAt, meta.ExpiresAt)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		//expired objects are hidden before they are swept
+		if s.Has(id, "tmp") {
+			t.Error("expected the expired object to be hidden")
+		}
+		if _, _, err := s.Read(id, "tmp"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected a not exist error, got %v", err)
+		}
+		metas, err := s.List(id, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metas) != 1 || metas[0].Key != "kept" {
+			t.Errorf("expected only the kept object to be listed, got %v", metas)
+		}
+		if _, err := s.Backend.Stat(id, "tmp"); err != nil {
+			t.Errorf("expected the expired object to stay in the backend until swept: %s", err)
+		}
+
+		swept, err := s.SweepExpired()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(swept) != 1 || swept[0].Key != "tmp" {
+			t.Errorf("expected the expired object to be swept, got %v", swept)
+		}
+		if _, err := s.Backend.Stat(id, "tmp"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected the swept object to be gone, got %v", err)
+		}
+		if !s.Has(id, "kept") {
+			t.Error("expected the object without expiration to be kept")
+		}
+		if chunking {
+			chunks, err := s.Backend.List(chunkNamespace(id), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chunks) != 1 {
+				t.Errorf("expected only the chunk of the kept object to be left, got %d", len(chunks))
+			}
+		}
+	}
+}
+
+func TestStoreQuota(t *testing.T) {
+	for _, chunking := range []bool{false, true} {
+		id, other := generateID(), generateID()
+		s := NewStore(StoreOpts{
+			Backend:  NewMemoryBackend(),
+			Chunking: chunking,
+			Quotas:   map[string]Quota{id: {MaxBytes: 10, MaxObjects: 2}},
+		})
+
+		write := func(id string, key string, data string) error {
+			_, err := s.Write(id, key, bytes.NewReader([]byte(data)))
+			return err
+		}
+
+		if err := write(id, "a", "aaaaaa"); err != nil {
+			t.Fatal(err)
+		}
+		if err := write(id, "b", "bbbbbb"); !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("expected the bytes quota to be exceeded, got %v", err)
+		}
+		if s.Has(id, "b") {
+			t.Error("expected the write over the quota to leave nothing behind")
+		}
+
+		//replacing an object makes room for it
+		if err := write(id, "a", "aaaaaaaaa"); err != nil {
+			t.Fatal(err)
+		}
+		if err := write(id, "b", "b"); err != nil {
+			t.Fatal(err)
+		}
+		if err := write(id, "c", ""); !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("expected the objects quota to be exceeded, got %v", err)
+		}
+
+		//other IDs have no quota
+		if err := write(other, "a", "a long object without any limit"); err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := s.Usage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u := report.IDs[id]; u.Bytes != 10 || u.Objects != 2 {
+			t.Errorf("expected 10 bytes in 2 objects, got %+v", u)
+		}
+		if report.Node.Objects != 3 {
+			t.Errorf("expected 3 objects on the node, got %d", report.Node.Objects)
+		}
+	}
+
+	s := NewStore(StoreOpts{Backend: NewMemoryBackend(), NodeQuota: Quota{MaxObjects: 1}})
+	if _, err := s.Write(generateID(), "a", bytes.NewReader([]byte("a"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(generateID(), "a", bytes.NewReader([]byte("a"))); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected the node quota to be exceeded, got %v", err)
+	}
+}
+
+func TestStoreUsageCounters(t *testing.T) {
+	for _, chunking := range []bool{false, true} {
+		b := NewMemoryBackend()
+		s := NewStore(StoreOpts{Backend: b, Chunking: chunking, Versioning: true})
+		id, other := generateID(), generateID()
+
+		//the counters have to agree with what is actually stored
+		check := func(step string) {
+			t.Helper()
+			have, err := s.Usage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := s.scanUsage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(have, want) {
+				t.Errorf("chunking=%v, after %s: counted %+v, stored %+v", chunking, step, have, want)
+			}
+		}
+
+		for i := 0; i < 3; i++ {
+			if _, err := s.Write(id, "doc", bytes.NewReader(bytes.Repeat([]byte("v"), i+1))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := s.Write(other, "doc", bytes.NewReader([]byte("other"))); err != nil {
+			t.Fatal(err)
+		}
+		check("replacing")
+
+		versions, err := s.ListVersions(id, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteVersion(id, "doc", versions[len(versions)-1].VersionID); err != nil {
+			t.Fatal(err)
+		}
+		check("deleting a version")
+
+		if err := s.Delete(id, "doc"); err != nil {
+			t.Fatal(err)
+		}
+		check("deleting")
+
+		if err := s.Quarantine(other, "doc"); err != nil {
+			t.Fatal(err)
+		}
+		check("quarantining")
+
+		//opened again they start from what is stored
+		reopened := NewStore(StoreOpts{Backend: b, Chunking: chunking, Versioning: true})
+		have, _ := reopened.Usage()
+		want, _ := s.Usage()
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("reopened with %+v, had %+v", have, want)
+		}
+
+		if err := s.Clear(); err != nil {
+			t.Fatal(err)
+		}
+		check("clearing")
+	}
+}
+
+func TestStoreCache(t *testing.T) {
+	s := NewStore(StoreOpts{Backend: NewMemoryBackend(), Cache: CacheOpts{MaxBytes: 12}})
+	id := generateID()
+
+	write := func(key string, opts WriteOpts) {
+		if _, err := s.WriteWithOpts(id, key, bytes.NewReader([]byte("data")), opts); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	write("owned", WriteOpts{})
+	write("pinned", WriteOpts{Cached: true, Metadata: map[string]string{pinnedKey: "true"}})
+	write("a", WriteOpts{Cached: true})
+	write("b", WriteOpts{Cached: true})
+
+	_, r, err := s.Read(id, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	//b was used the longest time ago and the pinned object never goes
+	write("c", WriteOpts{Cached: true})
+
+	for _, key := range []string{"owned", "pinned", "a", "c"} {
+		if !s.Has(id, key) {
+			t.Errorf("expected (%s) to be kept", key)
+		}
+	}
+	if s.Has(id, "b") {
+		t.Error("expected the least recently used object to be evicted")
+	}
+
+	stats, err := s.CacheStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Evictions != 1 || stats.Objects != 3 || stats.Bytes != 12 {
+		t.Errorf("unexpected cache stats %+v", stats)
+	}
+}
+
+func TestStorePin(t *testing.T) {
+	s := NewStore(StoreOpts{Backend: NewMemoryBackend(), Versioning: true})
+	id := generateID()
+
+	write := func(key string, data string, opts WriteOpts) {
+		if _, err := s.WriteWithOpts(id, key, bytes.NewReader([]byte(data)), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("pinned", "v1", WriteOpts{Metadata: map[string]string{"owner": "ci"}})
+	write("expiring", "data", WriteOpts{ExpiresAt: time.Now().Add(-time.Second)})
+	write("other", "data", WriteOpts{})
+
+	for _, key := range []string{"pinned", "expiring"} {
+		if err := s.Pin(id, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Delete(id, "pinned"); !errors.Is(err, ErrPinned) {
+		t.Errorf("expected deleting a pinned object to fail with ErrPinned, got %v", err)
+	}
+	if n, err := s.DeletePrefix(id, ""); err != nil || n != 1 {
+		t.Errorf("expected only the unpinned object to be deleted, got %d, %v", n, err)
+	}
+	if swept, err := s.SweepExpired(); err != nil || len(swept) != 0 {
+		t.Errorf("expected the pinned object not to be swept, got %v, %v", swept, err)
+	}
+
+	//the pin stays with the key, the old version doesn't keep it
+	write("pinned", "v2", WriteOpts{})
+	meta, err := s.Stat(id, "pinned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Pinned() {
+		t.Error("expected the pin to survive the object being replaced")
+	}
+	if _, err := s.PruneVersions(id, "pinned", RetentionPolicy{KeepLast: 1}); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := s.ListVersions(id, "pinned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[1].Pinned() || versions[1].Metadata["owner"] != "ci" {
+		t.Errorf("expected an unpinned old version keeping its metadata, got %+v", versions)
+	}
+
+	if err := s.Unpin(id, "pinned"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(id, "pinned"); err != nil {
+		t.Errorf("expected an unpinned object to be deleted, got %v", err)
+	}
+}
+
+// fullBackend is a backend in memory that says it has free bytes left
+type fullBackend struct {
+	*MemoryBackend
+	free uint64
+}
+
+func (b *fullBackend) Space() (uint64, uint64, error) {
+	return b.free, 1000, nil
+}
+
+func TestStoreSpace(t *testing.T) {
+	for _, chunking := range []bool{false, true} {
+		b := &fullBackend{MemoryBackend: NewMemoryBackend(), free: 110}
+		s := NewStore(StoreOpts{Backend: b, Chunking: chunking, MinFreeSpace: 100})
+		id := generateID()
+
+		if _, err := s.Write(id, "a", bytes.NewReader([]byte("aaaaa"))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Write(id, "b", bytes.NewReader([]byte("bbbbbbbbbbbb"))); !errors.Is(err, ErrInsufficientStorage) {
+			t.Errorf("expected the write to eat into the free space to fail, got %v", err)
+		}
+		if s.Has(id, "b") {
+			t.Error("expected the write without room to leave nothing behind")
+		}
+
+		c, err := s.Capacity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.Known || c.Free != 10 || c.Total != 1000 {
+			t.Errorf("expected 10 of 1000 bytes free, got %+v", c)
+		}
+
+		b.free = 100
+		if _, err := s.Write(id, "c", bytes.NewReader(nil)); !errors.Is(err, ErrInsufficientStorage) {
+			t.Errorf("expected a full disk to turn down every write, got %v", err)
+		}
+	}
+
+	//a backend that can't tell takes every write
+	s := NewStore(StoreOpts{Backend: NewMemoryBackend(), MinFreeSpace: 100})
+	if _, err := s.Write(generateID(), "a", bytes.NewReader([]byte("a"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := noSpace(&os.PathError{Op: "write", Path: "a", Err: syscall.ENOSPC}); !errors.Is(err, ErrInsufficientStorage) {
+		t.Error("expected a full disk to be insufficient storage")
+	}
+}
+
+func TestStoreExport(t *testing.T) {
+	src := NewStore(StoreOpts{Backend: NewMemoryBackend(), Chunking: true, Codec: GzipCodec{}})
+	id := generateID()
+	objects := map[string]string{
+		"a":             "first object",
+		"dir/b with /?": "a key that is no file name",
+		"empty":         "",
+	}
+	for key, data := range objects {
+		if _, err := src.WriteWithOpts(id, key, bytes.NewReader([]byte(data)), WriteOpts{Metadata: map[string]string{"k": key}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.Pin(id, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := new(bytes.Buffer)
+	n, err := src.Export(archive, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(objects) {
+		t.Errorf("expected %d objects exported, got %d", len(objects), n)
+	}
+
+	dst := NewStore(StoreOpts{Backend: NewMemoryBackend()})
+	if n, err := dst.Import(bytes.NewReader(archive.Bytes())); err != nil || n != len(objects) {
+		t.Fatalf("expected %d objects imported, got %d (%v)", len(objects), n, err)
+	}
+	for key, data := range objects {
+		_, r, err := dst.Read(id, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		r.Close()
+		if string(b) != data {
+			t.Errorf("[%s] expected %q, got %q", key, data, b)
+		}
+		meta, _ := dst.Stat(id, key)
+		if meta.Metadata["k"] != key {
+			t.Errorf("[%s] expected its metadata to be imported, got %v", key, meta.Metadata)
+		}
+	}
+	if meta, _ := dst.Stat(id, "a"); !meta.Pinned() {
+		t.Error("expected the pin to be imported")
+	}
+
+	//an incremental archive only has what changed, and importing
+	//it again doesn't write anything
+	since := time.Now()
+	time.Sleep(time.Millisecond * 5)
+	if _, err := src.Write(id, "c", bytes.NewReader([]byte("new"))); err != nil {
+		t.Fatal(err)
+	}
+	archive.Reset()
+	if n, err := src.Export(archive, since); err != nil || n != 1 {
+		t.Fatalf("expected 1 object exported, got %d (%v)", n, err)
+	}
+	if n, err := dst.Import(bytes.NewReader(archive.Bytes())); err != nil || n != 1 {
+		t.Fatalf("expected 1 object imported, got %d (%v)", n, err)
+	}
+	if n, err := dst.Import(bytes.NewReader(archive.Bytes())); err != nil || n != 0 {
+		t.Errorf("expected nothing imported twice, got %d (%v)", n, err)
+	}
+}
+
+func TestStoreExportTombstones(t *testing.T) {
+	src := NewStore(StoreOpts{Backend: NewMemoryBackend(), Tombstones: true})
+	dst := NewStore(StoreOpts{Backend: NewMemoryBackend()})
+	id := generateID()
+	for _, key := range []string{"a", "b"} {
+		if _, err := src.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive := new(bytes.Buffer)
+	if _, err := src.Export(archive, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.Import(archive); err != nil {
+		t.Fatal(err)
+	}
+
+	//"a" stays deleted, "b" is written again so it has no tombstone
+	since := time.Now()
+	time.Sleep(time.Millisecond * 5)
+	for _, key := range []string{"a", "b"} {
+		if err := src.Delete(id, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := src.Write(id, "b", bytes.NewReader([]byte("b again"))); err != nil {
+		t.Fatal(err)
+	}
+
+	archive.Reset()
+	if n, err := src.Export(archive, since); err != nil || n != 2 {
+		t.Fatalf("expected an object and a tombstone exported, got %d (%v)", n, err)
+	}
+	if n, err := dst.Import(archive); err != nil || n != 2 {
+		t.Fatalf("expected an object stored and one deleted, got %d (%v)", n, err)
+	}
+	if _, err := dst.Stat(id, "a"); err == nil {
+		t.Error("expected the tombstone to delete [a]")
+	}
+	_, r, err := dst.Read(id, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if string(b) != "b again" {
+		t.Errorf("have %q for [b]", b)
+	}
+
+	//the tombstones aren't objects of the ID
+	if ids, _ := src.IDs(); len(ids) != 1 {
+		t.Errorf("tombstones show up as an ID: %v", ids)
+	}
+}
+
+func TestStoreExportSkipsEvictions(t *testing.T) {
+	src := NewStore(StoreOpts{Backend: NewMemoryBackend(), Tombstones: true, Cache: CacheOpts{MaxBytes: 8}})
+	dst := NewStore(StoreOpts{Backend: NewMemoryBackend()})
+	id := generateID()
+	write := func(key string, opts WriteOpts) {
+		if _, err := src.WriteWithOpts(id, key, bytes.NewReader([]byte("data")), opts); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	write("a", WriteOpts{Cached: true})
+	write("b", WriteOpts{Cached: true})
+	write("tmp", WriteOpts{ExpiresAt: time.Now().Add(50 * time.Millisecond)})
+	archive := new(bytes.Buffer)
+	if _, err := src.Export(archive, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.Import(archive); err != nil {
+		t.Fatal(err)
+	}
+
+	//"a" is evicted and "tmp" swept, neither is a deletion to export
+	since := time.Now()
+	time.Sleep(time.Millisecond * 5)
+	write("c", WriteOpts{Cached: true})
+	if src.Has(id, "a") {
+		t.Fatal("expected [a] to be evicted")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if swept, err := src.SweepExpired(); err != nil || len(swept) != 1 {
+		t.Fatalf("expected [tmp] swept, got %v (%v)", swept, err)
+	}
+
+	archive.Reset()
+	if n, err := src.Export(archive, since); err != nil || n != 1 {
+		t.Fatalf("expected only [c] exported, got %d (%v)", n, err)
+	}
+	if _, err := dst.Import(archive); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if !dst.Has(id, key) {
+			t.Errorf("expected [%s] on the other side", key)
+		}
+	}
+}
+
+func TestStoreHashedKeys(t *testing.T) {
+	fs := NewFSBackend(FSBackendOpts{
+		Root:                    t.TempDir(),
+		PathTransformFunc:       CASPathTransformFunc,
+		HashedPathTransformFunc: DigestPathTransformFunc,
+	})
+	s := NewStore(StoreOpts{Backend: fs})
+	id := generateID()
+
+	//a key that looks like the digest of another is just a key
+	key := "picture.png"
+	digest := SHA256KeyHasher{}.HashKey(key)
+	for _, k := range []string{key, digest} {
+		if _, err := s.Write(id, k, bytes.NewReader([]byte("bytes of "+k))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range []string{key, digest} {
+		_, r, err := s.Read(id, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(have) != "bytes of "+k {
+			t.Errorf("[%s] reads back %q (%v)", k, have, err)
+		}
+	}
+	if err := s.Delete(id, digest); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Has(id, key) {
+		t.Error("deleting the digest deleted the key")
+	}
+
+	//only a write that says so is laid out as a digest, at the path of its key
+	replicas := generateID()
+	if _, err := s.WriteWithOpts(replicas, digest, bytes.NewReader([]byte("replica")), WriteOpts{Hashed: true}); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := s.Stat(replicas, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := replicas + "/" + CASPathTransformFunc(key).FullPath(); meta.Path != want {
+		t.Errorf("replica at %s, want %s", meta.Path, want)
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//metadata a tier keeps next to an object it compressed itself,
+//the tiered backend takes it off again before anyone sees it
+const (
+	tierCodecKey = "tier.codec"
+	tierSizeKey = "tier.size"
+)
+
+//Tier is one level of a TieredBackend
+type Tier struct{
+	Name 	string
+	Backend Backend
+	//Codec compresses the objects that move into the tier, unless the
+	//store compressed them already. nil keeps them as they are.
+	Codec 	Codec
+	//MaxIdle is how long an object may go unread before Rebalance
+	//moves it down to the next tier, 0 keeps it in this one
+	MaxIdle time.Duration
+}
+
+type TieredBackendOpts struct{
+	//Tiers from the hottest to the coldest, new objects go to the first
+	Tiers []Tier
+	//PromoteOnRead moves an object that is read from a lower tier
+	//back up to the first one before it is read
+	PromoteOnRead bool
+}
+
+//TieredBackend spreads the objects of a store over several backends,
+//say one in RAM, one on disk and a compressed archive. Every object is
+//in one tier, reads find it wherever it is, and objects move down as
+//they go unread or wherever Move puts them.
+type TieredBackend struct{
+	TieredBackendOpts
+
+	//held while an object is put in place or moved, so
+	//it is never left behind in two tiers
+	mu 			sync.Mutex
+
+	readLock 	sync.Mutex
+	//when every object was last read since the backend was opened
+	lastRead 	map[string]map[string]time.Time
+}
+
+func NewTieredBackend(opts TieredBackendOpts) (*TieredBackend, error){
+	if len(opts.Tiers) == 0{
+		return nil, fmt.Errorf("a tiered backend needs at least one tier")
+	}
+	for i, t := range opts.Tiers{
+		if t.Backend == nil{
+			return nil, fmt.Errorf("tier (%s) has no backend", t.Name)
+		}
+		if len(t.Name) == 0{
+			opts.Tiers[i].Name = strconv.Itoa(i)
+		}
+	}
+
+	return &TieredBackend{
+		TieredBackendOpts: 	opts,
+		lastRead: 			make(map[string]map[string]time.Time),
+	}, nil
+}
+
+func (b *TieredBackend) Put(id string, key string) (BlobWriter, error){
+	w, err := b.Tiers[0].Backend.Put(id, key)
+	if err != nil{
+		return nil, err
+	}
+	return &tieredBlobWriter{BlobWriter: w, backend: b, id: id, key: key}, nil
+}
+
+//tieredBlobWriter writes to the first tier and removes the object
+//from the others once it is committed
+type tieredBlobWriter struct{
+	BlobWriter
+	backend *TieredBackend
+	id 		string
+	key 	string
+}
+
+func (w *tieredBlobWriter) Commit(meta ObjectMeta) error{
+	b := w.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	meta.Metadata = withoutTierMeta(meta.Metadata)
+	if err := w.BlobWriter.Commit(meta); err != nil{
+		return err
+	}
+	b.touch(w.id, w.key)
+
+	for _, t := range b.Tiers[1:]{
+		if err := t.Backend.Delete(w.id, w.key); err != nil{
+			return err
+		}
+	}
+	return nil
+}
+
+//locate returns the tier the object is in and its metadata as
+//that tier stores it
+func (b *TieredBackend) locate(id string, key string) (int, ObjectMeta, error){
+	for i, t := range b.Tiers{
+		meta, err := t.Backend.Stat(id, key)
+		if err == nil{
+			return i, meta, nil
+		}
+		if !errors.Is(err, os.ErrNotExist){
+			return 0, ObjectMeta{}, err
+		}
+	}
+	return 0, ObjectMeta{}, errNotExist(id, key)
+}
+
+func (b *TieredBackend) Get(id string, key string) (int64, io.ReadCloser, error){
+	return b.ReadRange(id, key, 0, 0)
+}
+
+func (b *TieredBackend) ReadRange(id string, key string, offset int64, length int64) (int64, io.ReadCloser, error){
+	i, meta, err := b.locate(id, key)
+	if err != nil{
+		return 0, nil, err
+	}
+	if b.PromoteOnRead && i > 0{
+		if err := b.Move(id, key, b.Tiers[0].Name); err != nil{
+			log.Printf("promoting [%s] of (%s) failed: %s", key, id, err)
+		} else if i, meta, err = b.locate(id, key); err != nil{
+			return 0, nil, err
+		}
+	}
+	b.touch(id, key)
+	return b.readFrom(i, meta, offset, length)
+}
+
+//readFrom reads a range of the object stored as meta in tier i
+func (b *TieredBackend) readFrom(i int, meta ObjectMeta, offset int64, length int64) (int64, io.ReadCloser, error){
+	t, id, key := b.Tiers[i], meta.ID, meta.Key
+	codecName, ok := meta.Metadata[tierCodecKey]
+	if !ok{
+		return t.Backend.ReadRange(id, key, offset, length)
+	}
+
+	//compressed by the tier, the range is cut out after decompressing
+	codec, err := codecByName(codecName)
+	if err != nil{
+		return 0, nil, err
+	}
+	size, _ := strconv.ParseInt(meta.Metadata[tierSizeKey], 10, 64)
+	n, err := rangeSize(key, size, offset, length)
+	if err != nil{
+		return 0, nil, err
+	}
+
+	_, rc, err := t.Backend.Get(id, key)
+	if err != nil{
+		return 0, nil, err
+	}
+	r, err := decode(codec, rc)
+	if err != nil{
+		rc.Close()
+		return 0, nil, err
+	}
+	if _, err := io.CopyN(io.Discard, r, offset); err != nil{
+		rc.Close()
+		return 0, nil, err
+	}
+	return n, &sectionReadCloser{Reader: io.LimitReader(r, n), Closer: rc}, nil
+}
+
+func (b *TieredBackend) Stat(id string, key string) (ObjectMeta, error){
+	_, meta, err := b.locate(id, key)
+	if err != nil{
+		return ObjectMeta{}, err
+	}
+	meta.Metadata = withoutTierMeta(meta.Metadata)
+	return meta, nil
+}
+
+func (b *TieredBackend) SetMeta(meta ObjectMeta) error{
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i, stored, err := b.locate(meta.ID, meta.Key)
+	if err != nil{
+		return err
+	}
+
+	//keep what the tier needs to read the object back
+	md := withoutTierMeta(meta.Metadata)
+	for _, k := range []string{tierCodecKey, tierSizeKey}{
+		if v, ok := stored.Metadata[k]; ok{
+			if md == nil{
+				md = make(map[string]string)
+			}
+			md[k] = v
+		}
+	}
+	meta.Metadata = md
+	return b.Tiers[i].Backend.SetMeta(meta)
+}
+
+func (b *TieredBackend) Delete(id string, key string) error{
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, t := range b.Tiers{
+		if err := t.Backend.Delete(id, key); err != nil{
+			return err
+		}
+	}
+
+	b.readLock.Lock()
+	delete(b.lastRead[id], key)
+	b.readLock.Unlock()
+	return nil
+}
+
+//List merges the objects of every tier, an object caught half way
+//through a move is listed once
+func (b *TieredBackend) List(id string, prefix string) ([]ObjectMeta, error){
+	seen := make(map[string]bool)
+	metas := []ObjectMeta{}
+	for _, t := range b.Tiers{
+		tierMetas, err := t.Backend.List(id, prefix)
+		if err != nil{
+			return nil, err
+		}
+		for _, meta := range tierMetas{
+			if seen[meta.Key]{
+				continue
+			}
+			seen[meta.Key] = true
+			meta.Metadata = withoutTierMeta(meta.Metadata)
+			metas = append(metas, meta)
+		}
+	}
+
+	sort.Slice(metas, func(i, j int) bool{
+		return metas[i].Key < metas[j].Key
+	})
+	return metas, nil
+}
+
+func (b *TieredBackend) IDs() ([]string, error){
+	seen := make(map[string]bool)
+	ids := []string{}
+	for _, t := range b.Tiers{
+		tierIDs, err := t.Backend.IDs()
+		if err != nil{
+			return nil, err
+		}
+		for _, id := range tierIDs{
+			if !seen[id]{
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (b *TieredBackend) Clear() error{
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, t := range b.Tiers{
+		if err := t.Backend.Clear(); err != nil{
+			return err
+		}
+	}
+
+	b.readLock.Lock()
+	b.lastRead = make(map[string]map[string]time.Time)
+	b.readLock.Unlock()
+	return nil
+}
+
+//Close closes the tiers that have to be closed
+func (b *TieredBackend) Close() error{
+	var err error
+	for _, t := range b.Tiers{
+		if c, ok := t.Backend.(io.Closer); ok{
+			if cerr := c.Close(); err == nil{
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+//TierOf returns the name of the tier the object is in
+func (b *TieredBackend) TierOf(id string, key string) (string, error){
+	i, _, err := b.locate(id, key)
+	if err != nil{
+		return "", err
+	}
+	return b.Tiers[i].Name, nil
+}
+
+func (b *TieredBackend) tierIndex(name string) (int, error){
+	for i, t := range b.Tiers{
+		if t.Name == name{
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no tier (%s)", name)
+}
+
+//Move puts the object in the named tier, compressing or
+//decompressing it on the way as the tiers want it
+func (b *TieredBackend) Move(id string, key string, tier string) error{
+	to, err := b.tierIndex(tier)
+	if err != nil{
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	from, meta, err := b.locate(id, key)
+	if err != nil || from == to{
+		return err
+	}
+
+	size, r, err := b.readFrom(from, meta, 0, 0)
+	if err != nil{
+		return err
+	}
+	defer r.Close()
+
+	dst := b.Tiers[to]
+	w, err := dst.Backend.Put(id, key)
+	if err != nil{
+		return err
+	}
+	defer w.Abort()
+
+	meta.Path = ""
+	meta.Metadata = withoutTierMeta(meta.Metadata)
+
+	//objects the store compressed are left alone
+	codec := dst.Codec
+	if len(meta.Codec) > 0{
+		codec = nil
+	}
+	if _, err := encode(codec, w, r); err != nil{
+		return err
+	}
+	if codec != nil{
+		meta.Metadata = withTierMeta(meta.Metadata, codec.Name(), size)
+	}
+
+	if err := w.Commit(meta); err != nil{
+		return err
+	}
+	return b.Tiers[from].Backend.Delete(id, key)
+}
+
+//Rebalance moves every object that went unread for longer than the
+//MaxIdle of its tier down to the next tier, and returns how many moved.
+//Objects not read since the backend was opened count from when they
+//were last written.
+func (b *TieredBackend) Rebalance() (int, error){
+	moved := 0
+	for i, t := range b.Tiers[:len(b.Tiers) - 1]{
+		if t.MaxIdle <= 0{
+			continue
+		}
+		ids, err := t.Backend.IDs()
+		if err != nil{
+			return moved, err
+		}
+
+		next := b.Tiers[i + 1].Name
+		for _, id := range ids{
+			metas, err := t.Backend.List(id, "")
+			if err != nil{
+				return moved, err
+			}
+			for _, meta := range metas{
+				if time.Since(b.readAt(meta)) <= t.MaxIdle{
+					continue
+				}
+				if err := b.Move(id, meta.Key, next); err != nil{
+					return moved, err
+				}
+				moved++
+			}
+		}
+	}
+	return moved, nil
+}
+
+func (b *TieredBackend) touch(id string, key string){
+	b.readLock.Lock()
+	defer b.readLock.Unlock()
+
+	keys, ok := b.lastRead[id]
+	if !ok{
+		keys = make(map[string]time.Time)
+		b.lastRead[id] = keys
+	}
+	keys[key] = time.Now()
+}
+
+//readAt returns when the object was last read
+func (b *TieredBackend) readAt(meta ObjectMeta) time.Time{
+	b.readLock.Lock()
+	defer b.readLock.Unlock()
+
+	if t, ok := b.lastRead[meta.ID][meta.Key]; ok{
+		return t
+	}
+	return meta.ModifiedAt
+}
+
+func withTierMeta(md map[string]string, codec string, size int64) map[string]string{
+	out := make(map[string]string, len(md) + 2)
+	for k, v := range md{
+		out[k] = v
+	}
+	out[tierCodecKey] = codec
+	out[tierSizeKey] = strconv.FormatInt(size, 10)
+	return out
+}
+
+//withoutTierMeta returns md without the metadata of the tiers
+func withoutTierMeta(md map[string]string) map[string]string{
+	if _, ok := md[tierCodecKey]; !ok{
+		return md
+	}
+
+	out := make(map[string]string, len(md))
+	for k, v := range md{
+		if k != tierCodecKey && k != tierSizeKey{
+			out[k] = v
+		}
+	}
+	if len(out) == 0{
+		return nil
+	}
+	return out
+}
+
+//StartTiering rebalances the tiers of the store every interval (an
+//hour if it is not set) until the server is stopped. It does nothing
+//unless the store is on a TieredBackend.
+func (s *FileServer) StartTiering(interval time.Duration){
+	backend := s.store.Backend
+	if e, ok := backend.(*EncryptedBackend); ok{
+		backend = e.Backend
+	}
+	b, ok := backend.(*TieredBackend)
+	if !ok{
+		return
+	}
+	if interval <= 0{
+		interval = time.Hour
+	}
+
+	go func(){
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for{
+			select{
+			case <- ticker.C:
+				moved, err := b.Rebalance()
+				if err != nil{
+					log.Printf("[%s] moving objects between tiers failed: %s", s.Transport.Addr(), err)
+				}
+				if moved > 0{
+					fmt.Printf("[%s] moved (%d) objects to colder tiers\n", s.Transport.Addr(), moved)
+				}
+
+			case <- s.qiutch:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	//old versions of the objects of an ID are kept under the ID
+	//"versions/<id>", IDs are hex so this can never clash with one of them
+	versionsFolderName = "versions"
+
+	//an old version is stored under its key, this and its version ID
+	versionSep = "@"
+)
+
+//ObjectVersion is one version of an object
+type ObjectVersion struct{
+	ObjectMeta
+	//Current is set for the version Read returns
+	Current bool
+}
+
+//RetentionPolicy says which old versions of a key are pruned. A version
+//is pruned as soon as one of the rules says so, a rule that is 0 is off.
+type RetentionPolicy struct{
+	//KeepLast is how many old versions are kept besides the current one
+	KeepLast int
+	//KeepFor is how long an old version is kept once it was replaced
+	KeepFor time.Duration
+}
+
+//newVersionID returns a version ID that sorts after every
+//version ID made before t
+func newVersionID(t time.Time) string{
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	return fmt.Sprintf("%016x%08x", t.UnixNano(), binary.BigEndian.Uint32(suffix[:]))
+}
+
+//versionNamespace is the ID the old versions of the objects of id are stored under
+func versionNamespace(id string) string{
+	return versionsFolderName + "/" + id
+}
+
+func versionKey(key string, versionID string) string{
+	return key + versionSep + versionID
+}
+
+//splitVersionKey splits the key an old version is stored under
+//into the key of the object and the version ID
+func splitVersionKey(k string) (string, string, bool){
+	i := strings.LastIndex(k, versionSep)
+	if i < 0{
+		return "", "", false
+	}
+	return k[:i], k[i + len(versionSep):], true
+}
+
+//archiveVersion stores the current version of an object again next to
+//the other old versions of its key, without its pin, linked rather than
+//copied when the backend can. A chunked version keeps the references on
+//its chunks. It returns the version ID the old version is stored under.
+//chunkLock must be held.
+func (s *Store) archiveVersion(meta ObjectMeta) (string, error){
+	if len(meta.VersionID) == 0{
+		//written before versioning was turned on
+		meta.VersionID = newVersionID(meta.ModifiedAt)
+	}
+	//the pin stays with the key, old versions are left to the retention policy
+	meta.Metadata = withPin(meta.Metadata, false)
+
+	to := meta
+	//the version key is no digest, even when the key is
+	to.ID, to.Key, to.Path, to.Hashed = versionNamespace(meta.ID), versionKey(meta.Key, meta.VersionID), "", false
+	if err := s.copyObject(meta, to); err != nil{
+		return "", err
+	}
+	s.countUsage(to.ID, meta.Size, 1)
+	return meta.VersionID, nil
+}
+
+//locateVersion returns the metadata of a version as it is stored in the
+//backend, an empty versionID means the current version
+func (s *Store) locateVersion(id string, key string, versionID string) (ObjectMeta, error){
+	meta, err := s.Stat(id, key)
+	if err == nil && (len(versionID) == 0 || meta.VersionID == versionID){
+		return meta, nil
+	}
+	if len(versionID) == 0{
+		return ObjectMeta{}, err
+	}
+	return s.Backend.Stat(versionNamespace(id), versionKey(key, versionID))
+}
+
+//StatVersion returns the metadata of a version of the object
+func (s *Store) StatVersion(id string, key string, versionID string) (ObjectMeta, error){
+	meta, err := s.locateVersion(id, key, versionID)
+	if err != nil{
+		return ObjectMeta{}, err
+	}
+	meta.ID, meta.Key = id, key
+	return meta, nil
+}
+
+//ReadVersion streams a version of the object, checked against its
+//checksum like Read. An empty versionID reads the current version.
+func (s *Store) ReadVersion(id string, key string, versionID string) (int64, io.ReadCloser, error){
+	meta, err := s.locateVersion(id, key, versionID)
+	if err != nil{
+		return 0, nil, err
+	}
+
+	n, r, err := s.readMetaRange(meta, id, 0, 0)
+	if err != nil || len(meta.Checksum) == 0{
+		return n, r, err
+	}
+
+	v, err := newChecksumReader(r, meta.Checksum)
+	if err != nil{
+		r.Close()
+		return 0, nil, err
+	}
+	return n, &verifiedReadCloser{verifyReader: v, Closer: r}, nil
+}
+
+//ReadVersionRange is ReadRange for a version of the object
+func (s *Store) ReadVersionRange(id string, key string, versionID string, offset int64, length int64) (int64, io.ReadCloser, error){
+	meta, err := s.locateVersion(id, key, versionID)
+	if err != nil{
+		return 0, nil, err
+	}
+	return s.readMetaRange(meta, id, offset, length)
+}
+
+//ListVersions returns every version of the objects of id whose key
+//starts with prefix, sorted by key and newest first for every key
+func (s *Store) ListVersions(id string, prefix string) ([]ObjectVersion, error){
+	current, err := s.Backend.List(id, prefix)
+	if err != nil{
+		return nil, err
+	}
+	old, err := s.Backend.List(versionNamespace(id), prefix)
+	if err != nil{
+		return nil, err
+	}
+
+	versions := []ObjectVersion{}
+	currentIDs := make(map[string]string)
+	for _, meta := range current{
+		currentIDs[meta.Key] = meta.VersionID
+		versions = append(versions, ObjectVersion{ObjectMeta: meta, Current: true})
+	}
+
+	for _, meta := range old{
+		key, versionID, ok := splitVersionKey(meta.Key)
+		if !ok || !strings.HasPrefix(key, prefix){
+			continue
+		}
+		//left behind by a write that failed after archiving it
+		if cur, ok := currentIDs[key]; ok && cur == versionID{
+			continue
+		}
+		meta.ID, meta.Key, meta.VersionID = id, key, versionID
+		versions = append(versions, ObjectVersion{ObjectMeta: meta})
+	}
+
+	sort.Slice(versions, func(i, j int) bool{
+		if versions[i].Key != versions[j].Key{
+			return versions[i].Key < versions[j].Key
+		}
+		if versions[i].Current != versions[j].Current{
+			return versions[i].Current
+		}
+		return versions[i].VersionID > versions[j].VersionID
+	})
+	return versions, nil
+}
+
+//DeleteVersion deletes an old version of the object and releases its
+//chunks, the current version is deleted with Delete
+func (s *Store) DeleteVersion(id string, key string, versionID string) error{
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
+
+	return s.deleteVersion(id, key, versionID)
+}
+
+//deleteVersion is DeleteVersion with chunkLock held
+func (s *Store) deleteVersion(id string, key string, versionID string) error{
+	if meta, err := s.Backend.Stat(id, key); err == nil && meta.VersionID == versionID{
+		return fmt.Errorf("[%s] version (%s) is the current one", key, versionID)
+	}
+
+	ns, vkey := versionNamespace(id), versionKey(key, versionID)
+	meta, err := s.Backend.Stat(ns, vkey)
+	if errors.Is(err, os.ErrNotExist){
+		return nil
+	}
+	if err != nil{
+		return err
+	}
+
+	var m *Manifest
+	if meta.Chunked{
+		if m, err = s.readManifest(ns, vkey); err != nil{
+			return err
+		}
+	}
+
+	if err := s.Backend.Delete(ns, vkey); err != nil{
+		return err
+	}
+	s.countUsage(ns, -meta.Size, -1)
+	if m != nil{
+		s.releaseChunks(id, m)
+	}
+	return nil
+}
+
+//PruneVersions deletes the old versions of the object the policy
+//doesn't keep and returns their version IDs
+func (s *Store) PruneVersions(id string, key string, policy RetentionPolicy) ([]string, error){
+	if policy.KeepLast <= 0 && policy.KeepFor <= 0{
+		return nil, nil
+	}
+
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
+
+	versions, err := s.ListVersions(id, key)
+	if err != nil{
+		return nil, err
+	}
+
+	pruned := []string{}
+	var (
+		old int
+		//when the version before the one looked at was written,
+		//which is when that one stopped being current
+		replacedAt time.Time
+	)
+	for _, v := range versions{
+		if v.Key != key{
+			continue
+		}
+		if v.Current{
+			replacedAt = v.ModifiedAt
+			continue
+		}
+
+		if replacedAt.IsZero(){
+			//the object was deleted, there is nothing newer
+			replacedAt = v.ModifiedAt
+		}
+
+		old++
+		expired := policy.KeepFor > 0 && time.Since(replacedAt) > policy.KeepFor
+		if expired || (policy.KeepLast > 0 && old > policy.KeepLast){
+			if err := s.deleteVersion(id, key, v.VersionID); err != nil{
+				return pruned, err
+			}
+			pruned = append(pruned, v.VersionID)
+		}
+		replacedAt = v.ModifiedAt
+	}
+	return pruned, nil
+}
+
+//MessagePruneVersions tells the peers which old versions of
+//a key the owner pruned, so they drop them as well
+type MessagePruneVersions struct{
+	ID 			string
+	Key 		string
+	VersionIDs 	[]string
+}
+
+//GetVersion is Get for a version of the file other than the current one
+func (s *FileServer) GetVersion(key string, versionID string) (io.ReadCloser, error){
+	if _, err := s.store.locateVersion(s.ID, key, versionID); err == nil{
+		fmt.Printf("[%s] serving version (%s) of file (%s) from local\n", s.Transport.Addr(), versionID, key)
+		_, r, err := s.store.ReadVersion(s.ID, key, versionID)
+		return r, err
+	}
+
+	return s.openRemoteVersion(key, versionID, 0, 0)
+}
+
+//PruneVersions applies the retention policy of the server to the
+//old versions of the file and has the peers drop the same ones
+func (s *FileServer) PruneVersions(key string) error{
+	pruned, err := s.store.PruneVersions(s.ID, key, s.Retention)
+	if err != nil || len(pruned) == 0{
+		return err
+	}
+
+	fmt.Printf("[%s] pruned (%d) old versions of (%s)\n", s.Transport.Addr(), len(pruned), key)
+
+	msg := Message{
+		Payload: MessagePruneVersions{
+			ID: 		s.ID,
+			Key: 		s.hashKey(key),
+			VersionIDs: pruned,
+		},
+	}
+	for _, peer := range s.peerList(){
+		if err := s.sendTo(peer, &msg); err != nil{
+			log.Printf("pruning versions on peer %s failed: %s", peer.RemoteAddr(), err)
+		}
+	}
+	return nil
+}
+
+//StartRetention applies the retention policy to every file of the server
+//every interval (an hour if it is not set) until the server is stopped,
+//KeepFor is only enforced by this
+func (s *FileServer) StartRetention(interval time.Duration){
+	if interval <= 0{
+		interval = time.Hour
+	}
+
+	go func(){
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for{
+			select{
+			case <- ticker.C:
+				if err := s.pruneAll(); err != nil{
+					log.Printf("[%s] applying retention failed: %s", s.Transport.Addr(), err)
+				}
+
+			case <- s.qiutch:
+				return
+			}
+		}
+	}()
+}
+
+func (s *FileServer) pruneAll() error{
+	versions, err := s.store.ListVersions(s.ID, "")
+	if err != nil{
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, v := range versions{
+		if v.Current || seen[v.Key]{
+			continue
+		}
+		seen[v.Key] = true
+
+		if err := s.PruneVersions(v.Key); err != nil{
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileServer) handleMessagePruneVersions(from string, msg MessagePruneVersions) error{
+	if err := s.checkReplicaID(msg.ID); err != nil{
+		return fmt.Errorf("peer %s pruning (%s): %w", from, msg.Key, err)
+	}
+
+	for _, versionID := range msg.VersionIDs{
+		if err := s.store.DeleteVersion(msg.ID, msg.Key, versionID); err != nil{
+			return err
+		}
+	}
+
+	fmt.Printf("[%s] pruned (%d) old versions of (%s) for %s\n", s.Transport.Addr(), len(msg.VersionIDs), msg.Key, from)
+	return nil
+}
+
+//versionOf returns the version ID of the current version of the file
+//this node stores, so a replica is stored as the same version
+func (s *FileServer) versionOf(key string) string{
+	meta, err := s.store.Stat(s.ID, key)
+	if err != nil{
+		return ""
+	}
+	return meta.VersionID
+}